@@ -0,0 +1,56 @@
+package sytralrt
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// StopAllowlist restricts the stops served by the api, a nil StopAllowlist allows every stop
+type StopAllowlist map[string]bool
+
+// NewStopAllowlist allows the stops given, normalized with NormalizeStopID if normalize is true
+// since the departures are then indexed by their normalized id
+func NewStopAllowlist(stopIDs []string, normalize bool) StopAllowlist {
+	allowlist := make(StopAllowlist, len(stopIDs))
+	for _, id := range stopIDs {
+		if normalize {
+			id = NormalizeStopID(id)
+		}
+		allowlist[id] = true
+	}
+	return allowlist
+}
+
+// ReadStopIDs reads a stop id per line, the empty lines and those starting with # are ignored
+func ReadStopIDs(file io.Reader) ([]string, error) {
+	var stopIDs []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		stopIDs = append(stopIDs, line)
+	}
+	return stopIDs, scanner.Err()
+}
+
+// Allows tells if the stop can be served
+func (a StopAllowlist) Allows(stopID string) bool {
+	return a == nil || a[stopID]
+}
+
+// filter returns the departures of the allowed stops only
+func (a StopAllowlist) filter(departures map[string][]Departure) map[string][]Departure {
+	if a == nil || departures == nil {
+		return departures
+	}
+	filtered := make(map[string][]Departure, len(a))
+	for stop, stopDepartures := range departures {
+		if a[stop] {
+			filtered[stop] = stopDepartures
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,30 @@
+package sytralrt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStopAllowlist(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	stopIDs, err := ReadStopIDs(strings.NewReader("# pilot\n1\n\n  2  \n"))
+	require.Nil(err)
+	assert.Equal([]string{"1", "2"}, stopIDs)
+
+	allowlist := NewStopAllowlist(append(stopIDs, "ABC"), true)
+	assert.True(allowlist.Allows("1"))
+	assert.True(allowlist.Allows("abc"))
+	assert.False(allowlist.Allows("3"))
+
+	departures := map[string][]Departure{"1": {{Stop: "1"}}, "3": {{Stop: "3"}}}
+	assert.Equal(map[string][]Departure{"1": {{Stop: "1"}}}, allowlist.filter(departures))
+
+	var all StopAllowlist
+	assert.True(all.Allows("3"))
+	assert.Equal(departures, all.filter(departures))
+}
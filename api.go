@@ -1,8 +1,21 @@
 package sytralrt
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/contrib/ginrus"
@@ -10,20 +23,214 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/transform"
+	"google.golang.org/protobuf/proto"
 )
 
 type DeparturesResponse struct {
 	Message    string       `json:"message,omitempty"`
 	Departures *[]Departure `json:"departures,omitempty"` // the pointer allow us to display an empty array in json
+	*Freshness
+}
+
+// departureJSONField is a field of the departures in the JSON responses, read from the json tag of Departure
+type departureJSONField struct {
+	index     int
+	name      string
+	omitEmpty bool
+}
+
+// departureJSONFields are the fields of the departures in the JSON responses, in the order of Departure
+var departureJSONFields = readDepartureJSONFields()
+
+func readDepartureJSONFields() []departureJSONField {
+	departureType := reflect.TypeOf(Departure{})
+	fields := make([]departureJSONField, 0, departureType.NumField())
+	for i := 0; i < departureType.NumField(); i++ {
+		tag := strings.Split(departureType.Field(i).Tag.Get("json"), ",")
+		if tag[0] == "-" || tag[0] == "" {
+			continue
+		}
+		field := departureJSONField{index: i, name: tag[0]}
+		for _, option := range tag[1:] {
+			field.omitEmpty = field.omitEmpty || option == "omitempty"
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// isDepartureJSONField tells if name is the name of a field of the departures in the JSON responses
+func isDepartureJSONField(name string) bool {
+	for _, field := range departureJSONFields {
+		if field.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmptyJSONValue tells if a field tagged omitempty is left out by encoding/json
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	}
+	return false
+}
+
+// DepartureFieldNames renames the fields of the departures returned by /departures,
+// for the clients whose contract uses other names
+type DepartureFieldNames map[string]string
+
+// ParseDepartureFieldNames reads a list of field=name, the fields that aren't listed keep their name
+func ParseDepartureFieldNames(list []string) (DepartureFieldNames, error) {
+	names := make(DepartureFieldNames, len(list))
+	used := make(map[string]string, len(list))
+	for _, field := range list {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid departure field name %q, format is field=name", field)
+		}
+		from, to := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if !isDepartureJSONField(from) {
+			return nil, fmt.Errorf("unknown departure field %q", from)
+		}
+		if other, ok := used[to]; ok {
+			return nil, fmt.Errorf("departure fields %s and %s are both named %s", other, from, to)
+		}
+		names[from] = to
+		used[to] = from
+	}
+	for _, field := range departureJSONFields {
+		if other, ok := used[field.name]; ok && names[field.name] == "" && other != field.name {
+			return nil, fmt.Errorf("departure field %s is named %s, like the field %s", other, field.name, field.name)
+		}
+	}
+	return names, nil
+}
+
+// renamedDepartures marshals departures with the fields renamed by names
+type renamedDepartures struct {
+	departures []Departure
+	names      DepartureFieldNames
+}
+
+// MarshalJSON writes the fields of the departures in the order of Departure, like encoding/json
+func (r renamedDepartures) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('[')
+	for i := range r.departures {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		departure := reflect.ValueOf(r.departures[i])
+		buffer.WriteByte('{')
+		first := true
+		for _, field := range departureJSONFields {
+			value := departure.Field(field.index)
+			if field.omitEmpty && isEmptyJSONValue(value) {
+				continue
+			}
+			name := field.name
+			if to, ok := r.names[name]; ok {
+				name = to
+			}
+			key, err := json.Marshal(name)
+			if err != nil {
+				return nil, err
+			}
+			data, err := json.Marshal(value.Interface())
+			if err != nil {
+				return nil, err
+			}
+			if !first {
+				buffer.WriteByte(',')
+			}
+			first = false
+			buffer.Write(key)
+			buffer.WriteByte(':')
+			buffer.Write(data)
+		}
+		buffer.WriteByte('}')
+	}
+	buffer.WriteByte(']')
+	return buffer.Bytes(), nil
+}
+
+// Freshness tells the clients how old are the data they receive, it is only added to the responses
+// if a stale threshold is configured
+type Freshness struct {
+	Stale          bool    `json:"stale"`
+	DataAgeSeconds float64 `json:"data_age_seconds"`
+}
+
+// newFreshness returns the Freshness at now of data updated at lastUpdate, nil if no threshold is configured
+func newFreshness(now, lastUpdate time.Time, staleThreshold time.Duration) *Freshness {
+	if staleThreshold <= 0 || lastUpdate.IsZero() {
+		return nil
+	}
+	age := now.Sub(lastUpdate)
+	return &Freshness{
+		Stale:          age > staleThreshold,
+		DataAgeSeconds: age.Seconds(),
+	}
+}
+
+// Meta is the metadata of a list response wrapped in an Envelope
+type Meta struct {
+	GeneratedAt    time.Time `json:"generated_at"`
+	DataAgeSeconds float64   `json:"data_age_seconds"`
+	Count          int       `json:"count"`
+	Errors         []string  `json:"errors,omitempty"`
+}
+
+// Envelope is the structure of the list responses when the envelope mode is enabled
+type Envelope struct {
+	Meta Meta        `json:"meta"`
+	Data interface{} `json:"data"`
+}
+
+func newEnvelope(now, lastUpdate time.Time, data interface{}, count int, errors []string) Envelope {
+	meta := Meta{GeneratedAt: now, Count: count, Errors: errors}
+	if !lastUpdate.IsZero() {
+		meta.DataAgeSeconds = now.Sub(lastUpdate).Seconds()
+	}
+	return Envelope{Meta: meta, Data: data}
+}
+
+// wantEnvelope tells if a list response must be wrapped in an Envelope,
+// the envelope query parameter overrides the configuration
+func wantEnvelope(c *gin.Context, options RouterOptions) bool {
+	if envelope, err := strconv.ParseBool(c.Query("envelope")); err == nil {
+		return envelope
+	}
+	return options.Envelope
 }
 
 // StatusResponse defines the object returned by the /status endpoint
 type StatusResponse struct {
-	Status              string    `json:"status,omitempty"`
-	Version             string    `json:"version,omitempty"`
-	LastDepartureUpdate time.Time `json:"last_departure_update"`
-	LastParkingUpdate   time.Time `json:"last_parking_update"`
-	LastEquipmentUpdate time.Time `json:"last_equipment_update"`
+	Status                string    `json:"status,omitempty"`
+	Version               string    `json:"version,omitempty"`
+	LastDepartureUpdate   time.Time `json:"last_departure_update"`
+	LastParkingUpdate     time.Time `json:"last_parking_update"`
+	LastEquipmentUpdate   time.Time `json:"last_equipment_update"`
+	LastBikeStationUpdate time.Time `json:"last_bike_station_update"`
+	DeparturesCount       int       `json:"departures_count"`
+	ParkingsCount         int       `json:"parkings_count"`
+	EquipmentsCount       int       `json:"equipments_count"`
 }
 
 // ParkingResponse defines how a parking object is represent in a response
@@ -34,6 +241,7 @@ type ParkingResponse struct {
 	OccupiedSpaces            int       `json:"occupied"`
 	AvailableAccessibleSpaces int       `json:"available_PRM"`
 	OccupiedAccessibleSpaces  int       `json:"occupied_PRM"`
+	Coord                     *Coord    `json:"coord,omitempty"`
 }
 
 // ParkingModelToResponse converts the model of a Parking object into it's view in the response
@@ -45,7 +253,42 @@ func ParkingModelToResponse(p Parking) ParkingResponse {
 		OccupiedSpaces:            p.TotalStandardSpaces - p.AvailableStandardSpaces,
 		AvailableAccessibleSpaces: p.AvailableAccessibleSpaces,
 		OccupiedAccessibleSpaces:  p.TotalAccessibleSpaces - p.AvailableAccessibleSpaces,
+		Coord:                     p.Coord,
+	}
+}
+
+// BoundingBox is a geographic area, in WGS84 degrees
+type BoundingBox struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+// ParseBoundingBox reads a bounding box given as minLon,minLat,maxLon,maxLat
+func ParseBoundingBox(s string) (BoundingBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BoundingBox{}, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+	var values [4]float64
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return BoundingBox{}, fmt.Errorf("invalid bbox coordinate %q", part)
+		}
+		values[i] = value
+	}
+	box := BoundingBox{MinLon: values[0], MinLat: values[1], MaxLon: values[2], MaxLat: values[3]}
+	if box.MinLon < -180 || box.MaxLon > 180 || box.MinLat < -90 || box.MaxLat > 90 {
+		return BoundingBox{}, fmt.Errorf("bbox out of the longitudes [-180, 180] or the latitudes [-90, 90]")
+	}
+	if box.MinLon > box.MaxLon || box.MinLat > box.MaxLat {
+		return BoundingBox{}, fmt.Errorf("bbox minimums must not be greater than its maximums")
 	}
+	return box, nil
+}
+
+// Contains tells whether c is inside the box, its edges included
+func (b BoundingBox) Contains(c Coord) bool {
+	return c.Lon >= b.MinLon && c.Lon <= b.MaxLon && c.Lat >= b.MinLat && c.Lat <= b.MaxLat
 }
 
 type ByParkingResponseId []ParkingResponse
@@ -54,16 +297,158 @@ func (p ByParkingResponseId) Len() int           { return len(p) }
 func (p ByParkingResponseId) Less(i, j int) bool { return p[i].ID < p[j].ID }
 func (p ByParkingResponseId) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// ByParkingResponseAvailability sorts parkings by decreasing number of available spaces
+type ByParkingResponseAvailability []ParkingResponse
+
+func (p ByParkingResponseAvailability) Len() int      { return len(p) }
+func (p ByParkingResponseAvailability) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p ByParkingResponseAvailability) Less(i, j int) bool {
+	if p[i].AvailableSpaces == p[j].AvailableSpaces {
+		return p[i].ID < p[j].ID
+	}
+	return p[i].AvailableSpaces > p[j].AvailableSpaces
+}
+
 // ParkingsResponse defines the structure returned by the /parkings endpoint
 type ParkingsResponse struct {
 	Parkings []ParkingResponse `json:"records,omitempty"`
 	Errors   []string          `json:"errors,omitempty"`
+	*Freshness
+}
+
+// BikeStationsResponse defines the structure returned by the /bikestations endpoint
+type BikeStationsResponse struct {
+	BikeStations []BikeStation `json:"bike_stations,omitempty"`
+	Errors       []string      `json:"errors,omitempty"`
+	*Freshness
+}
+
+// compactEquipments marshals equipments without their empty fields, the zero times included
+type compactEquipments []EquipmentDetail
+
+type compactEquipment struct {
+	ID                  string              `json:"id,omitempty"`
+	Name                string              `json:"name,omitempty"`
+	EmbeddedType        string              `json:"embedded_type,omitempty"`
+	CurrentAvailability compactAvailability `json:"current_availaibity"`
+}
+
+type compactAvailability struct {
+	Status    string          `json:"status,omitempty"`
+	Cause     *Cause          `json:"cause,omitempty"`
+	Effect    *Effect         `json:"effect,omitempty"`
+	Periods   []compactPeriod `json:"periods,omitempty"`
+	UpdatedAt *time.Time      `json:"updated_at,omitempty"`
+}
+
+type compactPeriod struct {
+	Begin *time.Time `json:"begin,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+// nonZeroTime returns nil for the zero time
+func nonZeroTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (e compactEquipments) MarshalJSON() ([]byte, error) {
+	compact := make([]compactEquipment, len(e))
+	for i, equipment := range e {
+		availability := equipment.CurrentAvailability
+		c := &compact[i]
+		c.ID, c.Name, c.EmbeddedType = equipment.ID, equipment.Name, equipment.EmbeddedType
+		c.CurrentAvailability.Status = availability.Status
+		c.CurrentAvailability.UpdatedAt = nonZeroTime(availability.UpdatedAt)
+		if availability.Cause.Label != "" {
+			c.CurrentAvailability.Cause = &Cause{Label: availability.Cause.Label}
+		}
+		if availability.Effect.Label != "" {
+			c.CurrentAvailability.Effect = &Effect{Label: availability.Effect.Label}
+		}
+		for _, period := range availability.Periods {
+			if !period.Begin.IsZero() || !period.End.IsZero() {
+				c.CurrentAvailability.Periods = append(c.CurrentAvailability.Periods,
+					compactPeriod{Begin: nonZeroTime(period.Begin), End: nonZeroTime(period.End)})
+			}
+		}
+	}
+	return json.Marshal(compact)
+}
+
+// wantCompact tells whether the empty fields of the equipments are omitted, the compact
+// parameter overrides RouterOptions.CompactEquipments
+func wantCompact(c *gin.Context, options RouterOptions) bool {
+	if compact, err := strconv.ParseBool(c.Query("compact")); err == nil {
+		return compact
+	}
+	return options.CompactEquipments
+}
+
+// equipmentsMaxAge returns the max_age parameter, or RouterOptions.EquipmentsMaxAge without it
+func equipmentsMaxAge(c *gin.Context, options RouterOptions) (time.Duration, error) {
+	param, ok := c.GetQuery("max_age")
+	if !ok {
+		return options.EquipmentsMaxAge, nil
+	}
+	maxAge, err := time.ParseDuration(param)
+	if err != nil || maxAge < 0 {
+		return 0, fmt.Errorf("invalid max_age %q, a positive duration like 2h is expected", param)
+	}
+	return maxAge, nil
+}
+
+// equipmentsWindow returns the offset and limit parameters paginating /equipments, limit is 0 without limit
+func equipmentsWindow(c *gin.Context) (offset, limit int, err error) {
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"offset", &offset}, {"limit", &limit}} {
+		if str, ok := c.GetQuery(param.name); ok {
+			if *param.value, err = strconv.Atoi(str); err != nil || *param.value < 0 {
+				return 0, 0, fmt.Errorf("invalid %s %q, a positive integer is expected", param.name, str)
+			}
+		}
+	}
+	return offset, limit, nil
+}
+
+// paginateEquipments returns the window of the equipments asked with equipmentsWindow and the status of the
+// response: 206 with a Content-Range header like "items 0-9/42" if the window doesn't hold every equipment,
+// "items */42" if it is empty, and 200 otherwise
+func paginateEquipments(c *gin.Context, equipments []EquipmentDetail, offset, limit int) ([]EquipmentDetail, int) {
+	total := len(equipments)
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+	if offset == 0 && end == total {
+		return equipments, http.StatusOK
+	}
+	if offset >= end {
+		c.Header("Content-Range", fmt.Sprintf("items */%d", total))
+		return []EquipmentDetail{}, http.StatusPartialContent
+	}
+	c.Header("Content-Range", fmt.Sprintf("items %d-%d/%d", offset, end-1, total))
+	return equipments[offset:end], http.StatusPartialContent
 }
 
 // EquipmentsResponse defines the structure returned by the /equipments endpoint
 type EquipmentsResponse struct {
 	Equipments []EquipmentDetail `json:"equipments_details,omitempty"`
 	Error      string            `json:"errors,omitempty"`
+	*Freshness
+}
+
+// serviceRegistry only holds the sytralrt metrics, without the go runtime and process ones of the default registry
+var serviceRegistry = prometheus.NewRegistry()
+
+// mustRegister registers the sytralrt metrics both in the default registry and in serviceRegistry
+func mustRegister(collector prometheus.Collector) {
+	prometheus.MustRegister(collector)
+	serviceRegistry.MustRegister(collector)
 }
 
 var (
@@ -84,9 +469,210 @@ var (
 		Help:      "current number of http request being served",
 	},
 	)
+
+	httpRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Subsystem: "http",
+		Name:      "rejected_total",
+		Help:      "number of http requests rejected because too many requests were being served",
+	})
 )
 
-func DeparturesHandler(manager *DataManager) gin.HandlerFunc {
+// RouterOptions defines the behavior of the web api
+type RouterOptions struct {
+	// UnknownStopNotFound makes /departures return a 404 for a stop that has never been in the departures
+	// data and isn't in the stops reference data, instead of an empty list of departures
+	UnknownStopNotFound bool
+
+	// DepartureFieldNames renames the fields of the departures returned by /departures
+	DepartureFieldNames DepartureFieldNames
+
+	// NormalizeStopIDs makes /departures look the stop up by its id normalized with NormalizeStopID,
+	// the departures must have been loaded with the same option
+	NormalizeStopIDs bool
+
+	// StopAllowlist restricts the stops served by the departures and board endpoints, the other stops
+	// are unknown even if they are in the data. Every stop is served if it is nil.
+	StopAllowlist StopAllowlist
+
+	// BoardAssociations are the equipments and parkings of each stop returned by /board/:stop
+	BoardAssociations map[string]BoardAssociation
+
+	// Envelope wraps the lists returned by /departures, /parkings/P+R, /equipments and /bikestations
+	// in an Envelope with their metadata, it can be overridden by the envelope query parameter
+	Envelope bool
+
+	// CompactEquipments omits the empty fields of the equipments of /equipments, unless ?compact=false
+	CompactEquipments bool
+
+	// EquipmentsMaxAge leaves out of /equipments the equipments not updated for longer, their status is probably
+	// wrong. It can be overridden by the max_age query parameter, there is no limit if it is 0.
+	EquipmentsMaxAge time.Duration
+
+	// EnablePprof exposes the net/http/pprof handlers under /debug/pprof, they require the admin token
+	// and are disabled without it
+	EnablePprof bool
+
+	// StaleThreshold is the age above which data are flagged as stale in the responses,
+	// the freshness of the data isn't given if it is 0
+	StaleThreshold time.Duration
+
+	// AdminToken is the bearer token required by the /admin, /raw and /debug/pprof endpoints, they are disabled if it is empty
+	AdminToken string
+
+	// SnapshotPath is the file written by POST /admin/snapshot, the endpoint is disabled if it is empty
+	SnapshotPath string
+
+	// MaintenanceMessage is the message of the 503 answered by the data endpoints while the maintenance mode
+	// is enabled with POST /admin/maintenance, DefaultMaintenanceMessage is used if it is empty
+	MaintenanceMessage string
+
+	// Sources are the configured data sources, exposed by /admin/sources and checked by /ready
+	Sources []Source
+
+	// ReadinessFailureThreshold is the number of consecutive failed loadings of a source after which
+	// the service isn't ready anymore, a single failure is enough if it is 0
+	ReadinessFailureThreshold int
+
+	// ReadinessGracePeriod is the time since the last successful loading of a source during which
+	// failures don't make the service not ready
+	ReadinessGracePeriod time.Duration
+
+	// ReadinessWarmup is the time the service stays not ready once every source has been loaded for
+	// the first time, to let the caches warm up before receiving traffic
+	ReadinessWarmup time.Duration
+
+	// MaxConnections is the maximum number of requests served concurrently, the requests above it
+	// are answered with a 503. /health, /ready, the metrics and the departures streams aren't limited.
+	// There is no limit if it is 0.
+	MaxConnections int
+
+	// Refreshers reload each configured data type on POST /admin/warmup
+	Refreshers []Refresher
+
+	// ServiceMetricsPath is the path exposing only the sytralrt metrics, for the scrapers that don't want
+	// the go runtime and process metrics of /metrics. They aren't exposed separately if it is empty.
+	ServiceMetricsPath string
+
+	// SourcesHealthCheck enables /health/sources, checking that the sources can be reached
+	SourcesHealthCheck bool
+
+	// SourcesHealthCacheTTL is the time during which the result of /health/sources is reused
+	// so that the probes don't hammer the sources
+	SourcesHealthCacheTTL time.Duration
+
+	// SourcesHealthTimeout is the time given to each source to answer /health/sources
+	SourcesHealthTimeout time.Duration
+
+	// EmptyDeparturesWhenNotLoaded makes /departures answer 200 with no departures and the header
+	// X-Data-Not-Ready: true instead of a 503 before the departures are loaded, for the clients that break on 503
+	EmptyDeparturesWhenNotLoaded bool
+
+	// BasePath prefixes the routes, for a service mounted under a path by a reverse proxy
+	BasePath string
+
+	// BasePathProbes also prefixes with BasePath the routes of the probes and of the metrics: /health,
+	// /health/sources, /ready, /metrics and ServiceMetricsPath
+	BasePathProbes bool
+
+	// ResponseCacheTTL is the maximum time during which the responses of /board are reused, they are
+	// recomputed as soon as the data is updated anyway. They aren't cached if it is 0.
+	ResponseCacheTTL time.Duration
+
+	// Networks are served along with the main network under /networks/<name>
+	Networks map[string]Network
+}
+
+// Network is a transport network served by the same deployment as the main one, with its own data
+type Network struct {
+	Manager *DataManager
+	// Sources are the data sources of the network, checked by /ready
+	Sources []Source
+	// Options are the options of the data routes of the network, those of the main network if nil.
+	// Only the options of the data routes are used, the probes and admin routes are the main ones.
+	Options *RouterOptions
+}
+
+// Refresher reloads a type of data, Refresh is typically a call to RefreshDeparturesWithOptions
+// or its equivalent for the other data types
+type Refresher struct {
+	DataType string
+	Refresh  func() error
+}
+
+// Source describes where a type of data is loaded from
+type Source struct {
+	DataType string
+	URI      url.URL
+	Refresh  time.Duration
+	// Password is the password of the user of URI if it has none, see RefreshOptions.Password
+	Password PasswordSource
+	// Headers are added to the http(s) requests checking URI, see RefreshOptions.Headers
+	Headers http.Header
+}
+
+// SourceResponse defines how a data source is represented in the /admin/sources response
+type SourceResponse struct {
+	DataType   string     `json:"type"`
+	Scheme     string     `json:"scheme"`
+	Refresh    string     `json:"refresh"`
+	Enabled    bool       `json:"enabled"`
+	LoadStatus LoadStatus `json:"load_status"`
+}
+
+// SourcesResponse defines the structure returned by the /admin/sources endpoint
+type SourcesResponse struct {
+	Sources []SourceResponse `json:"sources"`
+}
+
+// SourceHealth is the reachability of a data source in the /health/sources response
+type SourceHealth struct {
+	DataType  string    `json:"type"`
+	Scheme    string    `json:"scheme"`
+	Reachable bool      `json:"reachable"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// SourcesHealthResponse defines the structure returned by the /health/sources endpoint
+type SourcesHealthResponse struct {
+	Reachable bool           `json:"reachable"`
+	Sources   []SourceHealth `json:"sources"`
+}
+
+// DepartureLinesResponse defines the structure returned by the /departures/lines endpoint
+type DepartureLinesResponse struct {
+	// Lines is the number of departures of each line
+	Lines   map[string]int `json:"lines"`
+	Message string         `json:"message,omitempty"`
+}
+
+// DepartureChangesResponse defines the structure returned by the /departures/changes endpoint
+type DepartureChangesResponse struct {
+	// Version is the since_version to give to get the next changes
+	Version uint64 `json:"version"`
+	// Departures are all the departures of the stops whose departures changed, by stop
+	Departures   map[string][]Departure `json:"departures"`
+	RemovedStops []string               `json:"removed_stops,omitempty"`
+	Message      string                 `json:"message,omitempty"`
+}
+
+// BoardResponse defines the structure returned by the /board/:stop endpoint
+type BoardResponse struct {
+	StopID     string            `json:"stop_id"`
+	Departures []Departure       `json:"departures"`
+	Equipments []EquipmentDetail `json:"equipments"`
+	Parkings   []ParkingResponse `json:"parkings"`
+	Errors     []string          `json:"errors,omitempty"`
+}
+
+// ReadyResponse defines the structure returned by the /ready endpoint
+type ReadyResponse struct {
+	Ready   bool     `json:"ready"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+func DeparturesHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		response := DeparturesResponse{}
 		stopID := c.Query("stop_id")
@@ -95,95 +681,1135 @@ func DeparturesHandler(manager *DataManager) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, response)
 			return
 		}
-		departures, err := manager.GetDeparturesByStop(stopID)
+		lookupID := stopID
+		if options.NormalizeStopIDs {
+			lookupID = NormalizeStopID(stopID)
+		}
+		if !options.StopAllowlist.Allows(lookupID) {
+			response.Message = fmt.Sprintf("Unknown stop: %s", stopID)
+			c.JSON(http.StatusNotFound, response)
+			return
+		}
+		departures, known, err := manager.LookupDeparturesByStop(lookupID)
+		if err != nil && options.EmptyDeparturesWhenNotLoaded {
+			c.Header("X-Data-Not-Ready", "true")
+			if wantEnvelope(c, options) {
+				c.JSON(http.StatusOK, newEnvelope(manager.Now(), time.Time{}, departures, 0, []string{"No data loaded"}))
+				return
+			}
+			response.Departures = &departures
+			c.JSON(http.StatusOK, response)
+			return
+		}
 		if err != nil {
 			response.Message = "No data loaded"
 			c.JSON(http.StatusServiceUnavailable, response)
 			return
 		}
+		if !known && options.UnknownStopNotFound {
+			response.Message = fmt.Sprintf("Unknown stop: %s", stopID)
+			c.JSON(http.StatusNotFound, response)
+			return
+		}
+		lastUpdate := manager.GetLastDepartureDataUpdate()
+		// the departures are also modified by the enrichment with the stops
+		modified := lastUpdate
+		if stopsUpdate := manager.GetLastStopsDataUpdate(); stopsUpdate.After(modified) {
+			modified = stopsUpdate
+		}
+		if notModified(c, modified) {
+			return
+		}
+		departures = manager.EnrichDepartures(departures)
+		if len(options.DepartureFieldNames) > 0 {
+			renamed := renamedDepartures{departures, options.DepartureFieldNames}
+			if wantEnvelope(c, options) {
+				c.JSON(http.StatusOK, newEnvelope(manager.Now(), lastUpdate, renamed, len(departures), nil))
+				return
+			}
+			c.JSON(http.StatusOK, struct {
+				Departures renamedDepartures `json:"departures"`
+				*Freshness
+			}{renamed, newFreshness(manager.Now(), lastUpdate, options.StaleThreshold)})
+			return
+		}
+		if wantEnvelope(c, options) {
+			c.JSON(http.StatusOK, newEnvelope(manager.Now(), lastUpdate, departures, len(departures), nil))
+			return
+		}
 		response.Departures = &departures
+		response.Freshness = newFreshness(manager.Now(), lastUpdate, options.StaleThreshold)
 		c.JSON(http.StatusOK, response)
 	}
 }
 
-func StatusHandler(manager *DataManager) gin.HandlerFunc {
+// DepartureLinesHandler returns the number of departures of each line, only of the stop given by the
+// stop_id parameter if there is one
+func DepartureLinesHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.JSON(http.StatusOK, StatusResponse{
-			"ok",
-			SytralRTVersion,
-			manager.GetLastDepartureDataUpdate(),
-			manager.GetLastParkingsDataUpdate(),
-			manager.GetLastEquipmentsDataUpdate(),
-		})
+		var response DepartureLinesResponse
+		stopID := c.Query("stop_id")
+		if options.NormalizeStopIDs {
+			stopID = NormalizeStopID(stopID)
+		}
+		if stopID != "" && !options.StopAllowlist.Allows(stopID) {
+			response.Message = fmt.Sprintf("Unknown stop: %s", c.Query("stop_id"))
+			c.JSON(http.StatusNotFound, response)
+			return
+		}
+		lines, err := manager.CountDeparturesByLine(stopID)
+		if err != nil {
+			response.Message = "No data loaded"
+			c.JSON(http.StatusServiceUnavailable, response)
+			return
+		}
+		if notModified(c, manager.GetLastDepartureDataUpdate()) {
+			return
+		}
+		response.Lines = lines
+		c.JSON(http.StatusOK, response)
 	}
 }
 
-func ParkingsHandler(manager *DataManager) gin.HandlerFunc {
+// departuresStreamKeepAlive is the time between two comments sent on the idle departures streams, so that
+// the proxies don't close them
+var departuresStreamKeepAlive = 30 * time.Second
+
+// DeparturesStreamHandler streams the departures of a stop as Server-Sent Events: the current departures
+// first, then the departures each time they change. The id of the events is the version of the departures
+// of the stop, a client reconnecting with this id as Last-Event-ID doesn't get them again if they didn't change.
+func DeparturesStreamHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var (
-			parkings []Parking
-			errStr   []string
-		)
+		stopID := c.Param("stop")
+		lookupID := stopID
+		if options.NormalizeStopIDs {
+			lookupID = NormalizeStopID(stopID)
+		}
+		if !options.StopAllowlist.Allows(lookupID) {
+			c.JSON(http.StatusNotFound, DeparturesResponse{Message: fmt.Sprintf("Unknown stop: %s", stopID)})
+			return
+		}
+		if _, known, _, err := manager.lookupStopVersion(lookupID); err == nil && !known && options.UnknownStopNotFound {
+			c.JSON(http.StatusNotFound, DeparturesResponse{Message: fmt.Sprintf("Unknown stop: %s", stopID)})
+			return
+		}
+		// the streams would hold the shutdown, the clients reconnect to another instance
+		draining := manager.DrainingStarted()
+		if manager.IsDraining() {
+			c.JSON(http.StatusServiceUnavailable, DeparturesResponse{Message: "shutting down"})
+			return
+		}
 
-		if ids, ok := c.GetQueryArray("ids[]"); ok {
-			// Only query parkings with a specific id
-			var errs []error
-			parkings, errs = manager.GetParkingsByIds(ids)
-			for _, e := range errs {
-				errStr = append(errStr, e.Error())
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		// nginx would buffer the events otherwise
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		lastID := c.GetHeader("Last-Event-ID")
+		keepAlive := time.NewTicker(departuresStreamKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			// the channel is taken before reading the departures so that no update is missed
+			updated := manager.DeparturesUpdated()
+			// the departures aren't sent until they are loaded
+			if departures, _, version, err := manager.lookupStopVersion(lookupID); err == nil {
+				if id := strconv.FormatUint(version, 10); id != lastID {
+					if err := writeDeparturesEvent(c.Writer, id, manager.EnrichDepartures(departures), options); err != nil {
+						logrus.Debugf("Departures stream of %s interrupted: %s", stopID, err)
+						return
+					}
+					lastID = id
+				}
 			}
-		} else {
-			// Query all parkings !
-			var err error
-			parkings, err = manager.GetParkings()
-			if err != nil {
-				errStr = append(errStr, err.Error())
+			select {
+			case <-updated:
+			case <-keepAlive.C:
+				if _, err := io.WriteString(c.Writer, ": keepalive\n\n"); err != nil {
+					return
+				}
+				c.Writer.Flush()
+			case <-c.Request.Context().Done():
+				return
+			case <-draining:
+				logrus.Debugf("Departures stream of %s closed by the shutdown", stopID)
+				return
 			}
 		}
+	}
+}
 
-		// Convert Parkings from the model to a response view
-		parkingsResp := make([]ParkingResponse, len(parkings))
-		for i, p := range parkings {
-			parkingsResp[i] = ParkingModelToResponse(p)
-		}
-		c.JSON(http.StatusOK, ParkingsResponse{
-			Parkings: parkingsResp,
-			Errors:   errStr,
-		})
+// writeDeparturesEvent sends the departures as a departures event, their JSON is the one of /departures
+func writeDeparturesEvent(w gin.ResponseWriter, id string, departures []Departure, options RouterOptions) error {
+	var data interface{} = DeparturesResponse{Departures: &departures}
+	if len(options.DepartureFieldNames) > 0 {
+		data = struct {
+			Departures renamedDepartures `json:"departures"`
+		}{renamedDepartures{departures, options.DepartureFieldNames}}
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "id: %s\nevent: departures\ndata: %s\n\n", id, payload); err != nil {
+		return err
 	}
+	w.Flush()
+	return nil
 }
 
-func EquipmentsHandler(manager *DataManager) gin.HandlerFunc {
+// DepartureChangesHandler returns the departures of the stops that changed since the version given
+// by the since_version parameter, all of them without this parameter
+func DepartureChangesHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		response := EquipmentsResponse{}
-
-		equipments, err := manager.GetEquipments()
+		var response DepartureChangesResponse
+		var since uint64
+		if param := c.Query("since_version"); param != "" {
+			var err error
+			if since, err = strconv.ParseUint(param, 10, 64); err != nil {
+				response.Message = fmt.Sprintf("invalid since_version: %s", param)
+				c.JSON(http.StatusBadRequest, response)
+				return
+			}
+		}
+		departures, removed, version, err := manager.GetDeparturesChangedSince(since)
 		if err != nil {
-			response.Error = "No data loaded"
+			response.Message = "No data loaded"
 			c.JSON(http.StatusServiceUnavailable, response)
 			return
 		}
-		response.Equipments = equipments
+		response.Version = version
+		response.Departures = options.StopAllowlist.filter(departures)
+		for _, stop := range removed {
+			if options.StopAllowlist.Allows(stop) {
+				response.RemovedStops = append(response.RemovedStops, stop)
+			}
+		}
 		c.JSON(http.StatusOK, response)
 	}
 }
 
-func SetupRouter(manager *DataManager, r *gin.Engine) *gin.Engine {
-	if r == nil {
-		r = gin.New()
+// GTFSRTHandler returns all the departures as a GTFS-Realtime feed of trip updates, in the protobuf format
+func GTFSRTHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		departures := options.StopAllowlist.filter(manager.Snapshot().Departures)
+		if departures == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"message": "No data loaded"})
+			return
+		}
+		lastUpdate := manager.GetLastDepartureDataUpdate()
+		if notModified(c, lastUpdate) {
+			return
+		}
+		data, err := proto.Marshal(newGTFSRTFeed(departures, lastUpdate))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, "application/x-protobuf", data)
 	}
-	r.Use(ginrus.Ginrus(logrus.StandardLogger(), time.RFC3339, false))
-	r.Use(instrumentGin())
+}
+
+// DeparturesCSVHandler streams all the departures served as CSV, sorted by stop
+func DeparturesCSVHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		departures := options.StopAllowlist.filter(manager.Snapshot().Departures)
+		if departures == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"message": "No data loaded"})
+			return
+		}
+		if notModified(c, manager.GetLastDepartureDataUpdate()) {
+			return
+		}
+		stops := make([]string, 0, len(departures))
+		for stop := range departures {
+			stops = append(stops, stop)
+		}
+		sort.Strings(stops)
+
+		charset, encoder, err := csvCharset(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		c.Header("Content-Type", "text/csv; charset="+charset)
+		c.Header("Content-Disposition", `attachment; filename="departures.csv"`)
+		c.Header("Vary", "Accept-Charset")
+		c.Status(http.StatusOK)
+		output := io.Writer(c.Writer)
+		if encoder != nil {
+			transcoder := transform.NewWriter(c.Writer, encoder)
+			defer transcoder.Close()
+			output = transcoder
+		}
+		writer := csv.NewWriter(output)
+		writer.Write([]string{"stop", "line", "type", "direction", "direction_name", "datetime"})
+		for _, stop := range stops {
+			for _, d := range departures[stop] {
+				writer.Write([]string{d.Stop, d.Line, d.Type, d.Direction, d.DirectionName, d.Datetime.Format(time.RFC3339)})
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			logrus.Warnf("Impossible to write the departures CSV: %s", err)
+		}
+	}
+}
+
+// csvCharset returns the charset of a CSV response, given by the encoding parameter or else by the
+// Accept-Charset header, and its encoder. The encoder is nil for UTF-8, the default.
+// The characters that the charset can't represent are replaced.
+func csvCharset(c *gin.Context) (string, *encoding.Encoder, error) {
+	if name, ok := c.GetQuery("encoding"); ok {
+		charset, enc, known := outputCharset(name)
+		if !known {
+			return "", nil, fmt.Errorf("Unsupported encoding %q, expected utf-8, iso-8859-1 or windows-1252", name)
+		}
+		return charset, enc, nil
+	}
+	for _, accepted := range strings.Split(c.GetHeader("Accept-Charset"), ",") {
+		name := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		if name == "*" {
+			break
+		}
+		if charset, enc, known := outputCharset(name); known && name != "" {
+			return charset, enc, nil
+		}
+	}
+	return "utf-8", nil, nil
+}
+
+// outputCharset returns the canonical name and the encoder of a charset, and whether it is supported
+func outputCharset(name string) (string, *encoding.Encoder, bool) {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "", "UTF-8", "UTF8":
+		return "utf-8", nil, true
+	case "ISO-8859-1", "LATIN1":
+		return "iso-8859-1", encoding.ReplaceUnsupported(charmap.ISO8859_1.NewEncoder()), true
+	case "WINDOWS-1252", "CP1252":
+		return "windows-1252", encoding.ReplaceUnsupported(charmap.Windows1252.NewEncoder()), true
+	}
+	return "", nil, false
+}
+
+// BoardHandler returns everything known about a stop: its departures and the equipments and parkings
+// associated to it, all of them from the same snapshot of the data
+func BoardHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
+	associations := options.BoardAssociations
+	if options.NormalizeStopIDs {
+		associations = normalizeBoardAssociations(associations)
+	}
+	return func(c *gin.Context) {
+		stopID := c.Param("stop")
+		lookupID := stopID
+		if options.NormalizeStopIDs {
+			lookupID = NormalizeStopID(stopID)
+		}
+		if !options.StopAllowlist.Allows(lookupID) {
+			c.JSON(http.StatusNotFound, BoardResponse{StopID: stopID, Errors: []string{fmt.Sprintf("Unknown stop: %s", stopID)}})
+			return
+		}
+		snapshot := manager.Snapshot()
+		association, associated := associations[lookupID]
+
+		response := BoardResponse{
+			StopID:     stopID,
+			Departures: []Departure{},
+			Equipments: []EquipmentDetail{},
+			Parkings:   []ParkingResponse{},
+		}
+		known := manager.IsKnownStop(lookupID)
+		if snapshot.Departures == nil {
+			response.Errors = append(response.Errors, "No departures in the data")
+		} else if departures, ok := snapshot.Departures[lookupID]; ok {
+			response.Departures = manager.EnrichDepartures(departures)
+		}
+		if !known && !associated && options.UnknownStopNotFound {
+			response.Errors = append(response.Errors, fmt.Sprintf("Unknown stop: %s", stopID))
+			c.JSON(http.StatusNotFound, response)
+			return
+		}
+
+		if len(association.EquipmentIDs) > 0 {
+			wanted := make(map[string]bool, len(association.EquipmentIDs))
+			for _, id := range association.EquipmentIDs {
+				wanted[id] = true
+			}
+			for _, equipment := range snapshot.Equipments {
+				if wanted[equipment.ID] {
+					response.Equipments = append(response.Equipments, equipment)
+				}
+			}
+		}
+		for _, id := range association.ParkingIDs {
+			if parking, ok := snapshot.Parkings[id]; ok {
+				response.Parkings = append(response.Parkings, ParkingModelToResponse(parking))
+			} else {
+				response.Errors = append(response.Errors, fmt.Sprintf("No parkings found with id: %s", id))
+			}
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func StatusHandler(manager *DataManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, StatusResponse{
+			"ok",
+			SytralRTVersion,
+			manager.GetLastDepartureDataUpdate(),
+			manager.GetLastParkingsDataUpdate(),
+			manager.GetLastEquipmentsDataUpdate(),
+			manager.GetLastBikeStationsDataUpdate(),
+			manager.DeparturesCount(),
+			manager.ParkingsCount(),
+			manager.EquipmentsCount(),
+		})
+	}
+}
+
+func ParkingsHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var (
+			parkings []Parking
+			errStr   []string
+		)
+
+		minAvailable := 0
+		minAvailableStr, sortByAvailability := c.GetQuery("min_available")
+		if sortByAvailability {
+			var err error
+			if minAvailable, err = strconv.Atoi(minAvailableStr); err != nil || minAvailable < 0 {
+				c.JSON(http.StatusBadRequest, ParkingsResponse{
+					Errors: []string{"min_available must be a positive integer"},
+				})
+				return
+			}
+		}
+
+		var box *BoundingBox
+		if bbox, ok := c.GetQuery("bbox"); ok {
+			parsed, err := ParseBoundingBox(bbox)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, ParkingsResponse{Errors: []string{err.Error()}})
+				return
+			}
+			box = &parsed
+		}
+
+		lastUpdate := manager.GetLastParkingsDataUpdate()
+		if notModified(c, lastUpdate) {
+			return
+		}
+
+		if ids, ok := c.GetQueryArray("ids[]"); ok {
+			// Only query parkings with a specific id
+			var errs []error
+			parkings, errs = manager.GetParkingsByIds(ids)
+			for _, e := range errs {
+				errStr = append(errStr, e.Error())
+			}
+		} else {
+			// Query all parkings !
+			var err error
+			parkings, err = manager.GetParkings()
+			if err != nil {
+				errStr = append(errStr, err.Error())
+			}
+		}
+
+		// Convert Parkings from the model to a response view
+		parkingsResp := make([]ParkingResponse, 0, len(parkings))
+		for _, p := range parkings {
+			// the parkings without coordinates can't be located in the box
+			if box != nil && (p.Coord == nil || !box.Contains(*p.Coord)) {
+				continue
+			}
+			if p.AvailableStandardSpaces >= minAvailable {
+				parkingsResp = append(parkingsResp, ParkingModelToResponse(p))
+			}
+		}
+		if sortByAvailability {
+			sort.Sort(ByParkingResponseAvailability(parkingsResp))
+		}
+		if wantEnvelope(c, options) {
+			c.JSON(http.StatusOK, newEnvelope(manager.Now(), lastUpdate, parkingsResp, len(parkingsResp), errStr))
+			return
+		}
+		c.JSON(http.StatusOK, ParkingsResponse{
+			Parkings:  parkingsResp,
+			Errors:    errStr,
+			Freshness: newFreshness(manager.Now(), lastUpdate, options.StaleThreshold),
+		})
+	}
+}
+
+func BikeStationsHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var (
+			bikeStations []BikeStation
+			errStr       []string
+		)
+
+		lastUpdate := manager.GetLastBikeStationsDataUpdate()
+		if notModified(c, lastUpdate) {
+			return
+		}
+
+		if ids, ok := c.GetQueryArray("ids[]"); ok {
+			// Only query bike stations with a specific id
+			var errs []error
+			bikeStations, errs = manager.GetBikeStationsByIds(ids)
+			for _, e := range errs {
+				errStr = append(errStr, e.Error())
+			}
+		} else {
+			var err error
+			bikeStations, err = manager.GetBikeStations()
+			if err != nil {
+				errStr = append(errStr, err.Error())
+			}
+		}
+
+		if wantEnvelope(c, options) {
+			if bikeStations == nil {
+				bikeStations = []BikeStation{}
+			}
+			c.JSON(http.StatusOK, newEnvelope(manager.Now(), lastUpdate, bikeStations, len(bikeStations), errStr))
+			return
+		}
+		c.JSON(http.StatusOK, BikeStationsResponse{
+			BikeStations: bikeStations,
+			Errors:       errStr,
+			Freshness:    newFreshness(manager.Now(), lastUpdate, options.StaleThreshold),
+		})
+	}
+}
+
+func EquipmentsHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		response := EquipmentsResponse{}
+
+		maxAge, err := equipmentsMaxAge(c, options)
+		if err != nil {
+			response.Error = err.Error()
+			c.JSON(http.StatusBadRequest, response)
+			return
+		}
+		offset, limit, err := equipmentsWindow(c)
+		if err != nil {
+			response.Error = err.Error()
+			c.JSON(http.StatusBadRequest, response)
+			return
+		}
+		equipments, err := manager.GetEquipments()
+		if err != nil {
+			response.Error = "No data loaded"
+			c.JSON(http.StatusServiceUnavailable, response)
+			return
+		}
+		lastUpdate := manager.GetLastEquipmentsDataUpdate()
+		if maxAge > 0 {
+			// the equipments left out change with the time, not only with the data
+			now := manager.Now()
+			recent := make([]EquipmentDetail, 0, len(equipments))
+			for _, equipment := range equipments {
+				if now.Sub(equipment.CurrentAvailability.UpdatedAt) <= maxAge {
+					recent = append(recent, equipment)
+				}
+			}
+			equipments = recent
+		} else if notModified(c, lastUpdate) {
+			return
+		}
+		equipments, status := paginateEquipments(c, equipments, offset, limit)
+		if wantCompact(c, options) {
+			if wantEnvelope(c, options) {
+				c.JSON(status, newEnvelope(manager.Now(), lastUpdate, compactEquipments(equipments), len(equipments), nil))
+				return
+			}
+			c.JSON(status, struct {
+				Equipments compactEquipments `json:"equipments_details,omitempty"`
+				*Freshness
+			}{equipments, newFreshness(manager.Now(), lastUpdate, options.StaleThreshold)})
+			return
+		}
+		if wantEnvelope(c, options) {
+			c.JSON(status, newEnvelope(manager.Now(), lastUpdate, equipments, len(equipments), nil))
+			return
+		}
+		response.Equipments = equipments
+		response.Freshness = newFreshness(manager.Now(), lastUpdate, options.StaleThreshold)
+		c.JSON(status, response)
+	}
+}
+
+// notModified sets the Last-Modified header to the time of the last update of the data,
+// if the client already has this version a 304 is returned and the handler must stop there
+func notModified(c *gin.Context, lastUpdate time.Time) bool {
+	if lastUpdate.IsZero() {
+		return false
+	}
+	// http dates have a precision of one second
+	lastUpdate = lastUpdate.Truncate(time.Second)
+	c.Header("Last-Modified", lastUpdate.UTC().Format(http.TimeFormat))
+
+	ifModifiedSince, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	if err != nil || lastUpdate.After(ifModifiedSince) {
+		return false
+	}
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+func SourcesHandler(manager *DataManager, sources []Source) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		response := SourcesResponse{Sources: make([]SourceResponse, 0, len(sources))}
+		for _, source := range sources {
+			response.Sources = append(response.Sources, SourceResponse{
+				DataType:   source.DataType,
+				Scheme:     source.URI.Scheme,
+				Refresh:    source.Refresh.String(),
+				Enabled:    source.URI.String() != "",
+				LoadStatus: manager.GetLoadStatus(source.DataType),
+			})
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// sourcesChecker checks the reachability of the sources and caches the result during ttl
+type sourcesChecker struct {
+	manager *DataManager
+	sources []Source
+	ttl     time.Duration
+	timeout time.Duration
+	check   func(uri url.URL, headers http.Header, timeout time.Duration) error
+
+	mutex    sync.Mutex
+	response *SourcesHealthResponse
+	expires  time.Time
+}
+
+// get returns the cached reachability of the sources, checking them again once it expired.
+// Concurrent requests wait for the same check.
+func (s *sourcesChecker) get() SourcesHealthResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.response != nil && s.manager.Now().Before(s.expires) {
+		return *s.response
+	}
+
+	var configured []Source
+	sources := make([]SourceHealth, 0, len(s.sources))
+	for _, source := range s.sources {
+		if source.URI.String() != "" {
+			configured = append(configured, source)
+			sources = append(sources, SourceHealth{DataType: source.DataType, Scheme: source.URI.Scheme})
+		}
+	}
+	// the sources are checked in parallel so that an unreachable one doesn't delay the others
+	var wg sync.WaitGroup
+	for i := range sources {
+		wg.Add(1)
+		go func(health *SourceHealth, source Source) {
+			defer wg.Done()
+			uri, err := withPassword(source.URI, source.Password)
+			if err == nil {
+				err = s.check(uri, source.Headers, s.timeout)
+			}
+			if err != nil {
+				health.Error = err.Error()
+				return
+			}
+			health.Reachable = true
+		}(&sources[i], configured[i])
+	}
+	wg.Wait()
+
+	now := s.manager.Now()
+	response := SourcesHealthResponse{Reachable: true, Sources: sources}
+	for i := range response.Sources {
+		response.Sources[i].CheckedAt = now
+		response.Reachable = response.Reachable && response.Sources[i].Reachable
+	}
+	s.response = &response
+	s.expires = now.Add(s.ttl)
+	return response
+}
+
+// SourcesHealthHandler answers whether each configured source can currently be reached,
+// with a 503 if one of them can't
+func SourcesHealthHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
+	checker := &sourcesChecker{
+		manager: manager,
+		sources: options.Sources,
+		ttl:     options.SourcesHealthCacheTTL,
+		timeout: options.SourcesHealthTimeout,
+		check:   CheckSourceWithHeaders,
+	}
+	return sourcesHealthHandler(checker)
+}
+
+func sourcesHealthHandler(checker *sourcesChecker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		response := checker.get()
+		if !response.Reachable {
+			c.JSON(http.StatusServiceUnavailable, response)
+			return
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// WarmupResult is the result of the reloading of a data type in the /admin/warmup response
+type WarmupResult struct {
+	DataType string  `json:"type"`
+	Success  bool    `json:"success"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// WarmupResponse defines the structure returned by the /admin/warmup endpoint
+type WarmupResponse struct {
+	Success bool           `json:"success"`
+	Results []WarmupResult `json:"results"`
+}
+
+// WarmupHandler reloads every data type and answers once they are all loaded, with a 503 if one of them failed.
+// The data types are reloaded in parallel, a loading already in progress is waited for before reloading.
+func WarmupHandler(refreshers []Refresher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		response := WarmupResponse{Success: true, Results: make([]WarmupResult, len(refreshers))}
+		var wg sync.WaitGroup
+		for i, refresher := range refreshers {
+			wg.Add(1)
+			go func(result *WarmupResult, refresher Refresher) {
+				defer wg.Done()
+				begin := time.Now()
+				err := refresher.Refresh()
+				result.DataType = refresher.DataType
+				result.Duration = time.Since(begin).Seconds()
+				if err != nil {
+					result.Error = err.Error()
+					return
+				}
+				result.Success = true
+			}(&response.Results[i], refresher)
+		}
+		wg.Wait()
+
+		for _, result := range response.Results {
+			response.Success = response.Success && result.Success
+		}
+		if !response.Success {
+			c.JSON(http.StatusServiceUnavailable, response)
+			return
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// LogLevelRequest defines the body of the POST /admin/loglevel requests
+type LogLevelRequest struct {
+	Level string `json:"level" form:"level"`
+}
+
+// LogLevelHandler changes the level of the logs, the level is given in a json body or as the level parameter.
+// It answers the new level.
+func LogLevelHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request LogLevelRequest
+		if err := c.ShouldBind(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("invalid request: %s", err)})
+			return
+		}
+		level, err := logrus.ParseLevel(request.Level)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		previous := logrus.GetLevel()
+		logrus.SetLevel(level)
+		logrus.Warnf("Log level changed from %s to %s", previous, level)
+		c.JSON(http.StatusOK, gin.H{"level": level.String()})
+	}
+}
+
+// DefaultMaintenanceMessage is the message answered by the data endpoints in maintenance mode
+const DefaultMaintenanceMessage = "The service is under maintenance, please retry later"
+
+// maintenanceMode makes the data endpoints answer 503 with its message while it is enabled
+type maintenanceMode struct {
+	mutex   sync.RWMutex
+	enabled bool
+	message string
+}
+
+func newMaintenanceMode(options RouterOptions) *maintenanceMode {
+	message := options.MaintenanceMessage
+	if message == "" {
+		message = DefaultMaintenanceMessage
+	}
+	return &maintenanceMode{message: message}
+}
+
+func (m *maintenanceMode) state() MaintenanceResponse {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return MaintenanceResponse{Enabled: m.enabled, Message: m.message}
+}
+
+// guard answers 503 with the maintenance message while the maintenance mode is enabled
+func (m *maintenanceMode) guard(c *gin.Context) {
+	if state := m.state(); state.Enabled {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"message": state.Message})
+		return
+	}
+	c.Next()
+}
+
+// MaintenanceRequest defines the body of the POST /admin/maintenance requests, Enabled is required
+// and the message is kept if Message is empty
+type MaintenanceRequest struct {
+	Enabled *bool  `json:"enabled" form:"enabled"`
+	Message string `json:"message" form:"message"`
+}
+
+// MaintenanceResponse defines the structure returned by the /admin/maintenance endpoint
+type MaintenanceResponse struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+}
+
+// MaintenanceHandler enables or disables the maintenance mode, it answers the new state
+func MaintenanceHandler(m *maintenanceMode) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request MaintenanceRequest
+		if err := c.ShouldBind(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("invalid request: %s", err)})
+			return
+		}
+		if request.Enabled == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "enabled is required"})
+			return
+		}
+		m.mutex.Lock()
+		m.enabled = *request.Enabled
+		if request.Message != "" {
+			m.message = request.Message
+		}
+		m.mutex.Unlock()
+
+		state := m.state()
+		if state.Enabled {
+			logrus.Warnf("Maintenance mode enabled: %s", state.Message)
+		} else {
+			logrus.Warn("Maintenance mode disabled")
+		}
+		c.JSON(http.StatusOK, state)
+	}
+}
+
+// HealthHandler answers 200 as long as the service is running, even while it is draining
+func HealthHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// ReadyHandler answers 503 while draining or if a configured source has never been loaded, keeps failing or
+// loaded data failing their sanity check, a source is failing once it reached the failure threshold and its
+// grace period is over.
+// The service is also not ready until the warmup delay elapsed since every source was first loaded.
+func ReadyHandler(manager *DataManager, options RouterOptions) gin.HandlerFunc {
+	threshold := options.ReadinessFailureThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	// the sources of the other networks are checked too, their reasons are prefixed by the network
+	type networkSources struct {
+		prefix  string
+		manager *DataManager
+		sources []Source
+	}
+	networks := []networkSources{{"", manager, options.Sources}}
+	for _, name := range networkNames(options.Networks) {
+		network := options.Networks[name]
+		networks = append(networks, networkSources{name + " ", network.Manager, network.Sources})
+	}
+	return func(c *gin.Context) {
+		response := ReadyResponse{Ready: true}
+		var loaded time.Time
+		if manager.IsDraining() {
+			response.Reasons = append(response.Reasons, "shutting down")
+		}
+		for _, network := range networks {
+			for _, source := range network.sources {
+				if source.URI.String() == "" {
+					continue
+				}
+				status := network.manager.GetLoadStatus(source.DataType)
+				if status.LastSuccess.IsZero() {
+					response.Reasons = append(response.Reasons, fmt.Sprintf("%s%s have never been loaded",
+						network.prefix, source.DataType))
+					continue
+				}
+				if status.FirstSuccess.After(loaded) {
+					loaded = status.FirstSuccess
+				}
+				if status.SanityError != "" {
+					response.Reasons = append(response.Reasons, fmt.Sprintf("%s%s look invalid: %s",
+						network.prefix, source.DataType, status.SanityError))
+				}
+				sinceSuccess := network.manager.Now().Sub(status.LastSuccess)
+				if status.ConsecutiveFailures >= threshold && sinceSuccess > options.ReadinessGracePeriod {
+					response.Reasons = append(response.Reasons, fmt.Sprintf("%s%s failed to load %d times in a row, last success %s ago",
+						network.prefix, source.DataType, status.ConsecutiveFailures, sinceSuccess.Truncate(time.Second)))
+				}
+			}
+		}
+		if len(response.Reasons) == 0 && !loaded.IsZero() {
+			if remaining := loaded.Add(options.ReadinessWarmup).Sub(manager.Now()); remaining > 0 {
+				response.Reasons = append(response.Reasons, fmt.Sprintf("warming up, ready in %s", remaining.Truncate(time.Second)))
+			}
+		}
+
+		if len(response.Reasons) > 0 {
+			response.Ready = false
+			c.JSON(http.StatusServiceUnavailable, response)
+			return
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// RawHandler serves the file of the last successful loading of a data type
+func RawHandler(manager *DataManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dataType := c.Param("type")
+		raw, ok := manager.GetRawData(dataType)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("No raw data for %s", dataType)})
+			return
+		}
+		if raw.Truncated {
+			c.Header("X-Truncated", "true")
+		}
+		c.Header("Last-Modified", raw.LoadedAt.UTC().Format(http.TimeFormat))
+		c.Data(http.StatusOK, raw.ContentType, raw.Content)
+	}
+}
+
+// SnapshotHandler serves the departures, parkings and equipments loaded as a JSON snapshot,
+// an instance started with --snapshot-file serves it without any source
+func SnapshotHandler(manager *DataManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Disposition", `attachment; filename="snapshot.json"`)
+		c.JSON(http.StatusOK, manager.Snapshot())
+	}
+}
+
+// SaveSnapshotResponse defines the structure returned by POST /admin/snapshot
+type SaveSnapshotResponse struct {
+	Success bool   `json:"success"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size_bytes"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SaveSnapshotHandler writes the snapshot served by SnapshotHandler to path, the requests are
+// served from the data in place while it is written
+func SaveSnapshotHandler(manager *DataManager, path string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		size, err := SaveSnapshot(manager, path)
+		if err != nil {
+			logrus.Errorf("Impossible to save the snapshot: %s", err)
+			c.JSON(http.StatusInternalServerError, SaveSnapshotResponse{Path: path, Error: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, SaveSnapshotResponse{Success: true, Path: path, Size: size})
+	}
+}
+
+// adminAuth rejects the requests that don't provide the admin token as a bearer token
+func adminAuth(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "invalid or missing admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// limitConcurrency answers 503 to the requests received while max requests are being served,
+// except those to the unlimited paths so that probes and monitoring still work under load
+func limitConcurrency(max int, unlimited func(path string) bool) gin.HandlerFunc {
+	slots := make(chan struct{}, max)
+	return func(c *gin.Context) {
+		if unlimited(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			c.Next()
+		default:
+			httpRejected.Inc()
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"message": "too many requests being served"})
+		}
+	}
+}
+
+func SetupRouter(manager *DataManager, r *gin.Engine) *gin.Engine {
+	return SetupRouterWithOptions(manager, r, RouterOptions{})
+}
+
+func SetupRouterWithOptions(manager *DataManager, r *gin.Engine, options RouterOptions) *gin.Engine {
+	if r == nil {
+		r = gin.New()
+	}
+	r.Use(ginrus.Ginrus(logrus.StandardLogger(), time.RFC3339, false))
+	r.Use(instrumentGin())
 	r.Use(gin.Recovery())
-	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
-	r.GET("/departures", DeparturesHandler(manager))
-	r.GET("/status", StatusHandler(manager))
-	r.GET("/parkings/P+R", ParkingsHandler(manager))
-	r.GET("/equipments", EquipmentsHandler(manager))
+	basePath, probesPath := path.Join("/", options.BasePath), "/"
+	if options.BasePathProbes {
+		probesPath = basePath
+	}
+	if options.MaxConnections > 0 {
+		probePaths := map[string]bool{
+			path.Join(probesPath, "/health"):  true,
+			path.Join(probesPath, "/ready"):   true,
+			path.Join(probesPath, "/metrics"): true,
+		}
+		if options.ServiceMetricsPath != "" {
+			probePaths[path.Join(probesPath, options.ServiceMetricsPath)] = true
+		}
+		// the departures streams stay open as long as their clients are connected, they would hold the slots
+		streamPrefixes := []string{path.Join(basePath, "/departures/stream") + "/"}
+		for _, name := range networkNames(options.Networks) {
+			streamPrefixes = append(streamPrefixes, path.Join(basePath, "/networks", name, "/departures/stream")+"/")
+		}
+		r.Use(limitConcurrency(options.MaxConnections, func(requestPath string) bool {
+			for _, prefix := range streamPrefixes {
+				if strings.HasPrefix(requestPath, prefix) {
+					return true
+				}
+			}
+			return probePaths[requestPath]
+		}))
+	}
+	// the groups only get the middlewares used before their creation
+	routes := r.Group(basePath)
+	probes := r.Group(probesPath)
+	maintenance := newMaintenanceMode(options)
+	probes.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	if options.ServiceMetricsPath != "" {
+		probes.GET(options.ServiceMetricsPath, gin.WrapH(promhttp.HandlerFor(serviceRegistry, promhttp.HandlerOpts{})))
+	}
+	setupDataRoutes(routes.Group("/", maintenance.guard), manager, options)
+	// the status tells the age of the data during a maintenance too
+	routes.GET("/status", StatusHandler(manager))
+	probes.GET("/ready", ReadyHandler(manager, options))
+	probes.GET("/health", HealthHandler())
+	if options.SourcesHealthCheck {
+		probes.GET("/health/sources", SourcesHealthHandler(manager, options))
+	}
+	for _, name := range networkNames(options.Networks) {
+		network := options.Networks[name]
+		networkOptions := options
+		if network.Options != nil {
+			networkOptions = *network.Options
+		}
+		setupDataRoutes(routes.Group(path.Join("/networks", name), maintenance.guard), network.Manager, networkOptions)
+		routes.GET(path.Join("/networks", name, "/status"), StatusHandler(network.Manager))
+	}
+	if len(options.Networks) > 0 {
+		r.NoRoute(unknownNetworkHandler(path.Join(basePath, "/networks"), options.Networks))
+	}
+
+	if options.AdminToken != "" {
+		admin := routes.Group("/admin", adminAuth(options.AdminToken))
+		admin.GET("/sources", SourcesHandler(manager, options.Sources))
+		admin.POST("/loglevel", LogLevelHandler())
+		admin.POST("/maintenance", MaintenanceHandler(maintenance))
+		admin.POST("/warmup", WarmupHandler(options.Refreshers))
+		admin.GET("/snapshot", SnapshotHandler(manager))
+		if options.SnapshotPath != "" {
+			admin.POST("/snapshot", SaveSnapshotHandler(manager, options.SnapshotPath))
+		}
+		routes.GET("/raw/:type", adminAuth(options.AdminToken), RawHandler(manager))
+		if options.EnablePprof {
+			setupPprof(routes.Group("/", adminAuth(options.AdminToken)))
+		}
+	}
 
 	return r
 }
 
+// setupDataRoutes adds the routes serving the data of a network
+func setupDataRoutes(routes *gin.RouterGroup, manager *DataManager, options RouterOptions) {
+	routes.GET("/departures", DeparturesHandler(manager, options))
+	routes.GET("/departures/changes", DepartureChangesHandler(manager, options))
+	routes.GET("/departures/gtfs-rt", GTFSRTHandler(manager, options))
+	routes.GET("/departures/csv", DeparturesCSVHandler(manager, options))
+	routes.GET("/departures/lines", DepartureLinesHandler(manager, options))
+	// not /departures/:stop/stream, the router of gin doesn't allow the :stop wildcard next to the static
+	// routes above ("wildcard route ':stop' conflicts with existing children")
+	routes.GET("/departures/stream/:stop", DeparturesStreamHandler(manager, options))
+	routes.GET("/parkings/P+R", ParkingsHandler(manager, options))
+	routes.GET("/equipments", EquipmentsHandler(manager, options))
+	routes.GET("/bikestations", BikeStationsHandler(manager, options))
+	if options.ResponseCacheTTL > 0 {
+		routes.GET("/board/:stop", cacheResponses(newResponseCache(manager, options.ResponseCacheTTL)), BoardHandler(manager, options))
+	} else {
+		routes.GET("/board/:stop", BoardHandler(manager, options))
+	}
+}
+
+// networkNames returns the names of the networks sorted
+func networkNames(networks map[string]Network) []string {
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unknownNetworkHandler explains the 404 of the routes of a network that isn't served,
+// the other routes not found keep the default answer
+func unknownNetworkHandler(prefix string, networks map[string]Network) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rest := strings.TrimPrefix(c.Request.URL.Path, prefix+"/")
+		if rest == c.Request.URL.Path {
+			return
+		}
+		name := strings.SplitN(rest, "/", 2)[0]
+		if _, ok := networks[name]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Unknown network: %s", name)})
+		}
+	}
+}
+
+func setupPprof(r *gin.RouterGroup) {
+	group := r.Group("/debug/pprof")
+	group.GET("/", gin.WrapF(pprof.Index))
+	group.GET("/cmdline", gin.WrapF(pprof.Cmdline))
+	group.GET("/profile", gin.WrapF(pprof.Profile))
+	group.GET("/symbol", gin.WrapF(pprof.Symbol))
+	group.POST("/symbol", gin.WrapF(pprof.Symbol))
+	group.GET("/trace", gin.WrapF(pprof.Trace))
+	for _, profile := range []string{"allocs", "block", "goroutine", "heap", "mutex", "threadcreate"} {
+		group.GET("/"+profile, gin.WrapH(pprof.Handler(profile)))
+	}
+}
+
 func instrumentGin() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		begin := time.Now()
@@ -196,6 +1822,7 @@ func instrumentGin() gin.HandlerFunc {
 }
 
 func init() {
-	prometheus.MustRegister(httpDurations)
-	prometheus.MustRegister(httpInFlight)
+	mustRegister(httpDurations)
+	mustRegister(httpInFlight)
+	mustRegister(httpRejected)
 }
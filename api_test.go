@@ -1,16 +1,24 @@
 package sytralrt
 
 import (
+	"bufio"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -114,6 +122,9 @@ func TestStatusApiHasLastUpdateTime(t *testing.T) {
 	assert.Equal(response.Status, "ok")
 	assert.True(response.LastDepartureUpdate.After(startTime))
 	assert.True(response.LastDepartureUpdate.Before(time.Now()))
+	assert.Equal(manager.DeparturesCount(), response.DeparturesCount)
+	assert.NotZero(response.DeparturesCount)
+	assert.Zero(response.ParkingsCount)
 }
 
 func TestStatusApiHasLastParkingUpdateTime(t *testing.T) {
@@ -154,10 +165,10 @@ func TestParkingsPRAPI(t *testing.T) {
 
 	var manager DataManager
 	manager.UpdateParkings(map[string]Parking{
-		"riri":   {"Riri", "First of the name", updateTime, 1, 2, 3, 4},
-		"fifi":   {"Fifi", "Second of the name", updateTime, 1, 2, 3, 4},
-		"loulou": {"Loulou", "Third of the name", updateTime, 1, 2, 3, 4},
-		"donald": {"Donald", "Donald THE Duck", updateTime, 1, 2, 3, 4},
+		"riri":   {"Riri", "First of the name", updateTime, 1, 2, 3, 4, nil},
+		"fifi":   {"Fifi", "Second of the name", updateTime, 1, 2, 3, 4, nil},
+		"loulou": {"Loulou", "Third of the name", updateTime, 1, 2, 3, 4, nil},
+		"donald": {"Donald", "Donald THE Duck", updateTime, 1, 2, 3, 4, nil},
 	})
 
 	c, engine := gin.CreateTestContext(httptest.NewRecorder())
@@ -182,6 +193,46 @@ func TestParkingsPRAPI(t *testing.T) {
 	assert.Equal("Riri", parkings[3].ID)
 }
 
+func TestParkingsPRAPIWithBoundingBox(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	manager.UpdateParkings(map[string]Parking{
+		"DECC": {ID: "DECC", Coord: &Coord{Lat: 45.7687, Lon: 4.9580}},
+		"VAI1": {ID: "VAI1", Coord: &Coord{Lat: 45.7801, Lon: 4.8048}},
+		"PERI": {ID: "PERI"},
+	})
+	engine := SetupRouter(&manager, gin.New())
+	get := func(target string) (int, ParkingsResponse) {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		var response ParkingsResponse
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
+
+	code, response := get("/parkings/P+R?bbox=4.9,45.7,5.0,45.8")
+	require.Equal(http.StatusOK, code)
+	require.Len(response.Parkings, 1)
+	assert.Equal("DECC", response.Parkings[0].ID)
+	assert.Equal(&Coord{Lat: 45.7687, Lon: 4.9580}, response.Parkings[0].Coord)
+
+	// the parkings without coordinates are only returned without bbox
+	code, response = get("/parkings/P+R?bbox=4.8,45.7,5.0,45.8")
+	require.Equal(http.StatusOK, code)
+	assert.Len(response.Parkings, 2)
+	code, response = get("/parkings/P+R")
+	require.Equal(http.StatusOK, code)
+	assert.Len(response.Parkings, 3)
+
+	for _, bbox := range []string{"4.8,45.7,5.0", "4.8,45.7,east,45.8", "5.0,45.7,4.8,45.8", "4.8,-95,5.0,45.8"} {
+		code, response = get("/parkings/P+R?bbox=" + bbox)
+		assert.Equal(http.StatusBadRequest, code, bbox)
+		assert.Len(response.Errors, 1, bbox)
+	}
+}
+
 func TestParkingsPRAPIwithParkingsID(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
@@ -193,10 +244,10 @@ func TestParkingsPRAPIwithParkingsID(t *testing.T) {
 
 	var manager DataManager
 	manager.UpdateParkings(map[string]Parking{
-		"riri":   {"Riri", "First of the name", updateTime, 1, 2, 3, 4},
-		"fifi":   {"Fifi", "Second of the name", updateTime, 1, 2, 3, 4},
-		"loulou": {"Loulou", "Third of the name", updateTime, 1, 2, 3, 4},
-		"donald": {"Donald", "Donald THE Duck", updateTime, 1, 2, 3, 4},
+		"riri":   {"Riri", "First of the name", updateTime, 1, 2, 3, 4, nil},
+		"fifi":   {"Fifi", "Second of the name", updateTime, 1, 2, 3, 4, nil},
+		"loulou": {"Loulou", "Third of the name", updateTime, 1, 2, 3, 4, nil},
+		"donald": {"Donald", "Donald THE Duck", updateTime, 1, 2, 3, 4, nil},
 	})
 
 	c, engine := gin.CreateTestContext(httptest.NewRecorder())
@@ -248,3 +299,1932 @@ func TestEquipmentsAPI(t *testing.T) {
 	assert.Len(response.Equipments, 3)
 	assert.Empty(response.Error)
 }
+
+func TestEquipmentsAPIStableOrder(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	equipmentURI, err := url.Parse(fmt.Sprintf("file://%s/NET_ACCESS.XML", fixtureDir))
+	require.Nil(err)
+
+	var manager DataManager
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	// the equipments are read from a map, several loadings would give different orders
+	var previous []string
+	for i := 0; i < 10; i++ {
+		err = RefreshEquipments(&manager, *equipmentURI)
+		require.Nil(err)
+
+		c.Request = httptest.NewRequest("GET", "/equipments", nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		require.Equal(200, w.Code)
+
+		var response EquipmentsResponse
+		err = json.Unmarshal(w.Body.Bytes(), &response)
+		require.Nil(err)
+		var ids []string
+		for _, equipment := range response.Equipments {
+			ids = append(ids, equipment.ID)
+		}
+		require.Len(ids, 3)
+		assert.True(sort.StringsAreSorted(ids), ids)
+		if previous != nil {
+			assert.Equal(previous, ids)
+		}
+		previous = ids
+	}
+}
+
+func TestDeparturesApiEmptyWhenNotLoaded(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manager DataManager
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{
+		EmptyDeparturesWhenNotLoaded: true,
+		UnknownStopNotFound:          true,
+	})
+
+	c.Request = httptest.NewRequest("GET", "/departures?stop_id=3", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	assert.Equal("true", w.Header().Get("X-Data-Not-Ready"))
+	assert.JSONEq(`{"departures": []}`, w.Body.String())
+
+	c.Request = httptest.NewRequest("GET", "/departures?stop_id=3&envelope=true", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	assert.Equal("true", w.Header().Get("X-Data-Not-Ready"))
+	var envelope Envelope
+	require.Nil(json.Unmarshal(w.Body.Bytes(), &envelope))
+	assert.Equal([]interface{}{}, envelope.Data)
+	assert.NotEmpty(envelope.Meta.Errors)
+
+	manager.UpdateDepartures(map[string][]Departure{"3": {{Stop: "3", Line: "C17"}}})
+	c.Request = httptest.NewRequest("GET", "/departures?stop_id=3", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	assert.Empty(w.Header().Get("X-Data-Not-Ready"))
+	var response DeparturesResponse
+	require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+	require.NotNil(response.Departures)
+	assert.Len(*response.Departures, 1)
+}
+
+func TestDepartureChangesApi(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manager DataManager
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	changes := func(query string, code int) DepartureChangesResponse {
+		c.Request = httptest.NewRequest("GET", "/departures/changes"+query, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		require.Equal(code, w.Code)
+		var response DepartureChangesResponse
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	response := changes("", http.StatusServiceUnavailable)
+	assert.NotEmpty(response.Message)
+
+	manager.UpdateDepartures(map[string][]Departure{"1": {{Stop: "1", Line: "C17"}}, "2": {{Stop: "2", Line: "C3"}}})
+	response = changes("", http.StatusOK)
+	assert.Len(response.Departures, 2)
+	version := response.Version
+
+	manager.UpdateDepartures(map[string][]Departure{"1": {{Stop: "1", Line: "C17"}}, "2": {{Stop: "2", Line: "C1"}}})
+	response = changes(fmt.Sprintf("?since_version=%d", version), http.StatusOK)
+	require.Len(response.Departures, 1)
+	assert.Equal("C1", response.Departures["2"][0].Line)
+	assert.Empty(response.RemovedStops)
+	assert.True(response.Version > version)
+
+	response = changes("?since_version=abc", http.StatusBadRequest)
+	assert.NotEmpty(response.Message)
+}
+
+func TestDepartureLinesApi(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manager DataManager
+	engine := SetupRouterWithOptions(&manager, gin.New(), RouterOptions{NormalizeStopIDs: true})
+	lines := func(query string, code int) DepartureLinesResponse {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", "/departures/lines"+query, nil))
+		require.Equal(code, w.Code)
+		var response DepartureLinesResponse
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	response := lines("", http.StatusServiceUnavailable)
+	assert.NotEmpty(response.Message)
+
+	manager.UpdateDepartures(map[string][]Departure{
+		"1": {{Stop: "1", Line: "C17"}, {Stop: "1", Line: "C3"}, {Stop: "1", Line: "c17 ", LineID: "C17"}},
+		"a": {{Stop: "A", Line: " c3"}},
+	})
+	assert.Equal(map[string]int{"C17": 2, "C3": 2}, lines("", http.StatusOK).Lines)
+	assert.Equal(map[string]int{"C17": 2, "C3": 1}, lines("?stop_id=1", http.StatusOK).Lines)
+	assert.Equal(map[string]int{"C3": 1}, lines("?stop_id=A", http.StatusOK).Lines)
+	assert.Empty(lines("?stop_id=2", http.StatusOK).Lines)
+}
+
+func TestDeparturesStreamApi(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manager DataManager
+	server := httptest.NewServer(SetupRouter(&manager, gin.New()))
+	defer server.Close()
+
+	// event reads the next event of a stream, skipping the keepalive comments
+	type event struct {
+		id         string
+		departures []Departure
+	}
+	next := func(reader *bufio.Reader) event {
+		var e event
+		for {
+			line, err := reader.ReadString('\n')
+			require.Nil(err)
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case line == "" && e.id != "":
+				return e
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				var response DeparturesResponse
+				require.Nil(json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &response))
+				e.departures = *response.Departures
+			}
+		}
+	}
+	stream := func(lastEventID string) (*bufio.Reader, func()) {
+		req, err := http.NewRequest("GET", server.URL+"/departures/stream/1", nil)
+		require.Nil(err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(err)
+		require.Equal(http.StatusOK, resp.StatusCode)
+		assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+
+	// nothing is sent before the departures are loaded
+	reader, closeStream := stream("")
+	defer closeStream()
+	manager.UpdateDepartures(map[string][]Departure{"1": {{Stop: "1", Line: "C17"}}, "2": {{Stop: "2", Line: "C3"}}})
+	first := next(reader)
+	require.Len(first.departures, 1)
+	assert.Equal("C17", first.departures[0].Line)
+
+	// the departures are only sent again once they changed
+	manager.UpdateDepartures(map[string][]Departure{"1": {{Stop: "1", Line: "C17"}}, "2": {{Stop: "2", Line: "C1"}}})
+	manager.UpdateDepartures(map[string][]Departure{"1": {{Stop: "1", Line: "C17"}, {Stop: "1", Line: "C9"}}})
+	second := next(reader)
+	assert.Len(second.departures, 2)
+	assert.NotEqual(first.id, second.id)
+
+	// a client reconnecting with the last id only gets the next changes
+	closeStream()
+	reader, closeStream = stream(second.id)
+	defer closeStream()
+	manager.UpdateDepartures(map[string][]Departure{"1": {}})
+	third := next(reader)
+	assert.Empty(third.departures)
+
+	// the streams end once the service is shutting down, and new ones are refused
+	manager.SetDraining(true)
+	for {
+		if _, err := reader.ReadString('\n'); err != nil {
+			assert.Equal(io.EOF, err)
+			break
+		}
+	}
+	resp, err := http.Get(server.URL + "/departures/stream/1")
+	require.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestDeparturesApiUnknownStop(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	loc, err := time.LoadLocation("Europe/Paris")
+	require.Nil(err)
+	dt := time.Date(2018, 9, 17, 20, 28, 0, 0, loc)
+
+	var manager DataManager
+	// an update of the stops forgets the stops no longer in the departures that it doesn't have
+	manager.UpdateStops(map[string]Stop{"6": {ID: "6", Name: "Gare Part-Dieu"}})
+	manager.UpdateDepartures(map[string][]Departure{
+		"4": {{Line: "87A", Stop: "4", Type: "E", Direction: "35998", DirectionName: "Mions Bourdelle", Datetime: dt}},
+	})
+	// the departures of stop 4 have all passed, it isn't in the next extract
+	manager.UpdateDepartures(map[string][]Departure{
+		"3": {{Line: "87A", Stop: "3", Type: "E", Direction: "35998", DirectionName: "Mions Bourdelle", Datetime: dt}},
+	})
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{UnknownStopNotFound: true})
+
+	c.Request = httptest.NewRequest("GET", "/departures?stop_id=3", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	response := DeparturesResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	require.Nil(err)
+	require.NotNil(response.Departures)
+	assert.Len(*response.Departures, 1)
+
+	//stops 4 and 6 are known but have no departures
+	for _, stop := range []string{"4", "6"} {
+		c.Request = httptest.NewRequest("GET", "/departures?stop_id="+stop, nil)
+		w = httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		require.Equal(http.StatusOK, w.Code, stop)
+		response = DeparturesResponse{}
+		err = json.Unmarshal(w.Body.Bytes(), &response)
+		require.Nil(err)
+		require.NotNil(response.Departures)
+		assert.Empty(*response.Departures)
+	}
+
+	//these is no stop 5 in our dataset
+	c.Request = httptest.NewRequest("GET", "/departures?stop_id=5", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusNotFound, w.Code)
+	response = DeparturesResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	require.Nil(err)
+	assert.Nil(response.Departures)
+	assert.Contains(response.Message, "5")
+}
+
+func TestPprofApi(t *testing.T) {
+	require := require.New(t)
+	var manager DataManager
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	c.Request = httptest.NewRequest("GET", "/debug/pprof/", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusNotFound, w.Code)
+
+	c, engine = gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{EnablePprof: true})
+
+	// the profiling data need the admin token
+	c.Request = httptest.NewRequest("GET", "/debug/pprof/", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusNotFound, w.Code)
+
+	c, engine = gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{EnablePprof: true, AdminToken: "secret"})
+
+	c.Request = httptest.NewRequest("GET", "/debug/pprof/", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusUnauthorized, w.Code)
+
+	c.Request = httptest.NewRequest("GET", "/debug/pprof/", nil)
+	c.Request.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+
+	c.Request = httptest.NewRequest("GET", "/debug/pprof/heap", nil)
+	c.Request.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+}
+
+func TestDeparturesApiLastModified(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	firstURI, err := url.Parse(fmt.Sprintf("file://%s/first.txt", fixtureDir))
+	require.Nil(err)
+
+	var manager DataManager
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	err = RefreshDepartures(&manager, *firstURI)
+	require.Nil(err)
+
+	c.Request = httptest.NewRequest("GET", "/departures?stop_id=3", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	lastModified := w.Header().Get("Last-Modified")
+	require.NotEmpty(lastModified)
+	lastModifiedTime, err := http.ParseTime(lastModified)
+	require.Nil(err)
+	assert.Equal(manager.GetLastDepartureDataUpdate().Truncate(time.Second).Unix(), lastModifiedTime.Unix())
+
+	c.Request = httptest.NewRequest("GET", "/departures?stop_id=3", nil)
+	c.Request.Header.Set("If-Modified-Since", lastModified)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusNotModified, w.Code)
+	assert.Empty(w.Body.Bytes())
+
+	c.Request = httptest.NewRequest("GET", "/departures?stop_id=3", nil)
+	c.Request.Header.Set("If-Modified-Since", lastModifiedTime.Add(-time.Minute).Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+}
+
+func TestDeparturesApiWithStops(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	departuresURI, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	stopsURI, err := url.Parse(fmt.Sprintf("file://%s/stops.txt", fixtureDir))
+	require.Nil(err)
+
+	var manager DataManager
+	clock := &fixedClock{time.Date(2018, 9, 17, 19, 29, 0, 0, time.UTC)}
+	manager.SetClock(clock)
+	require.Nil(RefreshDepartures(&manager, *departuresURI))
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	get := func(stopID string) []map[string]interface{} {
+		c.Request = httptest.NewRequest("GET", "/departures?stop_id="+stopID, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		require.Equal(http.StatusOK, w.Code)
+		var response struct{ Departures []map[string]interface{} }
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		require.NotEmpty(response.Departures)
+		return response.Departures
+	}
+	// without stops the departures aren't enriched
+	departures := get("3")
+	assert.NotContains(departures[0], "stop_name")
+	assert.NotContains(departures[0], "stop_coord")
+
+	clock.now = clock.now.Add(time.Minute)
+	require.Nil(RefreshStops(&manager, *stopsURI))
+	departures = get("3")
+	assert.Equal("Fort du Bruissin", departures[0]["stop_name"])
+	assert.Equal(map[string]interface{}{"lat": 45.7415, "lon": 4.7562}, departures[0]["stop_coord"])
+	// the stop 2 isn't in the reference data
+	departures = get("2")
+	assert.NotContains(departures[0], "stop_name")
+
+	// the stored departures aren't enriched
+	stored, err := manager.GetDeparturesByStop("3")
+	require.Nil(err)
+	assert.Empty(stored[0].StopName)
+}
+
+func TestDeparturesCSVApi(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manager DataManager
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	c.Request = httptest.NewRequest("GET", "/departures/csv", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+
+	uri, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshDepartures(&manager, *uri))
+
+	c.Request = httptest.NewRequest("GET", "/departures/csv", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	assert.Equal("text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.Nil(err)
+	assert.Equal([]string{"stop", "line", "type", "direction", "direction_name", "datetime"}, records[0])
+	count := 0
+	for _, departures := range manager.Snapshot().Departures {
+		count += len(departures)
+	}
+	require.Len(records, count+1)
+	// the departures are sorted by stop
+	departures, err := manager.GetDeparturesByStop("1")
+	require.Nil(err)
+	assert.Equal([]string{"1", "87A", "E", "35998", "Mions Bourdelle", "2018-09-17T20:28:00+02:00"}, records[1])
+	assert.Equal(departures[0].Datetime.Format(time.RFC3339), records[1][5])
+}
+
+func TestDeparturesCSVApiCharset(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manager DataManager
+	manager.UpdateDepartures(map[string][]Departure{
+		"1": {{Stop: "1", Line: "87A", DirectionName: "Vénissieux €"}},
+	})
+	engine := SetupRouter(&manager, gin.New())
+	get := func(target, acceptCharset string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", target, nil)
+		if acceptCharset != "" {
+			request.Header.Set("Accept-Charset", acceptCharset)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, request)
+		return w
+	}
+
+	w := get("/departures/csv", "")
+	require.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "Vénissieux €")
+
+	w = get("/departures/csv?encoding=ISO-8859-1", "")
+	require.Equal(http.StatusOK, w.Code)
+	assert.Equal("text/csv; charset=iso-8859-1", w.Header().Get("Content-Type"))
+	// the euro sign isn't in latin1
+	assert.Contains(w.Body.String(), "V\xe9nissieux \x1a")
+
+	w = get("/departures/csv", "windows-1252;q=0.9, utf-8")
+	require.Equal(http.StatusOK, w.Code)
+	assert.Equal("text/csv; charset=windows-1252", w.Header().Get("Content-Type"))
+	assert.Contains(w.Body.String(), "V\xe9nissieux \x80")
+
+	// the parameter wins over the header, unsupported charsets of the header are ignored
+	w = get("/departures/csv?encoding=utf-8", "windows-1252")
+	assert.Equal("text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	w = get("/departures/csv", "koi8-r, *")
+	assert.Equal("text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+
+	w = get("/departures/csv?encoding=koi8-r", "")
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestStopAllowlistApi(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manager DataManager
+	uri, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshDepartures(&manager, *uri))
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{StopAllowlist: NewStopAllowlist([]string{"1"}, false)})
+	get := func(path string) *httptest.ResponseRecorder {
+		c.Request = httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		return w
+	}
+
+	assert.Equal(http.StatusOK, get("/departures?stop_id=1").Code)
+	// stop 101 is in the data but not in the allowlist
+	_, known, err := manager.LookupDeparturesByStop("101")
+	require.Nil(err)
+	require.True(known)
+	assert.Equal(http.StatusNotFound, get("/departures?stop_id=101").Code)
+	assert.Equal(http.StatusOK, get("/board/1").Code)
+	assert.Equal(http.StatusNotFound, get("/board/101").Code)
+
+	w := get("/departures/changes")
+	require.Equal(http.StatusOK, w.Code)
+	var changes DepartureChangesResponse
+	require.Nil(json.Unmarshal(w.Body.Bytes(), &changes))
+	assert.Len(changes.Departures, 1)
+	assert.Contains(changes.Departures, "1")
+
+	w = get("/departures/csv")
+	require.Equal(http.StatusOK, w.Code)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.Nil(err)
+	departures, err := manager.GetDeparturesByStop("1")
+	require.Nil(err)
+	assert.Len(records, len(departures)+1)
+}
+
+func TestParkingsPRAPIMinAvailable(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	loc, err := time.LoadLocation("Europe/Paris")
+	require.Nil(err)
+	updateTime, err := time.ParseInLocation("2006-01-02 15:04:05", "2018-09-17 19:29:00", loc)
+	require.Nil(err)
+
+	var manager DataManager
+	manager.UpdateParkings(map[string]Parking{
+		"riri":   {"Riri", "First of the name", updateTime, 1, 2, 30, 4, nil},
+		"fifi":   {"Fifi", "Second of the name", updateTime, 10, 2, 30, 4, nil},
+		"loulou": {"Loulou", "Third of the name", updateTime, 5, 2, 30, 4, nil},
+		"donald": {"Donald", "Donald THE Duck", updateTime, 10, 2, 30, 4, nil},
+	})
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	c.Request = httptest.NewRequest("GET", "/parkings/P+R?min_available=5", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+
+	response := ParkingsResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	require.Nil(err)
+
+	parkings := response.Parkings
+	require.Len(parkings, 3)
+	assert.Equal("Donald", parkings[0].ID)
+	assert.Equal("Fifi", parkings[1].ID)
+	assert.Equal("Loulou", parkings[2].ID)
+
+	for _, invalid := range []string{"-1", "toto"} {
+		c.Request = httptest.NewRequest("GET", "/parkings/P+R?min_available="+invalid, nil)
+		w = httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		require.Equal(http.StatusBadRequest, w.Code)
+		response = ParkingsResponse{}
+		err = json.Unmarshal(w.Body.Bytes(), &response)
+		require.Nil(err)
+		assert.Empty(response.Parkings)
+		assert.NotEmpty(response.Errors)
+	}
+}
+
+func TestAdminSourcesApi(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	firstURI, err := url.Parse(fmt.Sprintf("file://%s/first.txt", fixtureDir))
+	require.Nil(err)
+	missingURI, err := url.Parse(fmt.Sprintf("file://%s/missing.txt", fixtureDir))
+	require.Nil(err)
+
+	var manager DataManager
+	err = RefreshDepartures(&manager, *firstURI)
+	require.Nil(err)
+	err = RefreshParkings(&manager, *missingURI)
+	require.Error(err)
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{
+		AdminToken: "secret",
+		Sources: []Source{
+			{DataType: DeparturesDataType, URI: *firstURI, Refresh: 30 * time.Second},
+			{DataType: ParkingsDataType, URI: *missingURI, Refresh: time.Minute},
+			{DataType: EquipmentsDataType},
+		},
+	})
+
+	c.Request = httptest.NewRequest("GET", "/admin/sources", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusUnauthorized, w.Code)
+
+	c.Request = httptest.NewRequest("GET", "/admin/sources", nil)
+	c.Request.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusUnauthorized, w.Code)
+
+	c.Request = httptest.NewRequest("GET", "/admin/sources", nil)
+	c.Request.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+
+	var response SourcesResponse
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	require.Nil(err)
+	require.Len(response.Sources, 3)
+
+	departures := response.Sources[0]
+	assert.Equal(DeparturesDataType, departures.DataType)
+	assert.Equal("file", departures.Scheme)
+	assert.Equal("30s", departures.Refresh)
+	assert.True(departures.Enabled)
+	assert.False(departures.LoadStatus.LastSuccess.IsZero())
+	assert.Empty(departures.LoadStatus.LastError)
+
+	parkings := response.Sources[1]
+	assert.True(parkings.Enabled)
+	assert.True(parkings.LoadStatus.LastSuccess.IsZero())
+	assert.False(parkings.LoadStatus.LastAttempt.IsZero())
+	assert.NotEmpty(parkings.LoadStatus.LastError)
+
+	equipments := response.Sources[2]
+	assert.False(equipments.Enabled)
+	assert.True(equipments.LoadStatus.LastAttempt.IsZero())
+}
+
+func TestAdminLogLevelApi(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.InfoLevel)
+
+	var manager DataManager
+	_, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{AdminToken: "secret"})
+
+	post := func(target, body, token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", target, strings.NewReader(body))
+		if body != "" {
+			request.Header.Set("Content-Type", "application/json")
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, request)
+		return w
+	}
+
+	w := post("/admin/loglevel", `{"level": "debug"}`, "wrong")
+	require.Equal(http.StatusUnauthorized, w.Code)
+	assert.Equal(logrus.InfoLevel, logrus.GetLevel())
+
+	w = post("/admin/loglevel", `{"level": "debug"}`, "secret")
+	require.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{"level": "debug"}`, w.Body.String())
+	assert.Equal(logrus.DebugLevel, logrus.GetLevel())
+
+	w = post("/admin/loglevel?level=warning", "", "secret")
+	require.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{"level": "warning"}`, w.Body.String())
+	assert.Equal(logrus.WarnLevel, logrus.GetLevel())
+
+	w = post("/admin/loglevel", `{"level": "verbose"}`, "secret")
+	require.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal(logrus.WarnLevel, logrus.GetLevel())
+}
+
+func TestAdminMaintenanceApi(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manager DataManager
+	manager.UpdateEquipments([]EquipmentDetail{{ID: "821"}})
+	engine := SetupRouterWithOptions(&manager, gin.New(), RouterOptions{AdminToken: "secret", MaintenanceMessage: "upstream maintenance"})
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			request.Header.Set("Content-Type", "application/json")
+		}
+		request.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, request)
+		return w
+	}
+
+	// the state must be given
+	w := serve("POST", "/admin/maintenance", "")
+	require.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal(http.StatusOK, serve("GET", "/equipments", "").Code)
+
+	w = serve("POST", "/admin/maintenance", `{"enabled": true}`)
+	require.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{"enabled": true, "message": "upstream maintenance"}`, w.Body.String())
+	w = serve("GET", "/equipments", "")
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(`{"message": "upstream maintenance"}`, w.Body.String())
+	assert.Equal(http.StatusServiceUnavailable, serve("GET", "/departures?stop_id=1", "").Code)
+	// the probes, the metrics and the status stay up
+	assert.Equal(http.StatusOK, serve("GET", "/health", "").Code)
+	assert.Equal(http.StatusOK, serve("GET", "/metrics", "").Code)
+	assert.Equal(http.StatusOK, serve("GET", "/status", "").Code)
+
+	w = serve("POST", "/admin/maintenance", `{"enabled": true, "message": "back at 6am"}`)
+	require.Equal(http.StatusOK, w.Code)
+	w = serve("GET", "/equipments", "")
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(`{"message": "back at 6am"}`, w.Body.String())
+
+	w = serve("POST", "/admin/maintenance", `{"enabled": false}`)
+	require.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{"enabled": false, "message": "back at 6am"}`, w.Body.String())
+	assert.Equal(http.StatusOK, serve("GET", "/equipments", "").Code)
+}
+
+func TestAdminApiDisabledWithoutToken(t *testing.T) {
+	require := require.New(t)
+	var manager DataManager
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	c.Request = httptest.NewRequest("GET", "/admin/sources", nil)
+	c.Request.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestEquipmentsApiCompact(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	location, err := time.LoadLocation("Europe/Paris")
+	require.Nil(err)
+	end := time.Date(2018, 9, 14, 13, 0, 0, 0, location)
+	var manager DataManager
+	manager.UpdateEquipments([]EquipmentDetail{{
+		ID:           "821",
+		EmbeddedType: "elevator",
+		CurrentAvailability: CurrentAvailability{
+			Status:  "unavailable",
+			Cause:   Cause{Label: "Problème technique"},
+			Periods: []Period{{End: end}},
+		},
+	}})
+	get := func(target string, options RouterOptions) string {
+		engine := SetupRouterWithOptions(&manager, gin.New(), options)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		require.Equal(http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	compact := `[{"id": "821", "embedded_type": "elevator", "current_availaibity": {"status": "unavailable",
+		"cause": {"label": "Problème technique"}, "periods": [{"end": "2018-09-14T13:00:00+02:00"}]}}]`
+	assert.JSONEq(`{"equipments_details": `+compact+`}`, get("/equipments?compact=true", RouterOptions{}))
+	assert.JSONEq(`{"equipments_details": `+compact+`}`, get("/equipments", RouterOptions{CompactEquipments: true}))
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	require.Nil(json.Unmarshal([]byte(get("/equipments?compact=true&envelope=true", RouterOptions{})), &envelope))
+	assert.JSONEq(compact, string(envelope.Data))
+
+	// the full equipments keep every field
+	full := get("/equipments?compact=false", RouterOptions{CompactEquipments: true})
+	assert.Contains(full, `"name":""`)
+	assert.Contains(full, `"begin":"0001-01-01T00:00:00Z"`)
+}
+
+func TestEquipmentsApiMaxAge(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	clock := &fixedClock{time.Date(2018, 9, 17, 19, 29, 0, 0, time.UTC)}
+	var manager DataManager
+	manager.SetClock(clock)
+	manager.UpdateEquipments([]EquipmentDetail{
+		{ID: "821", CurrentAvailability: CurrentAvailability{UpdatedAt: clock.now.Add(-30 * time.Minute)}},
+		{ID: "822", CurrentAvailability: CurrentAvailability{UpdatedAt: clock.now.Add(-3 * time.Hour)}},
+	})
+	get := func(target string, options RouterOptions) (int, EquipmentsResponse) {
+		engine := SetupRouterWithOptions(&manager, gin.New(), options)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		var response EquipmentsResponse
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
+
+	code, response := get("/equipments?max_age=1h", RouterOptions{})
+	require.Equal(http.StatusOK, code)
+	require.Len(response.Equipments, 1)
+	assert.Equal("821", response.Equipments[0].ID)
+
+	code, response = get("/equipments", RouterOptions{EquipmentsMaxAge: 4 * time.Hour})
+	require.Equal(http.StatusOK, code)
+	assert.Len(response.Equipments, 2)
+	code, response = get("/equipments?max_age=1h", RouterOptions{EquipmentsMaxAge: 4 * time.Hour})
+	require.Equal(http.StatusOK, code)
+	assert.Len(response.Equipments, 1)
+	// 0 disables the limit
+	code, response = get("/equipments?max_age=0", RouterOptions{EquipmentsMaxAge: time.Minute})
+	require.Equal(http.StatusOK, code)
+	assert.Len(response.Equipments, 2)
+
+	// the equipments age without any update of the data
+	clock.now = clock.now.Add(time.Hour)
+	code, response = get("/equipments?max_age=1h", RouterOptions{})
+	require.Equal(http.StatusOK, code)
+	assert.Empty(response.Equipments)
+
+	code, response = get("/equipments?max_age=1hour", RouterOptions{})
+	assert.Equal(http.StatusBadRequest, code)
+	assert.NotEmpty(response.Error)
+}
+
+func TestEquipmentsApiPagination(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manager DataManager
+	manager.UpdateEquipments([]EquipmentDetail{{ID: "821"}, {ID: "822"}, {ID: "823"}})
+	engine := SetupRouter(&manager, gin.New())
+	get := func(target string) (*httptest.ResponseRecorder, EquipmentsResponse) {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		var response EquipmentsResponse
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		return w, response
+	}
+
+	w, response := get("/equipments?offset=1&limit=1")
+	require.Equal(http.StatusPartialContent, w.Code)
+	assert.Equal("items 1-1/3", w.Header().Get("Content-Range"))
+	require.Len(response.Equipments, 1)
+	assert.Equal("822", response.Equipments[0].ID)
+
+	w, response = get("/equipments?offset=1")
+	require.Equal(http.StatusPartialContent, w.Code)
+	assert.Equal("items 1-2/3", w.Header().Get("Content-Range"))
+	assert.Len(response.Equipments, 2)
+
+	w, response = get("/equipments?offset=5&limit=2")
+	require.Equal(http.StatusPartialContent, w.Code)
+	assert.Equal("items */3", w.Header().Get("Content-Range"))
+	assert.Empty(response.Equipments)
+
+	// a window holding every equipment is the whole list
+	w, response = get("/equipments?offset=0&limit=10")
+	require.Equal(http.StatusOK, w.Code)
+	assert.Empty(w.Header().Get("Content-Range"))
+	assert.Len(response.Equipments, 3)
+
+	w, response = get("/equipments?limit=-1")
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.NotEmpty(response.Error)
+}
+
+func TestEquipmentsApiFreshness(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	equipmentURI, err := url.Parse(fmt.Sprintf("file://%s/NET_ACCESS.XML", fixtureDir))
+	require.Nil(err)
+
+	var manager DataManager
+	err = RefreshEquipments(&manager, *equipmentURI)
+	require.Nil(err)
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	c.Request = httptest.NewRequest("GET", "/equipments", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	assert.NotContains(w.Body.String(), "stale")
+
+	c, engine = gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{StaleThreshold: time.Hour})
+
+	c.Request = httptest.NewRequest("GET", "/equipments", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	var response EquipmentsResponse
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	require.Nil(err)
+	require.NotNil(response.Freshness)
+	assert.False(response.Stale)
+	assert.True(response.DataAgeSeconds >= 0)
+	assert.Len(response.Equipments, 3)
+
+	c, engine = gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{StaleThreshold: time.Nanosecond})
+
+	c.Request = httptest.NewRequest("GET", "/equipments", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	response = EquipmentsResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	require.Nil(err)
+	require.NotNil(response.Freshness)
+	assert.True(response.Stale)
+	assert.Len(response.Equipments, 3)
+}
+
+func TestBikeStationsAPI(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	loc, err := time.LoadLocation("Europe/Paris")
+	require.Nil(err)
+	updateTime, err := time.ParseInLocation("2006-01-02 15:04:05", "2018-09-17 19:29:00", loc)
+	require.Nil(err)
+
+	var manager DataManager
+	manager.UpdateBikeStations(map[string]BikeStation{
+		"1001": {"1001", "Opéra", 4, 12, updateTime},
+		"1002": {"1002", "Terreaux", 0, 20, updateTime},
+		"2010": {"2010", "Part-Dieu", 15, 5, updateTime},
+	})
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	c.Request = httptest.NewRequest("GET", "/bikestations", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+
+	response := BikeStationsResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	require.Nil(err)
+	bikeStations := response.BikeStations
+	sort.Sort(ByBikeStationId(bikeStations))
+	require.Len(bikeStations, 3)
+	require.Len(response.Errors, 0)
+	assert.Equal("1001", bikeStations[0].ID)
+	assert.Equal("2010", bikeStations[2].ID)
+
+	c.Request = httptest.NewRequest("GET", "/bikestations?ids[]=1002&ids[]=unknown", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+
+	response = BikeStationsResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	require.Nil(err)
+	require.Len(response.BikeStations, 1)
+	assert.Equal("Terreaux", response.BikeStations[0].Name)
+	assert.Equal(0, response.BikeStations[0].BikesAvailable)
+	require.Len(response.Errors, 1)
+}
+
+func TestReadyAPI(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	uri, err := url.Parse("file:///departures.txt")
+	require.Nil(err)
+	sources := []Source{
+		{DataType: DeparturesDataType, URI: *uri, Refresh: time.Second},
+		{DataType: ParkingsDataType},
+	}
+
+	ready := func(manager *DataManager, options RouterOptions) (int, ReadyResponse) {
+		c, engine := gin.CreateTestContext(httptest.NewRecorder())
+		engine = SetupRouterWithOptions(manager, engine, options)
+		c.Request = httptest.NewRequest("GET", "/ready", nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		response := ReadyResponse{}
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
+
+	var manager DataManager
+	options := RouterOptions{Sources: sources, ReadinessFailureThreshold: 2}
+
+	// departures have never been loaded, parkings aren't configured
+	code, response := ready(&manager, options)
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.False(response.Ready)
+	assert.Len(response.Reasons, 1)
+
+	manager.updateLoadStatus(DeparturesDataType, nil)
+	code, response = ready(&manager, options)
+	assert.Equal(http.StatusOK, code)
+	assert.True(response.Ready)
+
+	// a single failure is tolerated
+	manager.updateLoadStatus(DeparturesDataType, fmt.Errorf("timeout"))
+	code, _ = ready(&manager, options)
+	assert.Equal(http.StatusOK, code)
+
+	manager.updateLoadStatus(DeparturesDataType, fmt.Errorf("timeout"))
+	code, response = ready(&manager, options)
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Len(response.Reasons, 1)
+
+	// still within the grace period
+	options.ReadinessGracePeriod = time.Hour
+	code, _ = ready(&manager, options)
+	assert.Equal(http.StatusOK, code)
+
+	options.ReadinessGracePeriod = 0
+	manager.updateLoadStatus(DeparturesDataType, nil)
+	code, _ = ready(&manager, options)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(0, manager.GetLoadStatus(DeparturesDataType).ConsecutiveFailures)
+
+	// the data loaded failing their sanity check
+	manager.setSanityError(DeparturesDataType, "no departures")
+	code, response = ready(&manager, options)
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal([]string{"departures look invalid: no departures"}, response.Reasons)
+	manager.setSanityError(DeparturesDataType, "")
+	code, _ = ready(&manager, options)
+	assert.Equal(http.StatusOK, code)
+}
+
+func TestReadyAPIWarmup(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	uri, err := url.Parse("file:///departures.txt")
+	require.Nil(err)
+	sources := []Source{
+		{DataType: DeparturesDataType, URI: *uri},
+		{DataType: ParkingsDataType, URI: *uri},
+	}
+	clock := &fixedClock{time.Date(2018, 9, 17, 19, 29, 0, 0, time.UTC)}
+	var manager DataManager
+	manager.SetClock(clock)
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{Sources: sources, ReadinessWarmup: time.Minute})
+	ready := func() (int, ReadyResponse) {
+		c.Request = httptest.NewRequest("GET", "/ready", nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		response := ReadyResponse{}
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
+
+	manager.updateLoadStatus(DeparturesDataType, nil)
+	clock.now = clock.now.Add(30 * time.Second)
+	manager.updateLoadStatus(ParkingsDataType, nil)
+
+	// the warmup starts once every source has been loaded
+	clock.now = clock.now.Add(45 * time.Second)
+	code, response := ready()
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal([]string{"warming up, ready in 15s"}, response.Reasons)
+
+	clock.now = clock.now.Add(15 * time.Second)
+	code, _ = ready()
+	assert.Equal(http.StatusOK, code)
+
+	// the later loadings don't restart it
+	manager.updateLoadStatus(DeparturesDataType, nil)
+	code, _ = ready()
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(clock.now.Add(-90*time.Second), manager.GetLoadStatus(DeparturesDataType).FirstSuccess)
+}
+
+func TestRawAPI(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	SetMaxRawDataSize(100)
+	defer SetMaxRawDataSize(0)
+
+	uri, err := url.Parse(fmt.Sprintf("file://%s/parkings.txt", fixtureDir))
+	require.Nil(err)
+	var manager DataManager
+	err = RefreshParkings(&manager, *uri)
+	require.Nil(err)
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{AdminToken: "secret"})
+
+	c.Request = httptest.NewRequest("GET", "/raw/parkings", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusUnauthorized, w.Code)
+
+	c.Request = httptest.NewRequest("GET", "/raw/parkings", nil)
+	c.Request.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	assert.Equal("text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal("true", w.Header().Get("X-Truncated"))
+	require.Len(w.Body.Bytes(), 100)
+	assert.True(strings.HasPrefix(w.Body.String(), "COD_PAR_REL;LIB_PAR_REL;"))
+
+	c.Request = httptest.NewRequest("GET", "/raw/departures", nil)
+	c.Request.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestDeparturesAPINormalizeStopIDs(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	manager.UpdateDepartures(normalizeStopIDs(map[string][]Departure{
+		"STOP_A": {{Stop: "STOP_A", Line: "C17", Type: "E", Datetime: time.Now().Add(time.Hour)}},
+	}))
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{NormalizeStopIDs: true})
+
+	for _, stopID := range []string{"STOP_A", "stop_a", "Stop_A"} {
+		c.Request = httptest.NewRequest("GET", "/departures?stop_id="+stopID, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		require.Equal(http.StatusOK, w.Code)
+
+		var response DeparturesResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		require.Nil(err)
+		require.NotNil(response.Departures)
+		assert.Len(*response.Departures, 1, stopID)
+	}
+}
+
+func TestBoardAPI(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	for _, refresh := range []struct {
+		file    string
+		refresh func(*DataManager, url.URL) error
+	}{
+		{"first.txt", RefreshDepartures},
+		{"parkings.txt", RefreshParkings},
+		{"NET_ACCESS.XML", RefreshEquipments},
+	} {
+		uri, err := url.Parse(fmt.Sprintf("file://%s/%s", fixtureDir, refresh.file))
+		require.Nil(err)
+		require.Nil(refresh.refresh(&manager, *uri))
+	}
+	manager.UpdateStops(map[string]Stop{"3": {ID: "3", Name: "Gare Part-Dieu"}})
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{
+		UnknownStopNotFound: true,
+		BoardAssociations: map[string]BoardAssociation{
+			"3": {EquipmentIDs: []string{"821", "unknown"}, ParkingIDs: []string{"VAI1", "unknown"}},
+		},
+	})
+
+	c.Request = httptest.NewRequest("GET", "/board/3", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+
+	var response BoardResponse
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	require.Nil(err)
+	assert.Equal("3", response.StopID)
+	require.NotEmpty(response.Departures)
+	// the departures are enriched like those of /departures
+	assert.Equal("Gare Part-Dieu", response.Departures[0].StopName)
+	require.Len(response.Equipments, 1)
+	assert.Equal("821", response.Equipments[0].ID)
+	require.Len(response.Parkings, 1)
+	assert.Equal("VAI1", response.Parkings[0].ID)
+	assert.Len(response.Errors, 1)
+
+	c.Request = httptest.NewRequest("GET", "/board/unknown", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestBoardAPINormalizeStopIDs(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	manager.UpdateDepartures(map[string][]Departure{"s3": {{Stop: "S3", Line: "C3"}}})
+	manager.UpdateParkings(map[string]Parking{"VAI1": {ID: "VAI1"}})
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{
+		NormalizeStopIDs:  true,
+		BoardAssociations: map[string]BoardAssociation{"S3": {ParkingIDs: []string{"VAI1"}}},
+	})
+
+	// the associations are found whatever the case of the stop, like the departures
+	for _, stopID := range []string{"S3", "s3"} {
+		c.Request = httptest.NewRequest("GET", "/board/"+stopID, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		require.Equal(http.StatusOK, w.Code)
+
+		var response BoardResponse
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(response.Departures, 1)
+		require.Len(response.Parkings, 1)
+		assert.Equal("VAI1", response.Parkings[0].ID)
+	}
+}
+
+func TestBoardAPICache(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	clock := &fixedClock{time.Date(2018, 9, 17, 19, 29, 0, 0, time.UTC)}
+	var manager DataManager
+	manager.SetClock(clock)
+	manager.UpdateDepartures(map[string][]Departure{"3": {{Stop: "3", Line: "C3"}}})
+	manager.UpdateParkings(map[string]Parking{"VAI1": {ID: "VAI1"}, "DECC": {ID: "DECC"}})
+
+	associations := map[string]BoardAssociation{"3": {ParkingIDs: []string{"VAI1"}}}
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{
+		BoardAssociations: associations,
+		ResponseCacheTTL:  time.Minute,
+	})
+
+	board := func(query ...string) BoardResponse {
+		c.Request = httptest.NewRequest("GET", "/board/3"+strings.Join(query, ""), nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		require.Equal(http.StatusOK, w.Code)
+		assert.Equal("application/json; charset=utf-8", w.Header().Get("Content-Type"))
+
+		var response BoardResponse
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	response := board()
+	require.Len(response.Parkings, 1)
+	assert.Equal("VAI1", response.Parkings[0].ID)
+
+	// the data hasn't changed, the cached response is served, whatever the query string
+	associations["3"] = BoardAssociation{ParkingIDs: []string{"DECC"}}
+	response = board()
+	require.Len(response.Parkings, 1)
+	assert.Equal("VAI1", response.Parkings[0].ID)
+	response = board("?nocache=1")
+	require.Len(response.Parkings, 1)
+	assert.Equal("VAI1", response.Parkings[0].ID)
+
+	// the cached response expires
+	clock.now = clock.now.Add(time.Minute)
+	response = board()
+	require.Len(response.Parkings, 1)
+	assert.Equal("DECC", response.Parkings[0].ID)
+
+	// an update of the data is served immediately
+	manager.UpdateDepartures(map[string][]Departure{"3": {{Stop: "3", Line: "T1"}}})
+	response = board()
+	require.Len(response.Departures, 1)
+	assert.Equal("T1", response.Departures[0].Line)
+}
+
+func TestResponseCacheMaxEntries(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fixedClock{time.Date(2018, 9, 17, 19, 29, 0, 0, time.UTC)}
+	var manager DataManager
+	manager.SetClock(clock)
+	cache := newResponseCache(&manager, time.Minute)
+	cache.maxEntries = 2
+
+	response := func() cachedResponse { return cachedResponse{expires: clock.now.Add(time.Minute)} }
+	cache.set("stop=1", response())
+	cache.set("stop=2", response())
+	cache.set("stop=3", response())
+	_, ok := cache.get("stop=3", 0)
+	assert.False(ok)
+	_, ok = cache.get("stop=1", 0)
+	assert.True(ok)
+
+	// the expired entries make room for the new ones
+	clock.now = clock.now.Add(time.Minute)
+	cache.set("stop=3", response())
+	_, ok = cache.get("stop=3", 0)
+	assert.True(ok)
+	assert.Len(cache.entries, 1)
+}
+
+func TestParkingsAPIStalenessWithClock(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	clock := &fixedClock{time.Date(2018, 9, 17, 19, 29, 0, 0, time.UTC)}
+	var manager DataManager
+	manager.SetClock(clock)
+	manager.UpdateParkings(map[string]Parking{"DECC": {ID: "DECC"}})
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{StaleThreshold: time.Hour})
+
+	for _, elapsed := range []time.Duration{time.Hour, 2 * time.Hour} {
+		clock.now = manager.GetLastParkingsDataUpdate().Add(elapsed)
+		c.Request = httptest.NewRequest("GET", "/parkings/P+R", nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		require.Equal(http.StatusOK, w.Code)
+
+		var response ParkingsResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		require.Nil(err)
+		assert.Equal(elapsed > time.Hour, response.Stale)
+		assert.Equal(elapsed.Seconds(), response.DataAgeSeconds)
+	}
+}
+
+func TestEnvelopeAPI(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	clock := &fixedClock{time.Date(2018, 9, 17, 19, 29, 0, 0, time.UTC)}
+	var manager DataManager
+	manager.SetClock(clock)
+	manager.UpdateParkings(map[string]Parking{
+		"riri": {"Riri", "First of the name", clock.now, 1, 2, 3, 4, nil},
+		"fifi": {"Fifi", "Second of the name", clock.now, 1, 2, 3, 4, nil},
+	})
+	clock.now = clock.now.Add(time.Minute)
+
+	for _, test := range []struct {
+		options  RouterOptions
+		query    string
+		envelope bool
+	}{
+		{RouterOptions{}, "", false},
+		{RouterOptions{}, "?envelope=true", true},
+		{RouterOptions{Envelope: true}, "", true},
+		{RouterOptions{Envelope: true}, "?envelope=false", false},
+	} {
+		c, engine := gin.CreateTestContext(httptest.NewRecorder())
+		engine = SetupRouterWithOptions(&manager, engine, test.options)
+
+		c.Request = httptest.NewRequest("GET", "/parkings/P+R"+test.query, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		require.Equal(http.StatusOK, w.Code)
+
+		if !test.envelope {
+			var response ParkingsResponse
+			require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Len(response.Parkings, 2)
+			continue
+		}
+		var response struct {
+			Meta Meta              `json:"meta"`
+			Data []ParkingResponse `json:"data"`
+		}
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(response.Data, 2)
+		assert.Equal(2, response.Meta.Count)
+		assert.Equal(60.0, response.Meta.DataAgeSeconds)
+		assert.True(clock.now.Equal(response.Meta.GeneratedAt))
+		assert.Empty(response.Meta.Errors)
+	}
+}
+
+func TestDrainingAPI(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	get := func(path string) int {
+		c.Request = httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		return w.Code
+	}
+
+	require.Equal(http.StatusOK, get("/ready"))
+	require.Equal(http.StatusOK, get("/health"))
+
+	manager.SetDraining(true)
+	assert.True(manager.IsDraining())
+	assert.Equal(http.StatusServiceUnavailable, get("/ready"))
+	assert.Equal(http.StatusOK, get("/health"))
+	assert.Equal(http.StatusOK, get("/status"))
+}
+
+func TestMaxConnections(t *testing.T) {
+	assert := assert.New(t)
+
+	var manager DataManager
+	_, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{MaxConnections: 1})
+
+	// a slow request holds the only slot
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	engine.GET("/slow", func(c *gin.Context) {
+		close(entered)
+		<-release
+		c.Status(http.StatusOK)
+	})
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+		done <- w.Code
+	}()
+	<-entered
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	w := get("/status")
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal("1", w.Header().Get("Retry-After"))
+	assert.Equal(http.StatusOK, get("/health").Code)
+	assert.Equal(http.StatusOK, get("/metrics").Code)
+	// /ready and the streams aren't limited, they aren't ready here because nothing is loaded and the
+	// service is draining
+	manager.SetDraining(true)
+	for _, path := range []string{"/ready", "/departures/stream/1"} {
+		w = get(path)
+		assert.Equal(http.StatusServiceUnavailable, w.Code, path)
+		assert.NotContains(w.Body.String(), "too many requests", path)
+	}
+	manager.SetDraining(false)
+
+	close(release)
+	assert.Equal(http.StatusOK, <-done)
+	assert.Equal(http.StatusOK, get("/status").Code)
+}
+
+func TestBasePath(t *testing.T) {
+	assert := assert.New(t)
+
+	var manager DataManager
+	get := func(engine *gin.Engine, path string) int {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	_, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{BasePath: "/sytral/", AdminToken: "secret"})
+	assert.Equal(http.StatusOK, get(engine, "/sytral/status"))
+	assert.Equal(http.StatusServiceUnavailable, get(engine, "/sytral/departures?stop_id=3"))
+	assert.Equal(http.StatusUnauthorized, get(engine, "/sytral/admin/sources"))
+	assert.Equal(http.StatusNotFound, get(engine, "/status"))
+	assert.Equal(http.StatusNotFound, get(engine, "/departures?stop_id=3"))
+	// the probes keep their path
+	assert.Equal(http.StatusOK, get(engine, "/health"))
+	assert.Equal(http.StatusOK, get(engine, "/metrics"))
+	assert.Equal(http.StatusNotFound, get(engine, "/sytral/health"))
+
+	_, engine = gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{BasePath: "sytral", BasePathProbes: true,
+		ServiceMetricsPath: "/metrics/sytralrt", MaxConnections: 1})
+	assert.Equal(http.StatusOK, get(engine, "/sytral/status"))
+	assert.Equal(http.StatusOK, get(engine, "/sytral/health"))
+	assert.Equal(http.StatusOK, get(engine, "/sytral/metrics"))
+	assert.Equal(http.StatusOK, get(engine, "/sytral/metrics/sytralrt"))
+	assert.Equal(http.StatusNotFound, get(engine, "/health"))
+}
+
+func TestSourcesHealthAPI(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	clock := &fixedClock{time.Date(2018, 9, 17, 19, 29, 0, 0, time.UTC)}
+	manager.SetClock(clock)
+
+	departuresURI, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	parkingsURI, err := url.Parse(fmt.Sprintf("file://%s/parkings.txt", fixtureDir))
+	require.Nil(err)
+
+	// the sources are checked in parallel
+	var checks int32
+	reachable := true
+	checker := &sourcesChecker{
+		manager: &manager,
+		sources: []Source{
+			{DataType: DeparturesDataType, URI: *departuresURI},
+			{DataType: ParkingsDataType, URI: *parkingsURI},
+			{DataType: EquipmentsDataType},
+		},
+		ttl: 10 * time.Second,
+		check: func(uri url.URL, headers http.Header, timeout time.Duration) error {
+			atomic.AddInt32(&checks, 1)
+			if !reachable && uri == *parkingsURI {
+				return fmt.Errorf("connection refused")
+			}
+			return nil
+		},
+	}
+	_, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine.GET("/health/sources", sourcesHealthHandler(checker))
+
+	get := func() (int, SourcesHealthResponse) {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", "/health/sources", nil))
+		var response SourcesHealthResponse
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
+
+	code, response := get()
+	assert.Equal(http.StatusOK, code)
+	assert.True(response.Reachable)
+	// the equipments aren't configured
+	require.Len(response.Sources, 2)
+	assert.Equal(DeparturesDataType, response.Sources[0].DataType)
+	assert.Equal("file", response.Sources[0].Scheme)
+	assert.True(response.Sources[0].Reachable)
+	assert.Equal(clock.now, response.Sources[0].CheckedAt)
+	assert.Equal(int32(2), atomic.LoadInt32(&checks))
+
+	// the result is cached
+	reachable = false
+	clock.now = clock.now.Add(5 * time.Second)
+	code, _ = get()
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(int32(2), atomic.LoadInt32(&checks))
+
+	clock.now = clock.now.Add(5 * time.Second)
+	code, response = get()
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(int32(4), atomic.LoadInt32(&checks))
+	assert.False(response.Reachable)
+	assert.True(response.Sources[0].Reachable)
+	assert.False(response.Sources[1].Reachable)
+	assert.Equal("connection refused", response.Sources[1].Error)
+}
+
+func TestSourcesHealthAPIIsOptional(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	missingURI, err := url.Parse(fmt.Sprintf("file://%s/missing.txt", fixtureDir))
+	require.Nil(err)
+	sources := []Source{{DataType: DeparturesDataType, URI: *missingURI}}
+
+	var manager DataManager
+	_, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{Sources: sources})
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/health/sources", nil))
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	_, engine = gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{Sources: sources, SourcesHealthCheck: true})
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/health/sources", nil))
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(http.StatusOK, w.Code)
+}
+
+func TestServiceMetricsAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	var manager DataManager
+	_, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{ServiceMetricsPath: "/metrics/sytralrt"})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/metrics")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "go_goroutines")
+	assert.Contains(w.Body.String(), "sytralrt_http_in_flight")
+
+	w = get("/metrics/sytralrt")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "sytralrt_http_in_flight")
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			assert.True(strings.HasPrefix(line, "sytralrt_"), line)
+		}
+	}
+}
+
+func TestAdminWarmupApi(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	departuresURI, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	parkingsURI, err := url.Parse(fmt.Sprintf("file://%s/missing.txt", fixtureDir))
+	require.Nil(err)
+
+	var manager DataManager
+	refreshers := []Refresher{
+		{DataType: DeparturesDataType, Refresh: func() error { return RefreshDepartures(&manager, *departuresURI) }},
+		{DataType: ParkingsDataType, Refresh: func() error { return RefreshParkings(&manager, *parkingsURI) }},
+	}
+	_, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{AdminToken: "secret", Refreshers: refreshers})
+
+	post := func(token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/admin/warmup", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, request)
+		return w
+	}
+
+	w := post("wrong")
+	require.Equal(http.StatusUnauthorized, w.Code)
+	_, err = manager.GetDeparturesByStop("1")
+	assert.Error(err)
+
+	w = post("secret")
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+	var response WarmupResponse
+	require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+	assert.False(response.Success)
+	require.Len(response.Results, 2)
+	assert.Equal(DeparturesDataType, response.Results[0].DataType)
+	assert.True(response.Results[0].Success)
+	assert.Empty(response.Results[0].Error)
+	assert.Equal(ParkingsDataType, response.Results[1].DataType)
+	assert.False(response.Results[1].Success)
+	assert.NotEmpty(response.Results[1].Error)
+
+	// the data are loaded when the response is received
+	departures, err := manager.GetDeparturesByStop("1")
+	require.Nil(err)
+	assert.NotEmpty(departures)
+
+	refreshers[1].Refresh = func() error { return nil }
+	_, engine = gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{AdminToken: "secret", Refreshers: refreshers})
+	w = post("secret")
+	require.Equal(http.StatusOK, w.Code)
+	require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+	assert.True(response.Success)
+}
+
+func TestSnapshotApi(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	uri, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshDepartures(&manager, *uri))
+	uri, err = url.Parse(fmt.Sprintf("file://%s/parkings.txt", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshParkings(&manager, *uri))
+	uri, err = url.Parse(fmt.Sprintf("file://%s/bikestations.txt", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshBikeStations(&manager, *uri))
+	dir, err := ioutil.TempDir("", "sytralrt")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	require.Nil(ioutil.WriteFile(dir+"/stops.txt", []byte("id;name;lat;lon\nSTOP_A;Gare Part-Dieu;45.7605;4.8597\n"), 0644))
+	stopsURI := url.URL{Scheme: "file", Path: dir + "/stops.txt"}
+	require.Nil(RefreshStopsWithOptions(&manager, stopsURI, RefreshOptions{NormalizeStopIDs: true}))
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{AdminToken: "secret"})
+	c.Request = httptest.NewRequest("GET", "/admin/snapshot", nil)
+	c.Request.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	require.Nil(ioutil.WriteFile(dir+"/snapshot.json", w.Body.Bytes(), 0644))
+
+	var restored DataManager
+	require.Nil(LoadSnapshot(&restored, dir+"/snapshot.json"))
+	expected, err := json.Marshal(manager.Snapshot())
+	require.Nil(err)
+	actual, err := json.Marshal(restored.Snapshot())
+	require.Nil(err)
+	assert.JSONEq(string(expected), string(actual))
+
+	// the equipments weren't loaded when the snapshot was taken
+	assert.Nil(restored.Snapshot().Equipments)
+	assert.False(restored.GetLoadStatus(DeparturesDataType).LastSuccess.IsZero())
+	assert.True(restored.GetLoadStatus(EquipmentsDataType).LastSuccess.IsZero())
+	// the data keep their age
+	assert.True(manager.GetLastDepartureDataUpdate().Equal(restored.GetLastDepartureDataUpdate()))
+	assert.True(manager.GetLastDepartureDataUpdate().Equal(restored.GetLoadStatus(DeparturesDataType).LastSuccess))
+	assert.True(manager.GetLastParkingsDataUpdate().Equal(restored.GetLastParkingsDataUpdate()))
+	assert.True(manager.GetLastBikeStationsDataUpdate().Equal(restored.GetLastBikeStationsDataUpdate()))
+	assert.True(manager.GetLastStopsDataUpdate().Equal(restored.GetLastStopsDataUpdate()))
+	// the stops are still looked up regardless of the case of their id
+	stop, ok := restored.GetStop("stop_a")
+	require.True(ok)
+	assert.Equal("Gare Part-Dieu", stop.Name)
+
+	err = LoadSnapshot(&restored, dir+"/missing.json")
+	require.Error(err)
+	assert.Contains(err.Error(), "missing.json")
+
+	// the snapshot is written to disk on demand
+	engine = SetupRouterWithOptions(&manager, gin.New(), RouterOptions{AdminToken: "secret", SnapshotPath: dir + "/saved.json"})
+	c.Request = httptest.NewRequest("POST", "/admin/snapshot", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	c.Request.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	require.Equal(http.StatusOK, w.Code)
+	var response SaveSnapshotResponse
+	require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+	assert.True(response.Success)
+	info, err := os.Stat(dir + "/saved.json")
+	require.Nil(err)
+	assert.Equal(info.Size(), response.Size)
+	var saved DataManager
+	require.Nil(LoadSnapshot(&saved, dir+"/saved.json"))
+	actual, err = json.Marshal(saved.Snapshot())
+	require.Nil(err)
+	assert.JSONEq(string(expected), string(actual))
+
+	engine = SetupRouterWithOptions(&manager, gin.New(), RouterOptions{AdminToken: "secret", SnapshotPath: dir + "/missing/saved.json"})
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, c.Request)
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(err)
+	assert.Len(files, 3)
+}
+
+func TestNetworksApi(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager, tcl DataManager
+	uri, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshDepartures(&manager, *uri))
+	tclURI, err := url.Parse(fmt.Sprintf("file://%s/first.txt", fixtureDir))
+	require.Nil(err)
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{
+		Sources: []Source{{DataType: DeparturesDataType, URI: *uri}},
+		Networks: map[string]Network{
+			"tcl": {Manager: &tcl, Sources: []Source{{DataType: DeparturesDataType, URI: *tclURI}}},
+		},
+	})
+	get := func(path string) (int, string) {
+		c.Request = httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		return w.Code, w.Body.String()
+	}
+
+	// the network isn't loaded yet
+	code, body := get("/networks/tcl/departures?stop_id=3")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	code, body = get("/ready")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Contains(body, "tcl departures have never been loaded")
+
+	require.Nil(RefreshDepartures(&tcl, *tclURI))
+	code, _ = get("/ready")
+	assert.Equal(http.StatusOK, code)
+
+	// each network serves its own departures
+	code, body = get("/networks/tcl/departures?stop_id=3")
+	require.Equal(http.StatusOK, code)
+	var response DeparturesResponse
+	require.Nil(json.Unmarshal([]byte(body), &response))
+	tclDepartures, err := tcl.GetDeparturesByStop("3")
+	require.Nil(err)
+	assert.Len(*response.Departures, len(tclDepartures))
+	code, body = get("/departures?stop_id=3")
+	require.Equal(http.StatusOK, code)
+	response = DeparturesResponse{}
+	require.Nil(json.Unmarshal([]byte(body), &response))
+	departures, err := manager.GetDeparturesByStop("3")
+	require.Nil(err)
+	assert.Len(*response.Departures, len(departures))
+	// stop 1 is only in the main network
+	code, body = get("/networks/tcl/departures?stop_id=1")
+	require.Equal(http.StatusOK, code)
+	response = DeparturesResponse{}
+	require.Nil(json.Unmarshal([]byte(body), &response))
+	assert.Empty(*response.Departures)
+
+	code, _ = get("/networks/tcl/status")
+	assert.Equal(http.StatusOK, code)
+
+	code, body = get("/networks/other/departures?stop_id=3")
+	assert.Equal(http.StatusNotFound, code)
+	assert.Contains(body, "Unknown network: other")
+	code, _ = get("/unknown")
+	assert.Equal(http.StatusNotFound, code)
+}
+
+func TestNetworksOptions(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager, tcl DataManager
+	uri, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshDepartures(&manager, *uri))
+	require.Nil(RefreshDepartures(&tcl, *uri))
+
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{
+		StopAllowlist: NewStopAllowlist([]string{"1"}, false),
+		Networks: map[string]Network{
+			"tcl":   {Manager: &tcl, Options: &RouterOptions{StopAllowlist: NewStopAllowlist([]string{"3"}, false)}},
+			"other": {Manager: &tcl},
+		},
+	})
+	get := func(path string) int {
+		c.Request = httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		return w.Code
+	}
+
+	// the allowlist of the main network doesn't apply to a network with its own options
+	assert.Equal(http.StatusNotFound, get("/departures?stop_id=3"))
+	assert.Equal(http.StatusOK, get("/networks/tcl/departures?stop_id=3"))
+	assert.Equal(http.StatusNotFound, get("/networks/tcl/departures?stop_id=1"))
+	assert.Equal(http.StatusNotFound, get("/networks/tcl/board/1"))
+	// a network without options uses the ones of the main network
+	assert.Equal(http.StatusNotFound, get("/networks/other/departures?stop_id=3"))
+	assert.Equal(http.StatusOK, get("/networks/other/departures?stop_id=1"))
+}
+
+func TestDepartureFieldNames(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	names, err := ParseDepartureFieldNames([]string{"line=ligne", " stop = arret", "type=stop", "direction=type"})
+	require.Nil(err)
+	assert.Equal(DepartureFieldNames{"line": "ligne", "stop": "arret", "type": "stop", "direction": "type"}, names)
+	_, err = ParseDepartureFieldNames([]string{"vehicle=vehicule"})
+	assert.Error(err)
+	_, err = ParseDepartureFieldNames([]string{"line"})
+	assert.Error(err)
+	_, err = ParseDepartureFieldNames([]string{"line=ligne", "stop=ligne"})
+	assert.Error(err)
+	// stop would be there twice
+	_, err = ParseDepartureFieldNames([]string{"line=stop"})
+	assert.Error(err)
+
+	var manager DataManager
+	uri, err := url.Parse(fmt.Sprintf("file://%s/first.txt", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshDepartures(&manager, *uri))
+	c, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouterWithOptions(&manager, engine, RouterOptions{DepartureFieldNames: names})
+	for _, envelope := range []string{"false", "true"} {
+		c.Request = httptest.NewRequest("GET", "/departures?stop_id=3&envelope="+envelope, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, c.Request)
+		require.Equal(http.StatusOK, w.Code)
+
+		var response map[string][]map[string]string
+		if envelope == "true" {
+			var body struct {
+				Data []map[string]string `json:"data"`
+			}
+			require.Nil(json.Unmarshal(w.Body.Bytes(), &body))
+			response = map[string][]map[string]string{"departures": body.Data}
+		} else {
+			require.Nil(json.Unmarshal(w.Body.Bytes(), &response))
+		}
+		require.Len(response["departures"], 4)
+		assert.Equal(map[string]string{
+			"ligne":          "C20A",
+			"arret":          "3",
+			"stop":           "E",
+			"type":           "367",
+			"direction_name": "Francheville Taffignon",
+			"datetime":       "2018-09-17T20:28:37+02:00",
+		}, response["departures"][0])
+	}
+
+	// the fields keep the order of Departure, as without renaming
+	departures := []Departure{
+		{Line: "C20A", Stop: "3", Type: "E", Datetime: time.Date(2018, 9, 17, 20, 28, 37, 0, time.UTC)},
+		{Line: "C17", Stop: "1", StopName: "Gare", StopCoord: &Coord{Lat: 45.7, Lon: 4.8}, LineID: "C17"},
+	}
+	expected, err := json.Marshal(departures)
+	require.Nil(err)
+	data, err := json.Marshal(renamedDepartures{departures, nil})
+	require.Nil(err)
+	assert.Equal(string(expected), string(data))
+	data, err = json.Marshal(renamedDepartures{departures[:1], names})
+	require.Nil(err)
+	assert.Equal(`[{"ligne":"C20A","arret":"3","stop":"E","type":"","direction_name":"",`+
+		`"datetime":"2018-09-17T20:28:37Z"}]`, string(data))
+}
@@ -0,0 +1,67 @@
+package sytralrt
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+)
+
+// Kinds of objects that can be associated to a stop
+const (
+	boardEquipment = "equipment"
+	boardParking   = "parking"
+)
+
+// BoardAssociation lists the equipments and parkings shown on the board of a stop,
+// the data don't provide this association themselves
+type BoardAssociation struct {
+	EquipmentIDs []string
+	ParkingIDs   []string
+}
+
+// LoadBoardAssociations reads the associations of stops with equipments and parkings,
+// one association per line: stop_id;equipment|parking;id. Lines starting with # are ignored.
+func LoadBoardAssociations(file io.Reader) (map[string]BoardAssociation, error) {
+	reader := csv.NewReader(file)
+	reader.Comma = ';'
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 3
+
+	associations := make(map[string]BoardAssociation)
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		stopID, kind, id := line[0], line[1], line[2]
+		association := associations[stopID]
+		switch kind {
+		case boardEquipment:
+			association.EquipmentIDs = append(association.EquipmentIDs, id)
+		case boardParking:
+			association.ParkingIDs = append(association.ParkingIDs, id)
+		default:
+			return nil, fmt.Errorf("unknown kind %q for stop %s, expected %s or %s",
+				kind, stopID, boardEquipment, boardParking)
+		}
+		associations[stopID] = association
+	}
+	return associations, nil
+}
+
+// normalizeBoardAssociations indexes the associations by normalized stop id, the associations of the ids
+// differing only by their case are merged
+func normalizeBoardAssociations(associations map[string]BoardAssociation) map[string]BoardAssociation {
+	normalized := make(map[string]BoardAssociation, len(associations))
+	for stopID, association := range associations {
+		stopID = NormalizeStopID(stopID)
+		merged := normalized[stopID]
+		merged.EquipmentIDs = append(merged.EquipmentIDs, association.EquipmentIDs...)
+		merged.ParkingIDs = append(merged.ParkingIDs, association.ParkingIDs...)
+		normalized[stopID] = merged
+	}
+	return normalized
+}
@@ -0,0 +1,34 @@
+package sytralrt
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadBoardAssociations(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	uri, err := url.Parse(fmt.Sprintf("file://%s/board_associations.txt", fixtureDir))
+	require.Nil(err)
+	reader, err := getFileWithFS(*uri)
+	require.Nil(err)
+
+	associations, err := LoadBoardAssociations(reader)
+	require.Nil(err)
+	require.Len(associations, 2)
+	assert.Equal([]string{"821", "8205"}, associations["3"].EquipmentIDs)
+	assert.Equal([]string{"VAI1"}, associations["3"].ParkingIDs)
+	assert.Empty(associations["4"].EquipmentIDs)
+	assert.Equal([]string{"DECC"}, associations["4"].ParkingIDs)
+
+	_, err = LoadBoardAssociations(strings.NewReader("3;elevator;821\n"))
+	assert.Error(err)
+	_, err = LoadBoardAssociations(strings.NewReader("3;equipment\n"))
+	assert.Error(err)
+}
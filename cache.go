@@ -0,0 +1,161 @@
+package sytralrt
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	responseCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Subsystem: "http",
+		Name:      "cache_hits_total",
+		Help:      "number of http requests answered from the response cache",
+	})
+
+	responseCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Subsystem: "http",
+		Name:      "cache_misses_total",
+		Help:      "number of cacheable http requests that had to be computed",
+	})
+)
+
+func init() {
+	mustRegister(responseCacheHits)
+	mustRegister(responseCacheMisses)
+}
+
+// responseCacheMaxEntries bounds the number of responses kept for a version of the data
+const responseCacheMaxEntries = 10000
+
+// cachedResponse is a response body as it was computed from a version of the data
+type cachedResponse struct {
+	version     uint64
+	expires     time.Time
+	contentType string
+	body        []byte
+}
+
+// responseCache keeps the successful responses by route parameters, until they expire or the data they
+// were computed from is updated. It holds at most maxEntries responses.
+type responseCache struct {
+	manager    *DataManager
+	ttl        time.Duration
+	maxEntries int
+
+	mutex   sync.Mutex
+	version uint64
+	entries map[string]cachedResponse
+}
+
+func newResponseCache(manager *DataManager, ttl time.Duration) *responseCache {
+	return &responseCache{
+		manager:    manager,
+		ttl:        ttl,
+		maxEntries: responseCacheMaxEntries,
+		entries:    make(map[string]cachedResponse),
+	}
+}
+
+func (r *responseCache) get(key string, version uint64) (cachedResponse, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	response, ok := r.entries[key]
+	if !ok || response.version != version || !r.manager.Now().Before(response.expires) {
+		return cachedResponse{}, false
+	}
+	return response, true
+}
+
+func (r *responseCache) set(key string, response cachedResponse) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if response.version < r.version {
+		// the data has been updated while the response was computed
+		return
+	}
+	if response.version > r.version {
+		// the responses computed from the previous data won't be served anymore
+		r.entries = make(map[string]cachedResponse)
+		r.version = response.version
+	}
+	if _, ok := r.entries[key]; !ok && len(r.entries) >= r.maxEntries {
+		now := r.manager.Now()
+		for key, entry := range r.entries {
+			if !now.Before(entry.expires) {
+				delete(r.entries, key)
+			}
+		}
+		if len(r.entries) >= r.maxEntries {
+			// the response is still served, only not kept
+			return
+		}
+	}
+	r.entries[key] = response
+}
+
+// bodyRecorder keeps a copy of the body written to the response
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (b *bodyRecorder) Write(data []byte) (int, error) {
+	b.body.Write(data)
+	return b.ResponseWriter.Write(data)
+}
+
+func (b *bodyRecorder) WriteString(s string) (int, error) {
+	b.body.WriteString(s)
+	return b.ResponseWriter.WriteString(s)
+}
+
+// responseCacheKey is the key of the response of a request, made of its route parameters only: the cached
+// handlers don't read the query string, which would otherwise let any client fill the cache
+func responseCacheKey(c *gin.Context) string {
+	parts := make([]string, 0, len(c.Params))
+	for _, param := range c.Params {
+		parts = append(parts, param.Key+"="+param.Value)
+	}
+	return strings.Join(parts, "&")
+}
+
+// cacheResponses serves the responses of the handlers following it from cache, the route parameters
+// of the request being the key. Only the 200 responses are cached.
+func cacheResponses(cache *responseCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := responseCacheKey(c)
+		version := cache.manager.Version()
+		if response, ok := cache.get(key, version); ok {
+			responseCacheHits.Inc()
+			c.Data(http.StatusOK, response.contentType, response.body)
+			c.Abort()
+			return
+		}
+		responseCacheMisses.Inc()
+
+		recorder := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+		c.Writer = recorder.ResponseWriter
+
+		if recorder.Status() != http.StatusOK {
+			return
+		}
+		cache.set(key, cachedResponse{
+			version:     version,
+			expires:     cache.manager.Now().Add(cache.ttl),
+			contentType: recorder.Header().Get("Content-Type"),
+			body:        recorder.body.Bytes(),
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package sytralrt
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// States of a circuitBreaker, they are also the values of the sftp_circuit_breaker_state metric
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var sftpBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "sytralrt",
+	Subsystem: "sftp",
+	Name:      "circuit_breaker_state",
+	Help:      "state of the circuit breaker of each sftp host: 0 closed, 1 open, 2 half-open",
+},
+	[]string{"host"},
+)
+
+func init() {
+	mustRegister(sftpBreakerState)
+}
+
+// circuitBreaker stops calling a failing service: after threshold consecutive failures it opens and rejects
+// every call for cooldown. Then it half-opens and lets a single call through to test if the service has recovered.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown}
+	b.setState(breakerClosed)
+	return b
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	sftpBreakerState.WithLabelValues(b.name).Set(float64(state))
+}
+
+// allow returns an error if the call must not be done, otherwise the outcome of the call must be given to done
+func (b *circuitBreaker) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return fmt.Errorf("circuit breaker open for %s", b.name)
+		}
+		b.setState(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		// a call is already testing the service
+		return fmt.Errorf("circuit breaker half-open for %s", b.name)
+	}
+	return nil
+}
+
+// done records the outcome of a call allowed by allow
+func (b *circuitBreaker) done(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// sftpBreakers holds a circuit breaker per sftp host
+var sftpBreakers = struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	breakers  map[string]*circuitBreaker
+}{}
+
+// SetSftpCircuitBreaker enables a circuit breaker per sftp host: after threshold consecutive failures
+// fetches from this host fail immediately during cooldown. 0 (the default) disables it.
+func SetSftpCircuitBreaker(threshold int, cooldown time.Duration) {
+	sftpBreakers.Lock()
+	defer sftpBreakers.Unlock()
+
+	sftpBreakers.threshold = threshold
+	sftpBreakers.cooldown = cooldown
+	sftpBreakers.breakers = make(map[string]*circuitBreaker)
+}
+
+// getSftpBreaker returns the circuit breaker of a host, or nil if they are disabled
+func getSftpBreaker(host string) *circuitBreaker {
+	sftpBreakers.Lock()
+	defer sftpBreakers.Unlock()
+
+	if sftpBreakers.threshold <= 0 {
+		return nil
+	}
+	b, ok := sftpBreakers.breakers[host]
+	if !ok {
+		b = newCircuitBreaker(host, sftpBreakers.threshold, sftpBreakers.cooldown)
+		sftpBreakers.breakers[host] = b
+	}
+	return b
+}
@@ -42,4 +42,6 @@ type EquipementSource struct {
 	Start   string   `xml:"date_debut_indisponibilite,attr"`
 	End     string   `xml:"date_remise_service,attr"`
 	Hour    string   `xml:"heure_remise_service,attr"`
+	// Status is the raw status code of the provider, if any, see EquipmentStatuses
+	Status string `xml:"etat,attr"`
 }
@@ -0,0 +1,141 @@
+package sytralrt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// gcsClient is the Google Cloud Storage client used by every gs:// fetch
+var gcsClient = &googleStorage{}
+
+// openFileWithGCS streams the object of a gs://bucket/object uri, the download is bounded by the http timeout
+func openFileWithGCS(ctx context.Context, uri url.URL) (io.ReadCloser, error) {
+	object, err := gcsObject(uri)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, httpClient.Timeout)
+	reader, err := object.NewReader(ctx)
+	if err != nil {
+		cancel()
+		return nil, gcsError(uri, err)
+	}
+	return &releaseOnClose{reader, cancel}, nil
+}
+
+func getFileWithGCS(uri url.URL) (io.Reader, error) {
+	body, err := openFileWithGCS(context.Background(), uri)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var buffer bytes.Buffer
+	if _, err = buffer.ReadFrom(body); err != nil {
+		return nil, err
+	}
+	return &buffer, nil
+}
+
+// checkGCSSource checks that the object exists and can be read by getting its metadata
+func checkGCSSource(uri url.URL, timeout time.Duration) error {
+	object, err := gcsObject(uri)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err = object.Attrs(ctx); err != nil {
+		return gcsError(uri, err)
+	}
+	return nil
+}
+
+// gcsObject returns the handle of the object of a gs://bucket/object uri
+func gcsObject(uri url.URL) (*storage.ObjectHandle, error) {
+	bucket, object := uri.Host, strings.TrimPrefix(uri.Path, "/")
+	if bucket == "" || object == "" {
+		return nil, fmt.Errorf("Invalid GCS uri %s, expected gs://bucket/object", redactURI(uri))
+	}
+	client, err := gcsClient.client()
+	if err != nil {
+		return nil, fmt.Errorf("Impossible to get the Google credentials to fetch %s: %s", redactURI(uri), err)
+	}
+	return client.Bucket(bucket).Object(object), nil
+}
+
+// gcsError tells a missing object and denied credentials apart from the other errors of the client
+func gcsError(uri url.URL, err error) error {
+	if err == storage.ErrObjectNotExist || err == storage.ErrBucketNotExist {
+		return fmt.Errorf("GCS object %s not found", redactURI(uri))
+	}
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		status := fmt.Sprintf("%d %s", apiErr.Code, http.StatusText(apiErr.Code))
+		message := apiErr.Message
+		if message == "" {
+			message = strings.TrimSpace(apiErr.Body)
+		}
+		switch apiErr.Code {
+		case http.StatusNotFound:
+			return fmt.Errorf("GCS object %s not found", redactURI(uri))
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("Access to GCS object %s denied (%s), check the credentials and their permissions: %s",
+				redactURI(uri), status, message)
+		}
+		return fmt.Errorf("Unexpected status %s while fetching %s: %s", status, redactURI(uri), message)
+	}
+	return fmt.Errorf("Impossible to fetch %s: %s", redactURI(uri), err)
+}
+
+// withTimeout bounds ctx by timeout, 0 means no bound
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// googleStorage creates the client on the first fetch, with the application default credentials: the file
+// named by GOOGLE_APPLICATION_CREDENTIALS, else the file written by gcloud auth application-default login,
+// else the service account of the instance. STORAGE_EMULATOR_HOST targets an emulator without credentials.
+type googleStorage struct {
+	mutex   sync.Mutex
+	storage *storage.Client
+	// options are added to the default ones, the tests give their credentials with them
+	options []option.ClientOption
+}
+
+func (g *googleStorage) client() (*storage.Client, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.storage != nil {
+		return g.storage, nil
+	}
+	options := []option.ClientOption{option.WithScopes(storage.ScopeReadOnly)}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		// the client reads the objects from the emulator by itself but not their metadata
+		options = append(options, option.WithEndpoint("http://"+host+"/storage/v1/"), option.WithoutAuthentication())
+	}
+	options = append(options, g.options...)
+	// the default client of the oauth2 package, used to get the tokens, has no timeout
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Timeout: 30 * time.Second})
+	client, err := storage.NewClient(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	g.storage = client
+	return client, nil
+}
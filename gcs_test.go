@@ -0,0 +1,176 @@
+package sytralrt
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+func TestGetFileWithGCSEmulator(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(r.Header.Get("Authorization"))
+		// the objects are read with the XML API and their metadata with the JSON API
+		switch r.URL.EscapedPath() {
+		case "/extracts/sytral/oneline.txt":
+			fmt.Fprint(w, oneline)
+		case "/storage/v1/b/extracts/o/sytral%2Foneline.txt":
+			fmt.Fprint(w, `{"bucket": "extracts", "name": "sytral/oneline.txt"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	os.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+	defer func(client *googleStorage) { gcsClient = client }(gcsClient)
+	gcsClient = &googleStorage{}
+
+	uri, err := url.Parse("gs://extracts/sytral/oneline.txt")
+	require.Nil(err)
+	reader, err := getFile(*uri)
+	require.Nil(err)
+	data, err := ioutil.ReadAll(reader)
+	require.Nil(err)
+	assert.Equal(oneline, string(data))
+
+	var manager DataManager
+	err = RefreshDeparturesWithOptions(&manager, *uri, RefreshOptions{Streaming: true})
+	require.Nil(err)
+	departures, err := manager.GetDeparturesByStop("1")
+	require.Nil(err)
+	assert.Len(departures, 1)
+	assert.Nil(CheckSource(*uri, time.Second))
+
+	uri, err = url.Parse("gs://extracts/sytral/missing.txt")
+	require.Nil(err)
+	_, err = getFile(*uri)
+	require.Error(err)
+	assert.Equal("GCS object gs://extracts/sytral/missing.txt not found", err.Error())
+	assert.Error(CheckSource(*uri, time.Second))
+}
+
+func TestGetFileWithGCSServiceAccount(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(err)
+
+	// the assertions are checked by the test, the handler runs in the goroutine of the server
+	var (
+		mutex      sync.Mutex
+		assertions []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			assert.Equal("urn:ietf:params:oauth:grant-type:jwt-bearer", r.FormValue("grant_type"))
+			mutex.Lock()
+			assertions = append(assertions, r.FormValue("assertion"))
+			mutex.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "secret", "token_type": "Bearer", "expires_in": 3600}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, oneline)
+	}))
+	defer server.Close()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(err)
+	credentials, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "sytralrt@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    server.URL + "/token",
+	})
+	require.Nil(err)
+	dir, err := ioutil.TempDir("", "sytralrt")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	require.Nil(ioutil.WriteFile(dir+"/credentials.json", credentials, 0600))
+
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", dir+"/credentials.json")
+	defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+	// the requests to storage.googleapis.com are sent to the server
+	defer func(transport http.RoundTripper) { http.DefaultTransport = transport }(http.DefaultTransport)
+	http.DefaultTransport = &redirectTransport{server.URL, http.DefaultTransport}
+	defer func(client *googleStorage) { gcsClient = client }(gcsClient)
+	gcsClient = &googleStorage{}
+
+	uri, err := url.Parse("gs://extracts/oneline.txt")
+	require.Nil(err)
+	for i := 0; i < 2; i++ {
+		reader, err := getFile(*uri)
+		require.Nil(err)
+		data, err := ioutil.ReadAll(reader)
+		require.Nil(err)
+		assert.Equal(oneline, string(data))
+	}
+	// the token is reused
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(assertions, 1)
+	parts := strings.Split(assertions[0], ".")
+	require.Len(parts, 3)
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.Nil(err)
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	assert.Nil(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature))
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.Nil(err)
+	assert.Contains(string(claims), `"iss":"sytralrt@project.iam.gserviceaccount.com"`)
+
+	// the denied requests are told apart from the missing objects
+	gcsClient = &googleStorage{options: []option.ClientOption{
+		option.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "expired"})),
+	}}
+	_, err = getFile(*uri)
+	require.Error(err)
+	assert.Contains(err.Error(), "Access to GCS object gs://extracts/oneline.txt denied (403 Forbidden)")
+}
+
+// redirectTransport sends every request to the server at url
+type redirectTransport struct {
+	url       string
+	transport http.RoundTripper
+}
+
+func (r *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, err := url.Parse(r.url)
+	if err != nil {
+		return nil, err
+	}
+	redirected := *req
+	redirected.URL = &url.URL{}
+	*redirected.URL = *req.URL
+	redirected.URL.Scheme, redirected.URL.Host = target.Scheme, target.Host
+	redirected.Host = target.Host
+	return r.transport.RoundTrip(&redirected)
+}
@@ -0,0 +1,77 @@
+package sytralrt
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+)
+
+// newGTFSRTFeed makes a full dataset GTFS-RT feed of the departures. The departures of a trip are the
+// stop time updates of a single trip update, whose start is the earliest of its departures: the start of
+// the trip as long as it hasn't left its first stop. The departures without trip are each a trip update
+// of their line with a single stop time update.
+func newGTFSRTFeed(departures map[string][]Departure, lastUpdate time.Time) *gtfs.FeedMessage {
+	stops := make([]string, 0, len(departures))
+	for stop := range departures {
+		stops = append(stops, stop)
+	}
+	sort.Strings(stops)
+
+	timestamp := uint64(lastUpdate.Unix())
+	feed := &gtfs.FeedMessage{
+		Header: &gtfs.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Incrementality:      gtfs.FeedHeader_FULL_DATASET.Enum(),
+			Timestamp:           proto.Uint64(timestamp),
+		},
+	}
+	trips := make(map[string]*gtfs.TripUpdate)
+	starts := make(map[string]time.Time)
+	for _, stop := range stops {
+		for i, departure := range departures[stop] {
+			update := &gtfs.TripUpdate_StopTimeUpdate{
+				StopId:    proto.String(departure.Stop),
+				Departure: &gtfs.TripUpdate_StopTimeEvent{Time: proto.Int64(departure.Datetime.Unix())},
+			}
+			if trip, ok := trips[departure.TripID]; ok {
+				trip.StopTimeUpdate = append(trip.StopTimeUpdate, update)
+				if departure.Datetime.Before(starts[departure.TripID]) {
+					starts[departure.TripID] = departure.Datetime
+				}
+				continue
+			}
+
+			descriptor := &gtfs.TripDescriptor{RouteId: proto.String(departure.Line)}
+			if departure.Direction == "0" || departure.Direction == "1" {
+				descriptor.DirectionId = proto.Uint32(uint32(departure.Direction[0] - '0'))
+			}
+			trip := &gtfs.TripUpdate{
+				Trip:           descriptor,
+				StopTimeUpdate: []*gtfs.TripUpdate_StopTimeUpdate{update},
+				Timestamp:      proto.Uint64(timestamp),
+			}
+			id := fmt.Sprintf("%s:%s:%d", stop, departure.Line, i)
+			if departure.TripID != "" {
+				id = departure.TripID
+				descriptor.TripId = proto.String(departure.TripID)
+				trips[departure.TripID] = trip
+				starts[departure.TripID] = departure.Datetime
+			}
+			feed.Entity = append(feed.Entity, &gtfs.FeedEntity{Id: proto.String(id), TripUpdate: trip})
+		}
+	}
+
+	for id, trip := range trips {
+		start := starts[id]
+		trip.Trip.StartDate = proto.String(start.Format("20060102"))
+		trip.Trip.StartTime = proto.String(start.Format("15:04:05"))
+		// the stop time updates are ordered by stop sequence, which is the order of the departures
+		sort.SliceStable(trip.StopTimeUpdate, func(i, j int) bool {
+			return *trip.StopTimeUpdate[i].Departure.Time < *trip.StopTimeUpdate[j].Departure.Time
+		})
+	}
+	return feed
+}
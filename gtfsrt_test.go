@@ -0,0 +1,129 @@
+package sytralrt
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGTFSRTFeedEncoding(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	// the field numbers and wire types are the ones of gtfs-realtime.proto
+	data, err := proto.Marshal(newGTFSRTFeed(nil, time.Unix(1, 0)))
+	require.Nil(err)
+	assert.Equal([]byte{0x0a, 0x09, 0x0a, 0x03, '2', '.', '0', 0x10, 0x00, 0x18, 0x01}, data)
+
+	location, err := time.LoadLocation("Europe/Paris")
+	require.Nil(err)
+	datetime := time.Date(2018, 9, 17, 20, 28, 0, 0, location)
+	data, err = proto.Marshal(newGTFSRTFeed(map[string][]Departure{
+		"1": {{Stop: "1", Line: "87A", Datetime: datetime}},
+	}, time.Unix(1, 0)))
+	require.Nil(err)
+	// entity (2) > trip_update (3) > stop_time_update (2) > departure (3) > time (2)
+	event := protowire.AppendVarint([]byte{0x10}, uint64(datetime.Unix()))
+	// and stop_time_update (2) > stop_id (4)
+	stopTimeUpdate := append([]byte{0x1a, byte(len(event))}, event...)
+	stopTimeUpdate = append(stopTimeUpdate, 0x22, 0x01, '1')
+	assert.Contains(string(data), string(stopTimeUpdate))
+	// trip (1) > route_id (5)
+	assert.Contains(string(data), "\x0a\x05\x2a\x03"+"87A")
+}
+
+func TestGTFSRTFeedTrips(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	location, err := time.LoadLocation("Europe/Paris")
+	require.Nil(err)
+	datetime := time.Date(2018, 9, 17, 20, 28, 0, 0, location)
+	feed := newGTFSRTFeed(map[string][]Departure{
+		"1": {{Stop: "1", Line: "87A", Direction: "1", TripID: "87A-022AM:5:2:12", Datetime: datetime}},
+		"2": {
+			{Stop: "2", Line: "87A", Direction: "1", TripID: "87A-022AM:5:2:12", Datetime: datetime.Add(-5 * time.Minute)},
+			{Stop: "2", Line: "87A", Direction: "35998", Datetime: datetime},
+		},
+	}, time.Unix(1, 0))
+
+	// the departures of a trip are the stop time updates of a single trip update
+	require.Len(feed.Entity, 2)
+	trip := feed.Entity[0]
+	assert.Equal("87A-022AM:5:2:12", trip.GetId())
+	assert.Equal("87A-022AM:5:2:12", trip.TripUpdate.Trip.GetTripId())
+	assert.Equal("87A", trip.TripUpdate.Trip.GetRouteId())
+	assert.Equal(uint32(1), trip.TripUpdate.Trip.GetDirectionId())
+	assert.Equal("20180917", trip.TripUpdate.Trip.GetStartDate())
+	assert.Equal("20:23:00", trip.TripUpdate.Trip.GetStartTime())
+	require.Len(trip.TripUpdate.StopTimeUpdate, 2)
+	assert.Equal("2", trip.TripUpdate.StopTimeUpdate[0].GetStopId())
+	assert.Equal("1", trip.TripUpdate.StopTimeUpdate[1].GetStopId())
+
+	// a departure without trip is a trip update of its own, its direction isn't a GTFS one
+	alone := feed.Entity[1]
+	assert.Equal("2:87A:1", alone.GetId())
+	assert.Nil(alone.TripUpdate.Trip.TripId)
+	assert.Nil(alone.TripUpdate.Trip.DirectionId)
+	assert.Nil(alone.TripUpdate.Trip.StartDate)
+	require.Len(alone.TripUpdate.StopTimeUpdate, 1)
+}
+
+func TestGTFSRTAPI(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	_, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine = SetupRouter(&manager, engine)
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/departures/gtfs-rt", nil))
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+
+	uri, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshDepartures(&manager, *uri))
+	departures, err := manager.GetDeparturesByStop("3")
+	require.Nil(err)
+
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/departures/gtfs-rt", nil))
+	require.Equal(http.StatusOK, w.Code)
+	assert.Equal("application/x-protobuf", w.Header().Get("Content-Type"))
+
+	var feed gtfs.FeedMessage
+	require.Nil(proto.Unmarshal(w.Body.Bytes(), &feed))
+	assert.Equal("2.0", feed.Header.GetGtfsRealtimeVersion())
+	assert.Equal(uint64(manager.GetLastDepartureDataUpdate().Unix()), feed.Header.GetTimestamp())
+	var stop3 []*gtfs.TripUpdate_StopTimeUpdate
+	count := 0
+	for _, entity := range feed.Entity {
+		for _, update := range entity.TripUpdate.StopTimeUpdate {
+			count++
+			if update.GetStopId() == "3" && entity.TripUpdate.Trip.GetTripId() == departures[0].TripID {
+				assert.Equal(departures[0].Line, entity.TripUpdate.Trip.GetRouteId())
+				stop3 = append(stop3, update)
+			}
+		}
+	}
+	snapshot := manager.Snapshot()
+	expected := 0
+	for _, stopDepartures := range snapshot.Departures {
+		expected += len(stopDepartures)
+	}
+	assert.Equal(expected, count)
+	require.NotEmpty(departures[0].TripID)
+	require.Len(stop3, 1)
+	assert.Equal(departures[0].Datetime.Unix(), stop3[0].Departure.GetTime())
+}
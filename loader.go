@@ -1,22 +1,39 @@
 package sytralrt
 
 import (
+	"bufio"
 	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
 	"encoding/csv"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/pkg/sftp"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/text/encoding/charmap"
 )
 
+// The metrics of each data type in its own subsystem are deprecated, they are replaced by the metrics
+// labelled by source of metrics.go and only kept during the transition of the dashboards
 var (
 	departureLoadingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "sytralrt",
@@ -26,6 +43,22 @@ var (
 		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
 	})
 
+	departureFetchingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sytralrt",
+		Subsystem: "departures",
+		Name:      "fetch_durations_seconds",
+		Help:      "departures file download latency distributions.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
+	})
+
+	departureParsingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sytralrt",
+		Subsystem: "departures",
+		Name:      "parse_durations_seconds",
+		Help:      "departures file parsing latency distributions.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
+	})
+
 	departureLoadingErrors = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "sytralrt",
 		Subsystem: "departures",
@@ -41,6 +74,22 @@ var (
 		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
 	})
 
+	parkingsFetchingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sytralrt",
+		Subsystem: "parkings",
+		Name:      "fetch_durations_seconds",
+		Help:      "parkings file download latency distributions.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
+	})
+
+	parkingsParsingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sytralrt",
+		Subsystem: "parkings",
+		Name:      "parse_durations_seconds",
+		Help:      "parkings file parsing latency distributions.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
+	})
+
 	parkingsLoadingErrors = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "sytralrt",
 		Subsystem: "parkings",
@@ -56,32 +105,647 @@ var (
 		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
 	})
 
+	equipmentsFetchingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sytralrt",
+		Subsystem: "equipments",
+		Name:      "fetch_durations_seconds",
+		Help:      "equipments file download latency distributions.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
+	})
+
+	equipmentsParsingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sytralrt",
+		Subsystem: "equipments",
+		Name:      "parse_durations_seconds",
+		Help:      "equipments file parsing latency distributions.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
+	})
+
 	equipmentsLoadingErrors = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "sytralrt",
 		Subsystem: "equipments",
 		Name:      "loading_errors",
 		Help:      "current number of http request being served",
 	})
+
+	equipmentsAdded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Subsystem: "equipments",
+		Name:      "added_total",
+		Help:      "number of equipments absent from the previous equipments data",
+	})
+
+	equipmentsConflicts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Subsystem: "equipments",
+		Name:      "conflicts_total",
+		Help:      "number of equipments present in several files of a loading, deduplicated",
+	})
+
+	equipmentsRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Subsystem: "equipments",
+		Name:      "removed_total",
+		Help:      "number of equipments of the previous equipments data absent from the new one",
+	})
+
+	bikeStationsLoadingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sytralrt",
+		Subsystem: "bikestations",
+		Name:      "load_durations_seconds",
+		Help:      "bike stations loading latency distributions.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
+	})
+
+	bikeStationsFetchingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sytralrt",
+		Subsystem: "bikestations",
+		Name:      "fetch_durations_seconds",
+		Help:      "bike stations file download latency distributions.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
+	})
+
+	bikeStationsParsingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sytralrt",
+		Subsystem: "bikestations",
+		Name:      "parse_durations_seconds",
+		Help:      "bike stations file parsing latency distributions.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 1.5, 15),
+	})
+
+	bikeStationsLoadingErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Subsystem: "bikestations",
+		Name:      "loading_errors",
+		Help:      "number of errors while loading bike stations",
+	})
+
+	lastSuccessTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sytralrt",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "unix time of the last successful loading of each data type",
+	},
+		[]string{"type", "network"},
+	)
+
+	dataAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sytralrt",
+		Name:      "data_age_seconds",
+		Help:      "time since the last successful loading of each data type",
+	},
+		[]string{"type", "network"},
+	)
+
+	dataRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sytralrt",
+		Name:      "data_records",
+		Help:      "number of departures, parkings and equipments currently served",
+	},
+		[]string{"type", "network"},
+	)
+
+	sanitizedFields = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Name:      "sanitized_fields_total",
+		Help:      "number of CSV fields whose invalid UTF-8 bytes were replaced, by data type",
+	},
+		[]string{"type"},
+	)
+
+	badRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Name:      "bad_records_total",
+		Help:      "number of CSV records that couldn't be read or consumed, skipped or not, by source",
+	},
+		[]string{"source"},
+	)
+
+	incompleteRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Name:      "incomplete_records_total",
+		Help:      "number of records loaded with missing optional fields, by source",
+	},
+		[]string{"source"},
+	)
+
+	sftpResumesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Name:      "sftp_resumes_total",
+		Help:      "number of sftp downloads resumed after a failure",
+	})
+
+	unknownEquipmentStatuses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Name:      "equipments_unknown_status_total",
+		Help:      "number of equipments loaded with a raw status missing from the statuses mapping",
+	})
+
+	departureLoadLines    = newLoadLinesGauge("departures")
+	parkingsLoadLines     = newLoadLinesGauge("parkings")
+	bikeStationsLoadLines = newLoadLinesGauge("bikestations")
+
+	departuresMetrics = &sourceMetrics{DeparturesDataType, &legacyMetrics{
+		departureLoadingDuration, departureFetchingDuration, departureParsingDuration,
+		departureLoadingErrors, departureLoadLines,
+	}}
+	parkingsMetrics = &sourceMetrics{ParkingsDataType, &legacyMetrics{
+		parkingsLoadingDuration, parkingsFetchingDuration, parkingsParsingDuration,
+		parkingsLoadingErrors, parkingsLoadLines,
+	}}
+	equipmentsMetrics = &sourceMetrics{EquipmentsDataType, &legacyMetrics{
+		equipmentsLoadingDuration, equipmentsFetchingDuration, equipmentsParsingDuration,
+		equipmentsLoadingErrors, nil,
+	}}
+	bikeStationsMetrics = &sourceMetrics{BikeStationsDataType, &legacyMetrics{
+		bikeStationsLoadingDuration, bikeStationsFetchingDuration, bikeStationsParsingDuration,
+		bikeStationsLoadingErrors, bikeStationsLoadLines,
+	}}
+	stopsMetrics = newSourceMetrics(StopsDataType)
 )
 
+// UpdateDataAgeMetrics sets the data_age_seconds metric of every data type loaded at least once
+// and the data_records metric of the network of the manager, it is meant to be called periodically
+func UpdateDataAgeMetrics(manager *DataManager) {
+	network := manager.Network()
+	for dataType, status := range manager.getLoadStatuses() {
+		if !status.LastSuccess.IsZero() {
+			dataAge.WithLabelValues(dataType, network).Set(manager.Now().Sub(status.LastSuccess).Seconds())
+		}
+	}
+	dataRecords.WithLabelValues(DeparturesDataType, network).Set(float64(manager.DeparturesCount()))
+	dataRecords.WithLabelValues(ParkingsDataType, network).Set(float64(manager.ParkingsCount()))
+	dataRecords.WithLabelValues(EquipmentsDataType, network).Set(float64(manager.EquipmentsCount()))
+}
+
+// newLoadLinesGauge creates the metric exposing the LoadStats of the last loading of a data type
+func newLoadLinesGauge(subsystem string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sytralrt",
+		Subsystem: subsystem,
+		Name:      "last_load_lines",
+		Help:      "number of lines read, consumed, skipped and errored during the last loading",
+	},
+		[]string{"state"},
+	)
+}
+
 func init() {
-	prometheus.MustRegister(departureLoadingDuration)
-	prometheus.MustRegister(departureLoadingErrors)
-	prometheus.MustRegister(parkingsLoadingDuration)
-	prometheus.MustRegister(parkingsLoadingErrors)
-	prometheus.MustRegister(equipmentsLoadingDuration)
-	prometheus.MustRegister(equipmentsLoadingErrors)
+	mustRegister(departureLoadingDuration)
+	mustRegister(departureLoadingErrors)
+	mustRegister(departureFetchingDuration)
+	mustRegister(departureParsingDuration)
+	mustRegister(parkingsLoadingDuration)
+	mustRegister(parkingsLoadingErrors)
+	mustRegister(parkingsFetchingDuration)
+	mustRegister(parkingsParsingDuration)
+	mustRegister(equipmentsLoadingDuration)
+	mustRegister(equipmentsLoadingErrors)
+	mustRegister(equipmentsFetchingDuration)
+	mustRegister(equipmentsParsingDuration)
+	mustRegister(equipmentsAdded)
+	mustRegister(equipmentsRemoved)
+	mustRegister(equipmentsConflicts)
+	mustRegister(bikeStationsLoadingDuration)
+	mustRegister(bikeStationsLoadingErrors)
+	mustRegister(bikeStationsFetchingDuration)
+	mustRegister(bikeStationsParsingDuration)
+	mustRegister(lastSuccessTimestamp)
+	mustRegister(dataAge)
+	mustRegister(dataRecords)
+	mustRegister(unknownEquipmentStatuses)
+	mustRegister(sftpResumesTotal)
+	mustRegister(sanitizedFields)
+	mustRegister(incompleteRecords)
+	mustRegister(badRecords)
+	mustRegister(departureLoadLines)
+	mustRegister(parkingsLoadLines)
+	mustRegister(bikeStationsLoadLines)
+}
+
+// fetchSemaphore bounds the number of files fetched at the same time, a nil channel means no limit
+var fetchSemaphore chan struct{}
+
+// SetMaxConcurrentFetches limits the number of files fetched at the same time to protect the upstream servers,
+// fetches above this limit are queued. 0 (the default) disables the limit.
+// This must be called before starting to refresh data.
+func SetMaxConcurrentFetches(max int) {
+	if max <= 0 {
+		fetchSemaphore = nil
+		return
+	}
+	fetchSemaphore = make(chan struct{}, max)
+}
+
+// acquireFetchSlot waits for a slot of fetchSemaphore, it gives up with the error of ctx once ctx is done.
+// The slot must be given back with releaseFetchSlot.
+func acquireFetchSlot(ctx context.Context) error {
+	if fetchSemaphore == nil {
+		return nil
+	}
+	select {
+	case fetchSemaphore <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseFetchSlot() {
+	if fetchSemaphore != nil {
+		<-fetchSemaphore
+	}
+}
+
+// rawDataMaxSize is the number of bytes of the last loaded file kept for each data type, 0 means none
+var rawDataMaxSize int
+
+// SetMaxRawDataSize sets the number of bytes of the last successfully loaded file kept for each data type,
+// the files are truncated above this size. 0 (the default) disables the retention of the files.
+// This must be called before starting to refresh data.
+func SetMaxRawDataSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	rawDataMaxSize = size
+}
+
+// byteCounter counts the bytes read through it
+type byteCounter struct {
+	reader io.Reader
+	count  int64
+}
+
+func (b *byteCounter) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.count += int64(n)
+	return n, err
+}
+
+// rawRecorder keeps a copy of the first rawDataMaxSize bytes read from a file,
+// a nil rawRecorder keeps nothing
+type rawRecorder struct {
+	buffer    bytes.Buffer
+	truncated bool
+}
+
+func newRawRecorder() *rawRecorder {
+	if rawDataMaxSize <= 0 {
+		return nil
+	}
+	return &rawRecorder{}
+}
+
+// tee returns a reader copying into the recorder what is read from file
+func (r *rawRecorder) tee(file io.Reader) io.Reader {
+	if r == nil {
+		return file
+	}
+	return io.TeeReader(file, r)
+}
+
+func (r *rawRecorder) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := rawDataMaxSize - r.buffer.Len(); room < n {
+		r.truncated = true
+		if room < 0 {
+			room = 0
+		}
+		p = p[:room]
+	}
+	r.buffer.Write(p)
+	return n, nil
+}
+
+// store saves the recorded file as the raw data of the data type, the content type is guessed
+// from the extension of the uri or else from the content
+func (r *rawRecorder) store(manager *DataManager, dataType string, uri url.URL) {
+	if r == nil {
+		return
+	}
+	// the raw data are recorded once decompressed
+	contentType := mime.TypeByExtension(path.Ext(uncompressedPath(uri)))
+	if contentType == "" {
+		contentType = http.DetectContentType(r.buffer.Bytes())
+	}
+	manager.updateRawData(dataType, RawData{
+		Content:     r.buffer.Bytes(),
+		ContentType: contentType,
+		Truncated:   r.truncated,
+		LoadedAt:    manager.Now(),
+	})
+}
+
+// RefreshOptions defines how the data of a source are fetched
+type RefreshOptions struct {
+	// Fallbacks are tried in turn when the file can't be fetched from the main uri
+	Fallbacks []url.URL
+	// Charset of CSV files (utf-8, iso-8859-1 or windows-1252), utf-8 is used if empty.
+	// XML files declare their own charset.
+	Charset string
+	// Streaming makes the parser read the file while it is downloaded instead of buffering it entirely
+	// in memory first, it is useful for big files. The download time is then accounted in the parse duration.
+	Streaming bool
+	// Headers are added to the requests of http(s) fetches
+	Headers http.Header
+	// Format of the departures data: CSVFormat, JSONFormat or SiriFormat, guessed from the uri extension if empty
+	Format string
+	// TrimTrailingEmptyField removes the empty field produced by a trailing delimiter on the lines of CSV files
+	TrimTrailingEmptyField bool
+	// DetectDelimiter guesses the delimiter of the CSV files among ';', ',', tab and '|' from their first data
+	// line, ';' is used when the guess is ambiguous
+	DetectDelimiter bool
+	// SanitizeUTF8 replaces the invalid UTF-8 bytes of the fields of CSV files by the Unicode replacement
+	// character, instead of serving them as is and failing to encode the responses
+	SanitizeUTF8 bool
+	// NormalizeStopIDs indexes the departures, and the stops reference data, by stop id normalized with NormalizeStopID
+	NormalizeStopIDs bool
+	// DateLayouts are the layouts of the dates and times of the data, DefaultDateLayouts are used for the empty ones.
+	// They don't apply to SIRI data.
+	DateLayouts DateLayouts
+	// DirectionColumn is the column of the direction in the departures CSV files, the direction is left empty
+	// for the lines without this column. The seventh column is used if nil.
+	DirectionColumn *int
+	// LineColumn is the column of the line in the departures CSV files, the second column is used if nil
+	LineColumn *int
+	// LineElement is the element of the MonitoredVehicleJourney holding the line of the departures in SIRI data,
+	// for example PublishedLineName, LineRef is used if empty
+	LineElement string
+	// DeparturesFilter drops the departures it doesn't match while they are loaded, they are all kept if nil
+	DeparturesFilter *DepartureFilter
+	// MergeEquipments makes the equipments loaded update and insert the equipments by ID instead of replacing
+	// all of them, see DataManager.MergeEquipments
+	MergeEquipments bool
+	// EquipmentsDedup tells which equipment is kept when several files of a loading hold the same id:
+	// NewestEquipmentWins (used if empty) or FirstSourceWins
+	EquipmentsDedup string
+	// EquipmentsTTL is the time after which an equipment absent from the merged files is removed, 0 means never
+	EquipmentsTTL time.Duration
+	// EquipmentRequiredFields are the attributes without which an equipment fails the loading, the missing
+	// optional attributes are left empty. DefaultEquipmentRequiredFields is used if nil.
+	EquipmentRequiredFields EquipmentFields
+	// EquipmentStatuses maps the raw statuses of the equipments, the status is computed from the dates if nil
+	EquipmentStatuses EquipmentStatuses
+	// EquipmentsParseWorkers is the number of goroutines building the equipments of a file once it is
+	// decoded, for the big files. They are built by the loading goroutine if it is 0 or 1.
+	EquipmentsParseWorkers int
+	// MinFutureDeparturesRatio is the share of the departures (from 0 to 1) that must be in the future, the
+	// departures loaded with less of them fail their sanity check. There is no check if it is 0.
+	MinFutureDeparturesRatio float64
+	// MaxUnknownEquipmentsRatio is the share of the equipments (from 0 to 1) with an unknown status above which
+	// the equipments loaded fail their sanity check. There is no check if it is 0.
+	MaxUnknownEquipmentsRatio float64
+	// ParkingFields gives the columns of the parkings CSV files, DefaultParkingFields is used if nil
+	ParkingFields ParkingFields
+	// Publisher receives the departures of each successful refresh, it should not block (see AsyncPublisher)
+	Publisher Publisher
+	// Password is the password of the user of the uris without one, read at each connection
+	Password PasswordSource
+	// BadRecordPolicy tells what to do with the lines of the departures CSV files that can't be read or
+	// consumed: FailOnBadRecord (used if empty), SkipBadRecords or SkipBadRecordsUpTo MaxBadRecords.
+	// The skipped lines are logged and counted.
+	BadRecordPolicy string
+	MaxBadRecords   int
+	// PartialRefresh fetches with HTTP Range requests only the lines appended to the departures file since the
+	// previous loading and adds their departures to the current ones, for the files that are only ever appended to.
+	// The file is fetched entirely at the first loading, when the server ignores the Range or when the file gets
+	// shorter. It only applies to uncompressed CSV files served over http(s), the file is then never streamed.
+	PartialRefresh bool
+	// Timeout bounds a whole loading, the fetch and the reading of every file included, past it the loading
+	// is cancelled and fails. There is no bound if it is 0.
+	Timeout time.Duration
+}
+
+// refreshContext returns the context of a loading, cancelled after the Timeout if there is one
+func (o RefreshOptions) refreshContext() (context.Context, context.CancelFunc) {
+	if o.Timeout > 0 {
+		return context.WithTimeout(context.Background(), o.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// maxBadRecords is the LoadDataOptions.maxBadRecords of the BadRecordPolicy
+func (o RefreshOptions) maxBadRecords() int {
+	switch o.BadRecordPolicy {
+	case SkipBadRecords:
+		return -1
+	case SkipBadRecordsUpTo:
+		if o.MaxBadRecords > 0 {
+			return o.MaxBadRecords
+		}
+	}
+	return 0
+}
+
+// PasswordSource reads a password from an environment variable or a file, so that it is kept out of
+// the uris and of the configuration. The environment variable is used if both are given.
+type PasswordSource struct {
+	Env  string
+	File string
+}
+
+// withPassword returns uri with the password read from source if it has a user without password,
+// uri is returned as is if source is empty
+func withPassword(uri url.URL, source PasswordSource) (url.URL, error) {
+	if source.Env == "" && source.File == "" {
+		return uri, nil
+	}
+	if uri.User == nil {
+		return uri, fmt.Errorf("No user in %s to authenticate with the password", redactURI(uri))
+	}
+	if _, set := uri.User.Password(); set {
+		return uri, nil
+	}
+
+	var password string
+	if source.Env != "" {
+		var ok bool
+		if password, ok = os.LookupEnv(source.Env); !ok {
+			return uri, fmt.Errorf("The password environment variable %s isn't set", source.Env)
+		}
+	} else {
+		content, err := ioutil.ReadFile(source.File)
+		if err != nil {
+			return uri, fmt.Errorf("Impossible to read the password file: %s", err)
+		}
+		password = strings.TrimRight(string(content), "\r\n")
+	}
+	uri.User = url.UserPassword(uri.User.Username(), password)
+	return uri, nil
 }
 
 func getFile(uri url.URL) (io.Reader, error) {
+	return getFileWithOptions(context.Background(), uri, RefreshOptions{})
+}
+
+// getFileWithOptions downloads the file at uri, ctx only bounds the wait for a slot of fetchSemaphore
+func getFileWithOptions(ctx context.Context, uri url.URL, options RefreshOptions) (io.Reader, error) {
+	uri, err := withPassword(uri, options.Password)
+	if err != nil {
+		return nil, err
+	}
+	if err = acquireFetchSlot(ctx); err != nil {
+		return nil, err
+	}
+	defer releaseFetchSlot()
+
+	var file io.Reader
 	if uri.Scheme == "sftp" {
-		return getFileWithSftp(uri)
+		file, err = getFileWithSftp(uri)
+	} else if uri.Scheme == "scp" {
+		file, err = getFileWithScp(uri)
 	} else if uri.Scheme == "file" {
-		return getFileWithFS(uri)
+		file, err = getFileWithFS(uri)
+	} else if uri.Scheme == "http" || uri.Scheme == "https" {
+		file, err = getFileWithHTTP(uri, options.Headers)
+	} else if uri.Scheme == "gs" {
+		file, err = getFileWithGCS(uri)
 	} else {
-		return nil, fmt.Errorf("Unsupported protocols %s", uri.Scheme)
+		err = fmt.Errorf("Unsupported protocols %s", uri.Scheme)
 	}
+	if err != nil {
+		return nil, err
+	}
+	return decompress(uri, file)
+}
 
+// decompress wraps file in the decompressor matching the extension of uri,
+// file is returned as is if the extension isn't a compression format
+func decompress(uri url.URL, file io.Reader) (io.Reader, error) {
+	switch strings.ToLower(path.Ext(uri.Path)) {
+	case ".gz":
+		return gzip.NewReader(file)
+	case ".bz2":
+		return bzip2.NewReader(file), nil
+	case ".xz":
+		return nil, fmt.Errorf("Unsupported compression format xz for %s", redactURI(uri))
+	}
+	return file, nil
+}
+
+// uncompressedPath returns the path of uri without the extension of its compression format
+func uncompressedPath(uri url.URL) string {
+	switch ext := path.Ext(uri.Path); strings.ToLower(ext) {
+	case ".gz", ".bz2", ".xz":
+		return strings.TrimSuffix(uri.Path, ext)
+	}
+	return uri.Path
+}
+
+// decompressedFile closes the compressed file once its decompressed content has been read
+type decompressedFile struct {
+	io.Reader
+	file io.Closer
+}
+
+func (d *decompressedFile) Close() error {
+	return d.file.Close()
+}
+
+// openFile returns a reader streaming the file at uri, the connection is held until the reader is closed
+func openFile(ctx context.Context, uri url.URL, options RefreshOptions) (io.ReadCloser, error) {
+	uri, err := withPassword(uri, options.Password)
+	if err != nil {
+		return nil, err
+	}
+	if err = acquireFetchSlot(ctx); err != nil {
+		return nil, err
+	}
+	release := releaseFetchSlot
+
+	var file io.ReadCloser
+	if uri.Scheme == "sftp" {
+		file, err = openSftp(uri)
+	} else if uri.Scheme == "scp" {
+		file, err = openFileWithScp(uri)
+	} else if uri.Scheme == "file" {
+		file, err = os.Open(uri.Path)
+	} else if uri.Scheme == "http" || uri.Scheme == "https" {
+		file, err = openFileWithHTTP(ctx, uri, options.Headers)
+	} else if uri.Scheme == "gs" {
+		file, err = openFileWithGCS(ctx, uri)
+	} else {
+		err = fmt.Errorf("Unsupported protocols %s", uri.Scheme)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	reader, err := decompress(uri, file)
+	if err != nil {
+		file.Close()
+		release()
+		return nil, err
+	}
+	if reader != io.Reader(file) {
+		file = &decompressedFile{reader, file}
+	}
+	return &releaseOnClose{file, release}, nil
+}
+
+// releaseOnClose calls release once the underlying ReadCloser has been closed
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
+
+// fetchFile returns the file at uri, if it fails every fallback is tried in turn.
+// The returned reader must be closed once read, its reads fail once ctx is done.
+func fetchFile(ctx context.Context, uri url.URL, options RefreshOptions) (io.ReadCloser, error) {
+	fetch := func(uri url.URL) (io.ReadCloser, error) {
+		if options.Streaming {
+			file, err := openFile(ctx, uri, options)
+			if err != nil {
+				return nil, err
+			}
+			return newContextReader(ctx, file), nil
+		}
+		if _, bounded := ctx.Deadline(); bounded {
+			// the file is streamed into the buffer so that the download can be interrupted
+			file, err := openFile(ctx, uri, options)
+			if err != nil {
+				return nil, err
+			}
+			reader := newContextReader(ctx, file)
+			defer reader.Close()
+			var buffer bytes.Buffer
+			if _, err = buffer.ReadFrom(reader); err != nil {
+				return nil, err
+			}
+			return newContextReader(ctx, ioutil.NopCloser(&buffer)), nil
+		}
+		file, err := getFileWithOptions(ctx, uri, options)
+		if err != nil {
+			return nil, err
+		}
+		return newContextReader(ctx, ioutil.NopCloser(file)), nil
+	}
+
+	file, err := fetch(uri)
+	if err == nil {
+		return file, nil
+	}
+	for _, fallback := range options.Fallbacks {
+		logrus.Warnf("Impossible to fetch %s: %s, trying fallback %s", redactURI(uri), err, redactURI(fallback))
+		uri = fallback
+		if file, err = fetch(uri); err == nil {
+			logrus.Infof("Data fetched from fallback %s", redactURI(uri))
+			return file, nil
+		}
+	}
+	return nil, err
+}
+
+// redactURI returns the uri without its password so that it can be logged
+func redactURI(uri url.URL) string {
+	if _, ok := uri.User.Password(); ok {
+		uri.User = url.UserPassword(uri.User.Username(), "xxxxx")
+	}
+	return uri.String()
 }
 
 func getFileWithFS(uri url.URL) (io.Reader, error) {
@@ -97,36 +761,727 @@ func getFileWithFS(uri url.URL) (io.Reader, error) {
 	return &buffer, nil
 }
 
-func getFileWithSftp(uri url.URL) (io.Reader, error) {
+func openFileWithHTTP(ctx context.Context, uri url.URL, headers http.Header) (io.ReadCloser, error) {
+	resp, err := doHTTPRequest(ctx, uri, headers)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, httpStatusError(resp, uri)
+	}
+	return resp.Body, nil
+}
+
+// doHTTPRequest sends a GET request of uri with the headers, the body of the response must be closed
+func doHTTPRequest(ctx context.Context, uri url.URL, headers http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, uri.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	return httpClient.Do(req)
+}
+
+// httpStatusError is the error of a response with an unexpected status, a RetryAfterError if the server
+// asked to wait
+func httpStatusError(resp *http.Response, uri url.URL) error {
+	err := fmt.Errorf("Unexpected status %s while fetching %s", resp.Status, redactURI(uri))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return &RetryAfterError{Err: err, Delay: delay}
+		}
+	}
+	return err
+}
+
+// rangeable tells if the departures at uri can be fetched partially with HTTP Range requests: uncompressed
+// CSV files served over http(s)
+func rangeable(uri url.URL, options RefreshOptions) bool {
+	return (uri.Scheme == "http" || uri.Scheme == "https") && uncompressedPath(uri) == uri.Path &&
+		departuresFormat(uri, options) == CSVFormat
+}
+
+// fetchFileRange fetches the bytes of the file at uri following offset with an HTTP Range request, the whole
+// file is fetched if offset is 0. The Range is conditioned by If-Range on validator, the ETag or Last-Modified
+// of the file previously fetched, and validator is then the one of the file fetched. partial is false if the
+// content is the whole file, because the server ignored the Range, because the file changed (it has been
+// replaced) or because the file is now shorter than offset.
+func fetchFileRange(ctx context.Context, uri url.URL, options RefreshOptions, offset int64,
+	validator string) (content []byte, partial bool, newValidator string, err error) {
+	uri, err = withPassword(uri, options.Password)
+	if err != nil {
+		return nil, false, "", err
+	}
+	if err = acquireFetchSlot(ctx); err != nil {
+		return nil, false, "", err
+	}
+	defer releaseFetchSlot()
+
+	// the file is fetched again entirely in the same slot of the semaphore if it has been replaced
+	content, partial, newValidator, refetch, err := requestFileRange(ctx, uri, options, offset, validator)
+	if refetch {
+		content, partial, newValidator, _, err = requestFileRange(ctx, uri, options, 0, "")
+	}
+	return content, partial, newValidator, err
+}
+
+// requestFileRange sends the request of fetchFileRange, refetch tells that the file has been replaced and must
+// be fetched entirely
+func requestFileRange(ctx context.Context, uri url.URL, options RefreshOptions, offset int64,
+	validator string) (content []byte, partial bool, newValidator string, refetch bool, err error) {
+	headers := make(http.Header, len(options.Headers)+2)
+	for key, values := range options.Headers {
+		headers[key] = values
+	}
+	if offset > 0 {
+		headers.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if validator != "" {
+			headers.Set("If-Range", validator)
+		}
+	}
+	resp, err := doHTTPRequest(ctx, uri, headers)
+	if err != nil {
+		return nil, false, "", false, err
+	}
+	defer resp.Body.Close()
+	newValidator = rangeValidator(resp.Header)
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if start, _, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || start != offset {
+			return nil, false, "", false, fmt.Errorf("Unexpected Content-Range %q while fetching %s from byte %d",
+				resp.Header.Get("Content-Range"), redactURI(uri), offset)
+		}
+		if newValidator != "" && newValidator != validator {
+			// a server ignoring If-Range sends a part of another file, and a part can't be trusted
+			// without the validator of the file it follows
+			logrus.Infof("%s has been replaced, fetching it entirely", redactURI(uri))
+			return nil, false, "", true, nil
+		}
+		partial = true
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// nothing has been appended, unless the file has been replaced by a shorter one
+		if _, size, ok := parseContentRange(resp.Header.Get("Content-Range")); ok && size == offset &&
+			(newValidator == "" || newValidator == validator) {
+			return nil, true, validator, false, nil
+		}
+		logrus.Infof("%s is shorter than the %d bytes already loaded, fetching it entirely", redactURI(uri), offset)
+		return nil, false, "", true, nil
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			logrus.Debugf("Range ignored by the server of %s or file replaced, fetching it entirely", redactURI(uri))
+		}
+	default:
+		return nil, false, "", false, httpStatusError(resp, uri)
+	}
+	content, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, "", false, err
+	}
+	return content, partial, newValidator, false, nil
+}
+
+// rangeValidator returns the validator of a response usable with If-Range: its ETag if it is strong, its
+// Last-Modified otherwise, "" if it has none
+func rangeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// parseContentRange reads the first byte and the complete length of a Content-Range header,
+// like "bytes 100-199/200" or "bytes */200". start is -1 for the latter, size is -1 if it is unknown.
+func parseContentRange(header string) (start, size int64, ok bool) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(header, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	size = -1
+	if parts[1] != "*" {
+		var err error
+		if size, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	if parts[0] == "*" {
+		return -1, size, true
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, size, true
+}
+
+// RetryAfterError is the error of a source asking to wait before fetching it again
+type RetryAfterError struct {
+	Err   error
+	Delay time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Err, e.Delay)
+}
+
+// parseRetryAfter reads a Retry-After header, given in seconds or as an http date
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// MaxRetryAfterRefreshes bounds the delay asked by a source with Retry-After to this number of refresh
+// intervals, so that a wrong header doesn't stop the refreshes of a data type
+const MaxRetryAfterRefreshes = 10
+
+// NextRefresh returns the time to wait before the next refresh of a data type after a refresh that ended
+// with err: the refresh interval, or the delay asked by the source if it is longer, up to
+// MaxRetryAfterRefreshes refresh intervals
+func NextRefresh(err error, refresh time.Duration) time.Duration {
+	if retry, ok := err.(*RetryAfterError); ok && retry.Delay > refresh {
+		delay := retry.Delay
+		if max := MaxRetryAfterRefreshes * refresh; delay > max {
+			logrus.Warnf("The source asked to wait %s before the next refresh, waiting %s", delay, max)
+			return max
+		}
+		logrus.Warnf("The source asked to wait %s before the next refresh", delay)
+		return delay
+	}
+	return refresh
+}
+
+func getFileWithHTTP(uri url.URL, headers http.Header) (io.Reader, error) {
+	body, err := openFileWithHTTP(context.Background(), uri, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var buffer bytes.Buffer
+	if _, err = buffer.ReadFrom(body); err != nil {
+		return nil, err
+	}
+	return &buffer, nil
+}
+
+// DefaultHTTPTimeout bounds the http(s) fetches, the download of the body included
+const DefaultHTTPTimeout = 5 * time.Minute
+
+// httpClient is the client of the http(s) and gcs fetches
+var httpClient = &http.Client{Timeout: DefaultHTTPTimeout}
+
+// SetHTTPTimeout bounds the http(s) and gcs fetches, the download of the body included, so that a server
+// that stops answering fails the fetch instead of hanging it. This must be called before starting to refresh data.
+func SetHTTPTimeout(timeout time.Duration) {
+	httpClient = &http.Client{Timeout: timeout}
+}
+
+var (
+	// sftpKeepAlive is the time between two keepalive requests on the ssh connections, 0 means none
+	sftpKeepAlive time.Duration
+	// sftpReadTimeout is the time after which a read on an ssh connection fails, 0 means never
+	sftpReadTimeout time.Duration
+	// sftpResumes is the number of times a failed sftp download is resumed on a new connection, 0 means never
+	sftpResumes int
+	// sshAlgorithms are the ciphers, key exchanges and MACs offered on the ssh connections,
+	// the defaults of the ssh library are used for the empty ones
+	sshAlgorithms ssh.Config
+)
+
+// SetSftpKeepAlive makes the sftp fetches send a keepalive request every interval and fail if nothing
+// is received during readTimeout, so that a stalled transfer errors instead of hanging. 0 (the default)
+// disables them. This must be called before starting to refresh data.
+func SetSftpKeepAlive(interval, readTimeout time.Duration) {
+	sftpKeepAlive = interval
+	sftpReadTimeout = readTimeout
+}
+
+// SetSftpResumes makes a sftp download failing midway reconnect and read only the rest of the file, from
+// the offset reached, up to resumes times per download. A file modified in between isn't resumed. 0 (the default)
+// disables it, the download then fails. This must be called before starting to refresh data.
+func SetSftpResumes(resumes int) {
+	sftpResumes = resumes
+}
+
+// SetSftpAlgorithms restricts the ciphers, key exchange algorithms and MACs offered on the sftp and scp
+// connections, in order of preference, to match the policy of hardened servers. The defaults of the ssh library
+// are used for the nil ones. This must be called before starting to refresh data.
+func SetSftpAlgorithms(ciphers, keyExchanges, macs []string) {
+	sshAlgorithms = ssh.Config{
+		Ciphers:      ciphers,
+		KeyExchanges: keyExchanges,
+		MACs:         macs,
+	}
+}
+
+// deadlineConn is a connection whose reads fail if nothing is received during timeout
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+// keepAlive sends keepalive requests on the ssh connection until done is closed,
+// the connection is closed if a request fails
+func keepAlive(sshClient *ssh.Client, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				logrus.Warnf("sftp keepalive to %s failed: %s", sshClient.RemoteAddr(), err)
+				sshClient.Close()
+				return
+			}
+		}
+	}
+}
+
+// sftpFile is a remote file that closes its sftp session and ssh connection when closed,
+// or gives them back to the pool if it has been opened on a connection of the pool
+type sftpFile struct {
+	*sftp.File
+	client    *sftp.Client
+	sshClient *ssh.Client
+	done      chan struct{}
+
+	connection *sftpConnection
+	// broken keeps the connection of the pool from being reused, after a failed read
+	broken bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (f *sftpFile) Close() error {
+	f.closeOnce.Do(func() {
+		f.closeErr = f.File.Close()
+		if f.connection != nil {
+			f.connection.release(f.broken)
+			return
+		}
+		close(f.done)
+		f.client.Close()
+		f.sshClient.Close()
+	})
+	return f.closeErr
+}
+
+func openFileWithSftp(uri url.URL) (*sftpFile, error) {
+	breaker := getSftpBreaker(uri.Host)
+	if breaker == nil {
+		return dialSftpFile(uri)
+	}
+	if err := breaker.allow(); err != nil {
+		return nil, err
+	}
+	file, err := dialSftpFile(uri)
+	breaker.done(err)
+	return file, err
+}
+
+// openSftp opens the file at uri, its download is resumed on failure if SetSftpResumes has been set
+func openSftp(uri url.URL) (io.ReadCloser, error) {
+	file, err := openFileWithSftp(uri)
+	if err != nil {
+		return nil, err
+	}
+	if sftpResumes <= 0 {
+		return file, nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &resumableSftpFile{file: file, uri: uri, info: info}, nil
+}
+
+// resumableSftpFile is a sftp file whose download is resumed from the offset reached, on a new
+// connection, when a read fails
+type resumableSftpFile struct {
+	file    *sftpFile
+	uri     url.URL
+	info    os.FileInfo
+	offset  int64
+	resumes int
+}
+
+// A lost connection can end the reads with io.EOF, the download is resumed if the file isn't complete
+func (f *resumableSftpFile) Read(p []byte) (int, error) {
+	for {
+		n, err := f.file.Read(p)
+		f.offset += int64(n)
+		if err == io.EOF && f.offset < f.info.Size() {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if err = f.resume(err); err != nil || n > 0 {
+			return n, err
+		}
+	}
+}
+
+// WriteTo keeps the concurrent reads of sftp.File.WriteTo, an error of w isn't resumed
+func (f *resumableSftpFile) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for {
+		recorder := &writeErrorRecorder{Writer: w}
+		n, err := f.file.WriteTo(recorder)
+		written += n
+		f.offset += n
+		if err == nil && f.offset < f.info.Size() {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || recorder.err != nil {
+			return written, err
+		}
+		if err = f.resume(err); err != nil {
+			return written, err
+		}
+	}
+}
+
+// resume replaces the failed connection by a new one positioned at the offset reached,
+// cause is returned if there are no resumes left
+func (f *resumableSftpFile) resume(cause error) error {
+	if f.resumes >= sftpResumes {
+		return cause
+	}
+	f.resumes++
+	sftpResumesTotal.Inc()
+	logrus.Warnf("sftp download of %s failed after %d/%d bytes: %s, resuming (%d/%d)",
+		redactURI(f.uri), f.offset, f.info.Size(), cause, f.resumes, sftpResumes)
+	f.file.broken = true
+	f.file.Close()
+	f.file = nil
+
+	file, err := openFileWithSftp(f.uri)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if info.Size() != f.info.Size() || !info.ModTime().Equal(f.info.ModTime()) {
+		file.Close()
+		return fmt.Errorf("%s has been modified during its download, it can't be resumed", redactURI(f.uri))
+	}
+	if _, err = file.Seek(f.offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	return nil
+}
+
+func (f *resumableSftpFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// writeErrorRecorder records the error of the writes, to tell them apart from the errors of the reads
+type writeErrorRecorder struct {
+	io.Writer
+	err error
+}
+
+func (w *writeErrorRecorder) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// sftpAddress returns the address to dial for an sftp uri, IPv6 literals are bracketed
+// and the port defaults to 22
+func sftpAddress(uri url.URL) string {
+	port := uri.Port()
+	if port == "" {
+		port = "22"
+	}
+	return net.JoinHostPort(uri.Hostname(), port)
+}
+
+// dialSSH opens an ssh connection to the host of the uri with its credentials,
+// keepalive requests are sent on it until done is closed
+func dialSSH(uri url.URL, done <-chan struct{}) (*ssh.Client, error) {
+	sshConfig := newSSHConfig(uri, sftpReadTimeout)
+	address := sftpAddress(uri)
+	conn, err := net.DialTimeout("tcp", address, sshConfig.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if sftpReadTimeout > 0 {
+		conn = &deadlineConn{conn, sftpReadTimeout}
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+	if sftpKeepAlive > 0 {
+		go keepAlive(sshClient, sftpKeepAlive, done)
+	}
+	return sshClient, nil
+}
+
+// newSSHConfig returns the configuration to connect with the credentials of the uri
+func newSSHConfig(uri url.URL, timeout time.Duration) *ssh.ClientConfig {
 	password, _ := uri.User.Password()
-	sshConfig := &ssh.ClientConfig{
-		User: uri.User.Username(),
+	return &ssh.ClientConfig{
+		Config: sshAlgorithms,
+		User:   uri.User.Username(),
 		Auth: []ssh.AuthMethod{
 			ssh.Password(password),
 		},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec
+		Timeout:         timeout,
 	}
+}
 
-	sshClient, err := ssh.Dial("tcp", uri.Host, sshConfig)
+// CheckSource checks that the file at uri can be reached without downloading it, within timeout:
+// an sftp session is opened and the file stat'ed, an scp host is logged in, an http(s) uri must answer
+// a HEAD request, the metadata of a GCS object must be readable and a local file must exist. It doesn't go through the sftp circuit breaker.
+func CheckSource(uri url.URL, timeout time.Duration) error {
+	return CheckSourceWithHeaders(uri, nil, timeout)
+}
+
+// CheckSourceWithHeaders checks the source like CheckSource, the HEAD request of an http(s) uri is sent with headers
+// as the fetches of RefreshOptions.Headers, so that a source needing them isn't reported unreachable
+func CheckSourceWithHeaders(uri url.URL, headers http.Header, timeout time.Duration) error {
+	switch uri.Scheme {
+	case "sftp", "scp":
+		return checkSSHSource(uri, timeout)
+	case "file":
+		_, err := os.Stat(uri.Path)
+		return err
+	case "http", "https":
+		req, err := http.NewRequest(http.MethodHead, uri.String(), nil)
+		if err != nil {
+			return err
+		}
+		for key, values := range headers {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("Unexpected status %s while checking %s", resp.Status, redactURI(uri))
+		}
+		return nil
+	case "gs":
+		return checkGCSSource(uri, timeout)
+	}
+	return fmt.Errorf("Unsupported protocols %s", uri.Scheme)
+}
+
+func checkSSHSource(uri url.URL, timeout time.Duration) error {
+	address := sftpAddress(uri)
+	conn, err := net.DialTimeout("tcp", address, timeout)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, newSSHConfig(uri, timeout))
+	if err != nil {
+		return err
 	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
 	defer sshClient.Close()
+	if uri.Scheme != "sftp" {
+		return nil
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	_, err = client.Stat(uri.Path)
+	return err
+}
+
+func dialSftpFile(uri url.URL) (*sftpFile, error) {
+	if sftpPool.idleTimeout > 0 {
+		return openPooledSftpFile(uri)
+	}
+	done := make(chan struct{})
+	sshClient, err := dialSSH(uri, done)
+	if err != nil {
+		return nil, err
+	}
 
 	// open an SFTP session over an existing ssh connection.
 	client, err := sftp.NewClient(sshClient)
 	if err != nil {
+		close(done)
+		sshClient.Close()
 		return nil, err
 	}
-	defer client.Close()
 
 	file, err := client.Open(uri.Path)
+	if err != nil {
+		close(done)
+		client.Close()
+		sshClient.Close()
+		return nil, err
+	}
+	return &sftpFile{File: file, client: client, sshClient: sshClient, done: done}, nil
+}
+
+// scpFile is a remote file read from the output of cat over ssh, for the servers without the sftp subsystem.
+// It closes its ssh session and connection when closed.
+type scpFile struct {
+	stdout    io.Reader
+	session   *ssh.Session
+	sshClient *ssh.Client
+	done      chan struct{}
+
+	// waited is set once the exit status of cat has been read into waitErr, it can only be read once
+	waited  bool
+	waitErr error
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (f *scpFile) Read(p []byte) (int, error) {
+	n, err := f.stdout.Read(p)
+	if err == io.EOF {
+		// the whole output has been read, cat may still have failed
+		if !f.waited {
+			f.waitErr = f.session.Wait()
+			f.waited = true
+		}
+		if f.waitErr != nil {
+			return n, f.waitErr
+		}
+	}
+	return n, err
+}
+
+func (f *scpFile) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.done)
+		f.session.Close()
+		f.closeErr = f.sshClient.Close()
+	})
+	return f.closeErr
+}
+
+func openFileWithScp(uri url.URL) (*scpFile, error) {
+	breaker := getSftpBreaker(uri.Host)
+	if breaker == nil {
+		return dialScpFile(uri)
+	}
+	if err := breaker.allow(); err != nil {
+		return nil, err
+	}
+	file, err := dialScpFile(uri)
+	breaker.done(err)
+	return file, err
+}
+
+func dialScpFile(uri url.URL) (*scpFile, error) {
+	done := make(chan struct{})
+	sshClient, err := dialSSH(uri, done)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		close(done)
+		sshClient.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err == nil {
+		err = session.Start("cat " + shellQuote(uri.Path))
+	}
+	if err != nil {
+		close(done)
+		session.Close()
+		sshClient.Close()
+		return nil, err
+	}
+	return &scpFile{stdout: stdout, session: session, sshClient: sshClient, done: done}, nil
+}
+
+// shellQuote quotes a string to be used as a single argument of a shell command
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func getFileWithScp(uri url.URL) (io.Reader, error) {
+	file, err := openFileWithScp(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var buffer bytes.Buffer
+	if _, err = buffer.ReadFrom(file); err != nil {
+		return nil, err
+	}
+	return &buffer, nil
+}
+
+func getFileWithSftp(uri url.URL) (io.Reader, error) {
+	file, err := openSftp(uri)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 	var buffer bytes.Buffer
-	if _, err = file.WriteTo(&buffer); err != nil {
+	// io.Copy uses the concurrent reads of WriteTo
+	if _, err = io.Copy(&buffer, file); err != nil {
 		return nil, err
 	}
 	return &buffer, nil
@@ -137,61 +1492,232 @@ type LoadDataOptions struct {
 	skipFirstLine bool
 	delimiter     rune
 	nbFields      int
+	// transform is applied to every line before it is given to the LineConsumer, nil means identity
+	transform func([]string) []string
+	// trimTrailingEmptyField removes one empty last field from every line before checking nbFields
+	trimTrailingEmptyField bool
+	// sanitizeUTF8 replaces the invalid UTF-8 bytes of every field by utf8.RuneError
+	sanitizeUTF8 bool
+	// detectDelimiter replaces delimiter by the delimiterCandidates most frequent in the first data line,
+	// delimiter is kept if none of them is more frequent than the others
+	detectDelimiter bool
+	// maxBadRecords is the number of lines that can't be read or consumed skipped before failing,
+	// the loading fails at the first one if it is 0 and never fails because of them if it is negative
+	maxBadRecords int
 }
 
-func LoadData(file io.Reader, lineConsumer LineConsumer) error {
+// Strategies deduplicating the equipments present in several files of a loading
+const (
+	// NewestEquipmentWins keeps the equipment with the most recent update, the first file's on a tie
+	NewestEquipmentWins = "newest"
+	// FirstSourceWins keeps the equipment of the first file in the order of the uris
+	FirstSourceWins = "priority"
+)
 
-	return LoadDataWithOptions(file, lineConsumer, LoadDataOptions{
-		delimiter:     ';',
-		nbFields:      8,
-		skipFirstLine: false,
-	})
+// Policies for the CSV records that can't be read or consumed
+const (
+	// FailOnBadRecord fails the loading at the first bad record
+	FailOnBadRecord = "fail"
+	// SkipBadRecords skips all the bad records
+	SkipBadRecords = "skip"
+	// SkipBadRecordsUpTo skips the bad records up to RefreshOptions.MaxBadRecords, the loading fails after
+	SkipBadRecordsUpTo = "skip-up-to"
+)
+
+// delimiterCandidates are the delimiters among which the delimiter of the CSV files is detected
+var delimiterCandidates = []rune{';', ',', '\t', '|'}
+
+// delimiterSample is the number of bytes read to find the first data line when detecting the delimiter
+const delimiterSample = 64 * 1024
+
+// detectDelimiter returns the candidate found the most in the first data line of sample, the second line if
+// skipFirstLine is true. ok is false and fallback is returned if none of the candidates is the most frequent.
+func detectDelimiter(sample []byte, skipFirstLine bool, fallback rune) (delimiter rune, ok bool) {
+	lines := bytes.SplitN(sample, []byte("\n"), 3)
+	line := lines[0]
+	if skipFirstLine {
+		if len(lines) < 2 {
+			return fallback, false
+		}
+		line = lines[1]
+	}
+	best, bestCount, tied := fallback, 0, false
+	for _, candidate := range delimiterCandidates {
+		count := bytes.Count(line, []byte(string(candidate)))
+		if count > bestCount {
+			best, bestCount, tied = candidate, count, false
+		} else if count > 0 && count == bestCount {
+			tied = true
+		}
+	}
+	if bestCount == 0 || tied {
+		return fallback, false
+	}
+	return best, true
+}
+
+// defaultLoadDataOptions are the options used by LoadData
+var defaultLoadDataOptions = LoadDataOptions{
+	delimiter:     ';',
+	nbFields:      8,
+	skipFirstLine: false,
 }
 
-func LoadDataWithOptions(file io.Reader, lineConsumer LineConsumer, options LoadDataOptions) error {
+// LoadStats counts the lines handled by LoadDataWithOptions
+type LoadStats struct {
+	// Read is the number of lines read from the file, including the skipped and errored ones
+	Read int
+	// Consumed is the number of lines given to the LineConsumer successfully
+	Consumed int
+	// Skipped is the number of lines ignored, like the header
+	Skipped int
+	// Errored is the number of lines that couldn't be read or consumed
+	Errored int
+	// Sanitized is the number of fields whose invalid UTF-8 bytes were replaced
+	Sanitized int
+}
+
+// sanitizeUTF8 replaces in place the invalid UTF-8 bytes of the fields by utf8.RuneError,
+// it returns the number of fields modified
+func sanitizeUTF8(line []string) int {
+	sanitized := 0
+	for i, field := range line {
+		if !utf8.ValidString(field) {
+			line[i] = strings.ToValidUTF8(field, string(utf8.RuneError))
+			sanitized++
+		}
+	}
+	return sanitized
+}
+
+func LoadData(file io.Reader, lineConsumer LineConsumer) error {
+	_, err := LoadDataWithOptions(file, lineConsumer, defaultLoadDataOptions)
+	return err
+}
 
+// LoadDataWithOptions gives each line of the file to the LineConsumer, it stops at the first error.
+// The stats of the lines handled are returned even if there is an error.
+func LoadDataWithOptions(file io.Reader, lineConsumer LineConsumer, options LoadDataOptions) (LoadStats, error) {
+	var stats LoadStats
 	location, err := time.LoadLocation("Europe/Paris")
 	if err != nil {
-		return err
+		return stats, err
 	}
 
+	if options.detectDelimiter {
+		buffered := bufio.NewReaderSize(file, delimiterSample)
+		// a short file is entirely peeked with an EOF error
+		sample, _ := buffered.Peek(delimiterSample)
+		if delimiter, ok := detectDelimiter(sample, options.skipFirstLine, options.delimiter); ok {
+			logrus.Infof("CSV delimiter detected: %q", delimiter)
+			options.delimiter = delimiter
+		} else {
+			logrus.Warnf("Ambiguous CSV delimiter, using %q", options.delimiter)
+		}
+		file = buffered
+	}
 	reader := csv.NewReader(file)
 	reader.Comma = options.delimiter
 	reader.FieldsPerRecord = options.nbFields
+	nbFields := options.nbFields
+	if options.trimTrailingEmptyField {
+		// the number of fields is checked once the trailing field is removed
+		reader.FieldsPerRecord = -1
+	}
+
+	// badRecord counts a line that can't be read or consumed, the loading must stop if it returns an error
+	badRecord := func(lineNumber int, err error) error {
+		stats.Errored++
+		if options.maxBadRecords == 0 {
+			return err
+		}
+		if options.maxBadRecords > 0 && stats.Errored > options.maxBadRecords {
+			return fmt.Errorf("more than %d bad records, line %d: %s", options.maxBadRecords, lineNumber, err)
+		}
+		logrus.Warnf("Bad record skipped at line %d: %s", lineNumber, err)
+		return nil
+	}
 
 	// Loop through lines & turn into object
-	for {
+	for lineNumber := 1; ; lineNumber++ {
 		line, err := reader.Read()
 		if err == io.EOF {
 			break
-		} else if err != nil {
-			return err
+		}
+		stats.Read++
+		if err != nil {
+			if err := badRecord(lineNumber, err); err != nil {
+				return stats, err
+			}
+			continue
+		}
+
+		if options.trimTrailingEmptyField {
+			if n := len(line); n > 0 && line[n-1] == "" {
+				line = line[:n-1]
+			}
+			if nbFields == 0 {
+				nbFields = len(line)
+			}
+			if nbFields > 0 && len(line) != nbFields {
+				if err := badRecord(lineNumber, fmt.Errorf("line %d: wrong number of fields, expected %d, got %d",
+					lineNumber, nbFields, len(line))); err != nil {
+					return stats, err
+				}
+				continue
+			}
 		}
 
 		if options.skipFirstLine {
 			options.skipFirstLine = false
+			stats.Skipped++
+			continue
+		}
+
+		if options.sanitizeUTF8 {
+			stats.Sanitized += sanitizeUTF8(line)
+		}
+
+		if options.transform != nil {
+			line = options.transform(line)
+		}
+
+		if len(line) < lineConsumer.ExpectedFields() {
+			if err := badRecord(lineNumber, fmt.Errorf("line %d: expected at least %d fields, got %d",
+				lineNumber, lineConsumer.ExpectedFields(), len(line))); err != nil {
+				return stats, err
+			}
 			continue
 		}
 
 		if err := lineConsumer.Consume(line, location); err != nil {
-			return err
+			if err := badRecord(lineNumber, err); err != nil {
+				return stats, err
+			}
+			continue
 		}
+		stats.Consumed++
 	}
 
 	lineConsumer.Terminate()
-	return nil
+	return stats, nil
 }
 
-// CalculateDate adds date and hour parts
+// CalculateDate adds date and hour parts, an hour of 24 or more is on the next days of the service day
+// (25:10:00 is 01:10:00 the next day)
 func CalculateDate(info Info, location *time.Location) (time.Time, error) {
-	date, err := time.ParseInLocation("2006-01-02", info.Date, location)
+	return calculateDate(info, location, DefaultDateLayouts)
+}
+
+func calculateDate(info Info, location *time.Location, layouts DateLayouts) (time.Time, error) {
+	date, err := parseTime(layouts.Date, info.Date, location)
 	if err != nil {
-		return time.Now(), err
+		return time.Time{}, err
 	}
 
-	hour, err := time.ParseInLocation("15:04:05", info.Hour, location)
+	hour, err := parseTime(layouts.Time, info.Hour, location)
 	if err != nil {
-		return time.Now(), err
+		return time.Time{}, err
 	}
 
 	// Add time part to end date
@@ -200,120 +1726,709 @@ func CalculateDate(info Info, location *time.Location) (time.Time, error) {
 	return date, nil
 }
 
-func LoadXmlData(file io.Reader) ([]EquipmentDetail, error) {
+// Temporary structure used only to read departures from a JSON array, datetime is either RFC3339
+// or in the layout of the CSV extracts in local time
+type jsonDeparture struct {
+	Stop          string `json:"stop"`
+	Line          string `json:"line"`
+	Type          string `json:"type"`
+	Datetime      string `json:"datetime"`
+	Direction     string `json:"direction"`
+	DirectionName string `json:"direction_name"`
+}
 
+// LoadJSONData reads departures from a JSON array
+func LoadJSONData(file io.Reader) (map[string][]Departure, error) {
+	return loadJSONData(file, makeDepartureLineConsumer())
+}
+
+// loadJSONData reads the departures with consumer, which gives the layout of their datetime and filters them
+func loadJSONData(file io.Reader, consumer *DepartureLineConsumer) (map[string][]Departure, error) {
 	location, err := time.LoadLocation("Europe/Paris")
 	if err != nil {
 		return nil, err
 	}
 
-	XMLdata, err := ioutil.ReadAll(file)
-	if err != nil {
+	var records []jsonDeparture
+	if err = json.NewDecoder(file).Decode(&records); err != nil {
 		return nil, err
 	}
-	decoder := xml.NewDecoder(bytes.NewReader(XMLdata))
+
+	for i, record := range records {
+		if record.Stop == "" || record.Line == "" {
+			return nil, fmt.Errorf("departure %d: missing stop or line", i)
+		}
+		dt, err := parseTime(time.RFC3339, record.Datetime, time.UTC)
+		if err != nil {
+			dt, err = parseTime(consumer.layouts.DateTime(), record.Datetime, location)
+			if err != nil {
+				return nil, fmt.Errorf("departure %d: %s", i, err)
+			}
+		}
+		departure := Departure{
+			Stop:          record.Stop,
+			Line:          record.Line,
+			Type:          record.Type,
+			Datetime:      dt.In(location),
+			Direction:     record.Direction,
+			DirectionName: record.DirectionName,
+		}
+		consumer.add(departure)
+	}
+
+	consumer.Terminate()
+	return consumer.data, nil
+}
+
+func LoadXmlData(file io.Reader) ([]EquipmentDetail, error) {
+	equipments, _, err := loadXmlData(file, time.Now(), DefaultDateLayouts, nil, nil, 1)
+	return equipments, err
+}
+
+// loadXmlData reads the equipments, their status is computed at now. An equipment missing one of the
+// required attributes fails the loading, DefaultEquipmentRequiredFields are used if required is nil.
+// The raw statuses are mapped by statuses if it is set.
+// The number of equipments missing optional attributes is returned. The equipments are built by
+// workers goroutines, in the order of the document.
+func loadXmlData(file io.Reader, now time.Time, layouts DateLayouts,
+	required EquipmentFields, statuses EquipmentStatuses, workers int) ([]EquipmentDetail, int, error) {
+	layouts = layouts.withDefaults()
+	if required == nil {
+		required = DefaultEquipmentRequiredFields
+	}
+
+	location, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	decoder := xml.NewDecoder(file)
 	decoder.CharsetReader = getCharsetReader
 
+	// Skip everything preceding the root element (BOM, xml declaration, comments, processing instructions...)
 	var root Root
-	err = decoder.Decode(&root)
-	if err != nil {
-		return nil, err
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, 0, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			if err = decoder.DecodeElement(&root, &start); err != nil {
+				return nil, 0, err
+			}
+			break
+		}
 	}
 
-	equipments := make(map[string]EquipmentDetail)
 	//Calculate updated_at from Info.Date and Info.Hour
-	updatedAt, err := CalculateDate(root.Info, location)
+	updatedAt, err := calculateDate(root.Info, location, layouts)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	// for each root.Data.Lines.Stations create an object Equipment
+	var sources []EquipementSource
 	for _, l := range root.Data.Lines {
 		for _, s := range l.Stations {
-			for _, e := range s.Equipments {
-				ed, err := NewEquipmentDetail(e, updatedAt, location)
-				if err != nil {
-					return nil, err
-				}
-				equipments[ed.ID] = *ed
+			sources = append(sources, s.Equipments...)
+		}
+	}
+
+	// the equipments are built by the workers, each of them taking one equipment every workers
+	type built struct {
+		detail     *EquipmentDetail
+		incomplete bool
+		err        error
+	}
+	results := make([]built, len(sources))
+	build := func(first, step int) {
+		for i := first; i < len(sources); i += step {
+			r := &results[i]
+			if r.incomplete, r.err = sources[i].checkFields(required); r.err == nil {
+				r.detail, r.err = newEquipmentDetail(sources[i], updatedAt, location, now, layouts, statuses)
 			}
 		}
 	}
+	if workers <= 1 {
+		build(0, 1)
+	} else {
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(first int) {
+				defer wg.Done()
+				build(first, workers)
+			}(w)
+		}
+		wg.Wait()
+	}
 
-	// Transform the map to array of EquipmentDetail
+	// the results are read in the order of the document so that the error returned and the equipment
+	// kept for a duplicated ID (the last one) don't depend on the workers
+	incomplete := 0
+	indexes := make(map[string]int)
 	equipmentDetails := make([]EquipmentDetail, 0)
-	for _, ed := range equipments {
-		equipmentDetails = append(equipmentDetails, ed)
+	for _, r := range results {
+		if r.err != nil {
+			return nil, 0, r.err
+		}
+		if r.incomplete {
+			incomplete++
+		}
+		if i, ok := indexes[r.detail.ID]; ok {
+			equipmentDetails[i] = *r.detail
+		} else {
+			indexes[r.detail.ID] = len(equipmentDetails)
+			equipmentDetails = append(equipmentDetails, *r.detail)
+		}
 	}
 
-	return equipmentDetails, nil
+	return equipmentDetails, incomplete, nil
 }
 
 func RefreshDepartures(manager *DataManager, uri url.URL) error {
+	return RefreshDeparturesWithOptions(manager, uri, RefreshOptions{})
+}
+
+// departuresFormat returns the configured format, if none is configured it is guessed from the extension
+// of the uri, defaulting to CSV
+func departuresFormat(uri url.URL, options RefreshOptions) string {
+	if options.Format != "" {
+		return options.Format
+	}
+	if strings.EqualFold(path.Ext(uncompressedPath(uri)), ".json") {
+		return JSONFormat
+	}
+	return CSVFormat
+}
+
+func RefreshDeparturesWithOptions(manager *DataManager, uri url.URL, options RefreshOptions) (err error) {
+	defer manager.lockRefresh(DeparturesDataType)()
+	defer func() { manager.updateLoadStatus(DeparturesDataType, err) }()
+	ctx, cancel := options.refreshContext()
+	defer func() { departuresMetrics.endRefresh(ctx, cancel, err) }()
 	begin := time.Now()
-	file, err := getFile(uri)
+	var file io.ReadCloser
+	offset, partial, validator := int64(-1), false, ""
+	if options.PartialRefresh && rangeable(uri, options) {
+		file, offset, partial, validator, err = fetchDeparturesRange(ctx, manager, uri, options)
+	} else {
+		file, err = fetchFile(ctx, uri, options)
+	}
+	if err != nil {
+		departuresMetrics.loadError(manager.Network())
+		return err
+	}
+	defer file.Close()
+	fetched := time.Now()
+	departuresMetrics.observeFetch(fetched.Sub(begin))
+
+	size := &byteCounter{reader: file}
+	raw := newRawRecorder()
+	input := raw.tee(size)
+
+	reader, err := getCharsetReader(options.Charset, input)
 	if err != nil {
-		departureLoadingErrors.Inc()
+		departuresMetrics.loadError(manager.Network())
 		return err
 	}
 
-	departureConsumer := makeDepartureLineConsumer()
-	if err = LoadData(file, departureConsumer); err != nil {
-		departureLoadingErrors.Inc()
+	var departures map[string][]Departure
+	departureConsumer := makeDepartureLineConsumerWithLayouts(options.DateLayouts)
+	departureConsumer.filter = options.DeparturesFilter
+	departureConsumer.directionColumn = options.DirectionColumn
+	departureConsumer.lineColumn = options.LineColumn
+	departureConsumer.lineElement = options.LineElement
+	switch departuresFormat(uri, options) {
+	case CSVFormat:
+		var stats LoadStats
+		loadDataOptions := defaultLoadDataOptions
+		loadDataOptions.trimTrailingEmptyField = options.TrimTrailingEmptyField
+		loadDataOptions.detectDelimiter = options.DetectDelimiter
+		loadDataOptions.sanitizeUTF8 = options.SanitizeUTF8
+		loadDataOptions.maxBadRecords = options.maxBadRecords()
+		stats, err = LoadDataWithOptions(reader, departureConsumer, loadDataOptions)
+		departuresMetrics.observeStats(stats)
+		departures = departureConsumer.data
+	case JSONFormat:
+		departures, err = loadJSONData(reader, departureConsumer)
+	case SiriFormat:
+		// the xml declares its own charset
+		departures, err = loadSiriData(input, departureConsumer)
+	default:
+		err = fmt.Errorf("Unsupported departures format %s", options.Format)
+	}
+	if err != nil {
+		departuresMetrics.loadError(manager.Network())
 		return err
 	}
-	manager.UpdateDepartures(departureConsumer.data)
-	departureLoadingDuration.Observe(time.Since(begin).Seconds())
+	if departureConsumer.filtered > 0 {
+		logrus.Debugf("%d departures dropped by the filter", departureConsumer.filtered)
+	}
+	if options.NormalizeStopIDs {
+		departures = normalizeStopIDs(departures)
+	}
+	departuresMetrics.observeParse(time.Since(fetched))
+	logrus.Debugf("Departures fetched in %s and parsed in %s", fetched.Sub(begin), time.Since(fetched))
+	if options.PartialRefresh {
+		manager.setRangeOffset(DeparturesDataType, uri, offset, validator)
+	}
+	if partial {
+		// only the appended lines have been read, they aren't the file
+		logrus.Debugf("%d bytes of departures loaded, up to byte %d", size.count, offset)
+		departures = manager.AppendDepartures(departures)
+		departuresMetrics.observeFileSize(offset)
+	} else {
+		manager.UpdateDepartures(departures)
+		raw.store(manager, DeparturesDataType, uri)
+		departuresMetrics.observeFileSize(size.count)
+	}
+	recordSanity(manager, DeparturesDataType, departuresSanity(departures, manager.Now(), options.MinFutureDeparturesRatio))
+	if options.Publisher != nil {
+		if err := options.Publisher.PublishDepartures(departures); err != nil {
+			logrus.Errorf("Impossible to publish departures: %s", err)
+		}
+	}
+	departuresMetrics.observeLoad(time.Since(begin))
 	return nil
 }
 
+// fetchDeparturesRange fetches the departures file at uri from the end of the part loaded by the previous
+// refresh. Only the complete lines are returned, the last one may still be being written, and offset is the
+// position following them in the file, validator is the one of the file. If uri can't be fetched the fallbacks
+// are fetched entirely and offset is -1.
+func fetchDeparturesRange(ctx context.Context, manager *DataManager, uri url.URL,
+	options RefreshOptions) (file io.ReadCloser, offset int64, partial bool, validator string, err error) {
+	previous, previousValidator := manager.rangeOffset(DeparturesDataType, uri)
+	content, partial, validator, err := fetchFileRange(ctx, uri, options, previous, previousValidator)
+	if err != nil {
+		if len(options.Fallbacks) == 0 {
+			return nil, 0, false, "", err
+		}
+		logrus.Warnf("Impossible to fetch %s: %s, trying fallback %s", redactURI(uri), err, redactURI(options.Fallbacks[0]))
+		fallback := options.Fallbacks[0]
+		options.Fallbacks = options.Fallbacks[1:]
+		file, err = fetchFile(ctx, fallback, options)
+		return file, -1, false, "", err
+	}
+	complete := bytes.LastIndexByte(content, '\n') + 1
+	offset = int64(complete)
+	if partial {
+		offset += previous
+	}
+	return newContextReader(ctx, ioutil.NopCloser(bytes.NewReader(content[:complete]))), offset, partial, validator, nil
+}
+
 func RefreshParkings(manager *DataManager, uri url.URL) error {
+	return RefreshParkingsWithOptions(manager, uri, RefreshOptions{})
+}
+
+func RefreshParkingsWithOptions(manager *DataManager, uri url.URL, options RefreshOptions) (err error) {
+	defer manager.lockRefresh(ParkingsDataType)()
+	defer func() { manager.updateLoadStatus(ParkingsDataType, err) }()
+	ctx, cancel := options.refreshContext()
+	defer func() { parkingsMetrics.endRefresh(ctx, cancel, err) }()
 	begin := time.Now()
-	file, err := getFile(uri)
+	file, err := fetchFile(ctx, uri, options)
+	if err != nil {
+		parkingsMetrics.loadError(manager.Network())
+		return err
+	}
+	defer file.Close()
+	fetched := time.Now()
+	parkingsMetrics.observeFetch(fetched.Sub(begin))
+
+	size := &byteCounter{reader: file}
+	raw := newRawRecorder()
+	input := raw.tee(size)
+
+	reader, err := getCharsetReader(options.Charset, input)
 	if err != nil {
-		parkingsLoadingErrors.Inc()
+		parkingsMetrics.loadError(manager.Network())
 		return err
 	}
 
-	parkingsConsumer := makeParkingLineConsumer()
+	parkingsConsumer := makeParkingLineConsumerWithFields(options.ParkingFields, options.DateLayouts)
 	loadDataOptions := LoadDataOptions{
 		delimiter:     ';',
 		nbFields:      0,    // We might not have etereogenous lines
 		skipFirstLine: true, // First line is a header
+
+		trimTrailingEmptyField: options.TrimTrailingEmptyField,
+		detectDelimiter:        options.DetectDelimiter,
+		sanitizeUTF8:           options.SanitizeUTF8,
 	}
-	err = LoadDataWithOptions(file, parkingsConsumer, loadDataOptions)
+	stats, err := LoadDataWithOptions(reader, parkingsConsumer, loadDataOptions)
+	parkingsMetrics.observeStats(stats)
 	if err != nil {
-		parkingsLoadingErrors.Inc()
+		parkingsMetrics.loadError(manager.Network())
 		return err
 	}
+	parkingsMetrics.observeParse(time.Since(fetched))
+	logrus.Debugf("Parkings fetched in %s and parsed in %s", fetched.Sub(begin), time.Since(fetched))
 
 	manager.UpdateParkings(parkingsConsumer.parkings)
-	parkingsLoadingDuration.Observe(time.Since(begin).Seconds())
+	raw.store(manager, ParkingsDataType, uri)
+	parkingsMetrics.observeFileSize(size.count)
+	parkingsMetrics.observeLoad(time.Since(begin))
+
+	return nil
+}
+
+func RefreshBikeStations(manager *DataManager, uri url.URL) error {
+	return RefreshBikeStationsWithOptions(manager, uri, RefreshOptions{})
+}
+
+func RefreshBikeStationsWithOptions(manager *DataManager, uri url.URL, options RefreshOptions) (err error) {
+	defer manager.lockRefresh(BikeStationsDataType)()
+	defer func() { manager.updateLoadStatus(BikeStationsDataType, err) }()
+	ctx, cancel := options.refreshContext()
+	defer func() { bikeStationsMetrics.endRefresh(ctx, cancel, err) }()
+	begin := time.Now()
+	file, err := fetchFile(ctx, uri, options)
+	if err != nil {
+		bikeStationsMetrics.loadError(manager.Network())
+		return err
+	}
+	defer file.Close()
+	fetched := time.Now()
+	bikeStationsMetrics.observeFetch(fetched.Sub(begin))
+
+	size := &byteCounter{reader: file}
+	raw := newRawRecorder()
+	input := raw.tee(size)
+
+	reader, err := getCharsetReader(options.Charset, input)
+	if err != nil {
+		bikeStationsMetrics.loadError(manager.Network())
+		return err
+	}
+
+	bikeStationsConsumer := makeBikeStationLineConsumerWithLayouts(options.DateLayouts)
+	loadDataOptions := LoadDataOptions{
+		delimiter:     ';',
+		nbFields:      0,
+		skipFirstLine: true, // First line is a header
+
+		trimTrailingEmptyField: options.TrimTrailingEmptyField,
+		detectDelimiter:        options.DetectDelimiter,
+		sanitizeUTF8:           options.SanitizeUTF8,
+	}
+	stats, err := LoadDataWithOptions(reader, bikeStationsConsumer, loadDataOptions)
+	bikeStationsMetrics.observeStats(stats)
+	if err != nil {
+		bikeStationsMetrics.loadError(manager.Network())
+		return err
+	}
+	bikeStationsMetrics.observeParse(time.Since(fetched))
+	logrus.Debugf("Bike stations fetched in %s and parsed in %s", fetched.Sub(begin), time.Since(fetched))
+
+	manager.UpdateBikeStations(bikeStationsConsumer.bikeStations)
+	raw.store(manager, BikeStationsDataType, uri)
+	bikeStationsMetrics.observeFileSize(size.count)
+	bikeStationsMetrics.observeLoad(time.Since(begin))
+
+	return nil
+}
+
+func RefreshStops(manager *DataManager, uri url.URL) error {
+	return RefreshStopsWithOptions(manager, uri, RefreshOptions{})
+}
+
+// RefreshStopsWithOptions loads the stops reference data, a CSV file with a header whose lines are
+// id;name;lat;lon
+func RefreshStopsWithOptions(manager *DataManager, uri url.URL, options RefreshOptions) (err error) {
+	defer manager.lockRefresh(StopsDataType)()
+	defer func() { manager.updateLoadStatus(StopsDataType, err) }()
+	ctx, cancel := options.refreshContext()
+	defer func() { stopsMetrics.endRefresh(ctx, cancel, err) }()
+	begin := time.Now()
+	file, err := fetchFile(ctx, uri, options)
+	if err != nil {
+		stopsMetrics.loadError(manager.Network())
+		return err
+	}
+	defer file.Close()
+	fetched := time.Now()
+	stopsMetrics.observeFetch(fetched.Sub(begin))
+
+	size := &byteCounter{reader: file}
+	raw := newRawRecorder()
+	input := raw.tee(size)
+
+	reader, err := getCharsetReader(options.Charset, input)
+	if err != nil {
+		stopsMetrics.loadError(manager.Network())
+		return err
+	}
+
+	stopsConsumer := makeStopLineConsumer()
+	loadDataOptions := LoadDataOptions{
+		delimiter:     ';',
+		nbFields:      0,
+		skipFirstLine: true, // First line is a header
+
+		trimTrailingEmptyField: options.TrimTrailingEmptyField,
+		detectDelimiter:        options.DetectDelimiter,
+		sanitizeUTF8:           options.SanitizeUTF8,
+	}
+	stats, err := LoadDataWithOptions(reader, stopsConsumer, loadDataOptions)
+	stopsMetrics.observeStats(stats)
+	if err != nil {
+		stopsMetrics.loadError(manager.Network())
+		return err
+	}
+	stopsMetrics.observeParse(time.Since(fetched))
+	logrus.Debugf("Stops fetched in %s and parsed in %s", fetched.Sub(begin), time.Since(fetched))
+
+	stops := stopsConsumer.stops
+	if options.NormalizeStopIDs {
+		stops = make(map[string]Stop, len(stopsConsumer.stops))
+		for id, stop := range stopsConsumer.stops {
+			stops[NormalizeStopID(id)] = stop
+		}
+	}
+	manager.updateStops(stops, options.NormalizeStopIDs)
+	raw.store(manager, StopsDataType, uri)
+	stopsMetrics.observeFileSize(size.count)
+	stopsMetrics.observeLoad(time.Since(begin))
 
 	return nil
 }
 
 func getCharsetReader(charset string, input io.Reader) (io.Reader, error) {
-	if charset == "ISO-8859-1" {
+	switch strings.ToUpper(charset) {
+	case "", "UTF-8", "UTF8":
+		return input, nil
+	case "ISO-8859-1", "LATIN1":
 		return charmap.ISO8859_1.NewDecoder().Reader(input), nil
+	case "WINDOWS-1252", "CP1252":
+		return charmap.Windows1252.NewDecoder().Reader(input), nil
 	}
 
-	return nil, fmt.Errorf("Unknown Charset")
+	return nil, fmt.Errorf("Unknown Charset %s", charset)
 }
 
 func RefreshEquipments(manager *DataManager, uri url.URL) error {
+	return RefreshEquipmentsWithOptions(manager, uri, RefreshOptions{})
+}
+
+func RefreshEquipmentsWithOptions(manager *DataManager, uri url.URL, options RefreshOptions) error {
+	return RefreshEquipmentsFromURIs(manager, []url.URL{uri}, options)
+}
+
+// RefreshEquipmentsFromURIs loads and merges the equipments of several files, an equipment present in
+// several files is deduplicated according to options.EquipmentsDedup. A file that can't be loaded is skipped,
+// the equipments are only left untouched if none of the files can be loaded.
+// The fallbacks of the options are only used when there is a single uri.
+func RefreshEquipmentsFromURIs(manager *DataManager, uris []url.URL, options RefreshOptions) (err error) {
+	defer manager.lockRefresh(EquipmentsDataType)()
+	defer func() { manager.updateLoadStatus(EquipmentsDataType, err) }()
+	ctx, cancel := options.refreshContext()
+	defer func() { equipmentsMetrics.endRefresh(ctx, cancel, err) }()
+	if len(uris) == 0 {
+		equipmentsMetrics.loadError(manager.Network())
+		return fmt.Errorf("No equipments uri provided")
+	}
+	if len(uris) > 1 {
+		options.Fallbacks = nil
+	}
+
 	begin := time.Now()
-	file, err := getFile(uri)
-	if err != nil {
-		equipmentsLoadingErrors.Inc()
+	var equipments []EquipmentDetail
+	indexes := make(map[string]int)
+	var errs []string
+	var size int64
+	var retryAfter *RetryAfterError
+	for _, uri := range uris {
+		loaded, raw, fileSize, err := loadEquipmentsFile(ctx, uri, options, manager.Now())
+		if err != nil {
+			if retry, ok := err.(*RetryAfterError); ok && (retryAfter == nil || retry.Delay > retryAfter.Delay) {
+				retryAfter = retry
+			}
+			equipmentsMetrics.loadError(manager.Network())
+			logrus.Errorf("Impossible to load equipments from %s: %s", redactURI(uri), err)
+			errs = append(errs, fmt.Sprintf("%s: %s", redactURI(uri), err))
+			continue
+		}
+		logrus.Infof("%d equipments loaded from %s", len(loaded), redactURI(uri))
+		raw.store(manager, EquipmentsDataType, uri)
+		size += fileSize
+
+		conflicts := 0
+		for _, equipment := range loaded {
+			i, ok := indexes[equipment.ID]
+			if !ok {
+				indexes[equipment.ID] = len(equipments)
+				equipments = append(equipments, equipment)
+				continue
+			}
+			conflicts++
+			if options.EquipmentsDedup != FirstSourceWins &&
+				equipment.CurrentAvailability.UpdatedAt.After(equipments[i].CurrentAvailability.UpdatedAt) {
+				equipments[i] = equipment
+			}
+		}
+		if conflicts > 0 {
+			equipmentsConflicts.Add(float64(conflicts))
+			logrus.Debugf("%d equipments of %s already loaded from another file", conflicts, redactURI(uri))
+		}
+	}
+	if len(errs) == len(uris) {
+		err = fmt.Errorf("No equipments file could be loaded: %s", strings.Join(errs, ", "))
+		if retryAfter != nil {
+			// the longest delay asked by the sources is honored
+			return &RetryAfterError{Err: err, Delay: retryAfter.Delay}
+		}
 		return err
 	}
+	// the equipments are left untouched rather than updated with the files loaded before the timeout
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if options.MergeEquipments {
+		manager.MergeEquipments(equipments, options.EquipmentsTTL)
+		// the equipments merged are checked
+		equipments, _ = manager.GetEquipments()
+	} else {
+		manager.UpdateEquipments(equipments)
+	}
+	recordSanity(manager, EquipmentsDataType, equipmentsSanity(equipments, options.MaxUnknownEquipmentsRatio))
+	equipmentsMetrics.observeFileSize(size)
+	equipmentsMetrics.observeLoad(time.Since(begin))
+	return nil
+}
+
+// loadEquipmentsFile returns the equipments of the file at uri, its raw content and its size
+func loadEquipmentsFile(ctx context.Context, uri url.URL, options RefreshOptions, now time.Time) ([]EquipmentDetail, *rawRecorder, int64, error) {
+	begin := time.Now()
+	file, err := fetchFile(ctx, uri, options)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer file.Close()
+	fetched := time.Now()
+	equipmentsMetrics.observeFetch(fetched.Sub(begin))
 
-	equipments, err := LoadXmlData(file)
+	size := &byteCounter{reader: file}
+	raw := newRawRecorder()
+	equipments, incomplete, err := loadXmlData(raw.tee(size), now, options.DateLayouts,
+		options.EquipmentRequiredFields, options.EquipmentStatuses, options.EquipmentsParseWorkers)
 	if err != nil {
-		equipmentsLoadingErrors.Inc()
-		return err
+		return nil, nil, 0, err
+	}
+	equipmentsMetrics.observeIncomplete(incomplete)
+	equipmentsMetrics.observeParse(time.Since(fetched))
+	logrus.Debugf("Equipments fetched in %s and parsed in %s", fetched.Sub(begin), time.Since(fetched))
+	return equipments, raw, size.count, nil
+}
+
+// SaveSnapshot writes the data loaded as a snapshot readable by LoadSnapshot and returns its size. The data
+// are encoded without holding the locks of the manager, and the file is replaced atomically so that a
+// reader never sees a partial snapshot.
+func SaveSnapshot(manager *DataManager, path string) (int64, error) {
+	snapshot := manager.Snapshot()
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	var info os.FileInfo
+	if err = json.NewEncoder(file).Encode(snapshot); err == nil {
+		if err = file.Sync(); err == nil {
+			info, err = file.Stat()
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return 0, err
+	}
+	logrus.Infof("Snapshot %s saved: %d bytes", path, info.Size())
+	return info.Size(), nil
+}
+
+// LoadSnapshot loads the data of a snapshot served by /admin/snapshot, to serve it without any source.
+// The data types that weren't loaded when the snapshot was taken stay unloaded.
+func LoadSnapshot(manager *DataManager, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Impossible to open the snapshot %s: %s", path, err)
+	}
+	defer file.Close()
+
+	var snapshot Snapshot
+	if err = json.NewDecoder(file).Decode(&snapshot); err != nil {
+		return fmt.Errorf("Invalid snapshot %s: %s", path, err)
+	}
+	if snapshot.Departures != nil {
+		manager.UpdateDepartures(snapshot.Departures)
+		manager.restoreUpdate(DeparturesDataType, snapshot.UpdatedAt[DeparturesDataType])
 	}
-	manager.UpdateEquipments(equipments)
-	equipmentsLoadingDuration.Observe(time.Since(begin).Seconds())
+	if snapshot.Parkings != nil {
+		manager.UpdateParkings(snapshot.Parkings)
+		manager.restoreUpdate(ParkingsDataType, snapshot.UpdatedAt[ParkingsDataType])
+	}
+	if snapshot.Equipments != nil {
+		manager.UpdateEquipments(snapshot.Equipments)
+		manager.restoreUpdate(EquipmentsDataType, snapshot.UpdatedAt[EquipmentsDataType])
+	}
+	if snapshot.BikeStations != nil {
+		manager.UpdateBikeStations(snapshot.BikeStations)
+		manager.restoreUpdate(BikeStationsDataType, snapshot.UpdatedAt[BikeStationsDataType])
+	}
+	if snapshot.Stops != nil {
+		manager.updateStops(snapshot.Stops, snapshot.StopsNormalized)
+		manager.restoreUpdate(StopsDataType, snapshot.UpdatedAt[StopsDataType])
+	}
+	logrus.Infof("Snapshot %s loaded: %d stops with departures, %d parkings, %d equipments, %d bike stations, %d stops",
+		path, len(snapshot.Departures), len(snapshot.Parkings), len(snapshot.Equipments), len(snapshot.BikeStations),
+		len(snapshot.Stops))
 	return nil
 }
+
+// contextReader fails the reads once its context is done, the file is then closed to interrupt
+// a read blocked on the network
+type contextReader struct {
+	ctx    context.Context
+	file   io.ReadCloser
+	closed chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func newContextReader(ctx context.Context, file io.ReadCloser) *contextReader {
+	r := &contextReader{ctx: ctx, file: file, closed: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Close()
+		case <-r.closed:
+		}
+	}()
+	return r
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.file.Read(p)
+	if err != nil && r.ctx.Err() != nil {
+		// the error comes from the file closed by the cancellation
+		return n, r.ctx.Err()
+	}
+	return n, err
+}
+
+// Close closes the file once, whether it is called by the reader or at the cancellation
+func (r *contextReader) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+		r.err = r.file.Close()
+	})
+	return r.err
+}
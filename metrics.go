@@ -0,0 +1,206 @@
+package sytralrt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultDurationBuckets are the buckets of the durations of the loadings, from 1ms to about 290ms
+var DefaultDurationBuckets = prometheus.ExponentialBuckets(0.001, 1.5, 15)
+
+const (
+	loadDurationsHelp  = "loading latency distributions of each source, fetch and parsing included"
+	fetchDurationsHelp = "file download latency distributions of each source"
+	parseDurationsHelp = "file parsing latency distributions of each source"
+)
+
+var (
+	loadDurations  = newDurationsVec("load_durations_seconds", loadDurationsHelp, DefaultDurationBuckets)
+	fetchDurations = newDurationsVec("fetch_durations_seconds", fetchDurationsHelp, DefaultDurationBuckets)
+	parseDurations = newDurationsVec("parse_durations_seconds", parseDurationsHelp, DefaultDurationBuckets)
+
+	loadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Name:      "load_errors_total",
+		Help:      "number of errors while loading each source",
+	},
+		[]string{"source", "network"},
+	)
+
+	fileSizes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sytralrt",
+		Name:      "last_file_size_bytes",
+		Help:      "size of the file of the last successful loading of each source, once decompressed",
+	},
+		[]string{"source"},
+	)
+
+	loadRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sytralrt",
+		Name:      "last_load_records",
+		Help:      "number of records read, consumed, skipped and errored during the last loading of each source",
+	},
+		[]string{"source", "state"},
+	)
+
+	loadTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Name:      "load_timeouts_total",
+		Help:      "number of loadings of each source cancelled by their timeout",
+	},
+		[]string{"source"},
+	)
+)
+
+func init() {
+	mustRegister(loadDurations)
+	mustRegister(fetchDurations)
+	mustRegister(parseDurations)
+	mustRegister(loadErrors)
+	mustRegister(loadRecords)
+	mustRegister(fileSizes)
+	mustRegister(loadTimeouts)
+}
+
+// newDurationsVec creates a histogram of durations labelled by source
+func newDurationsVec(name, help string, buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sytralrt",
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+	},
+		[]string{"source"},
+	)
+}
+
+// SetDurationBuckets replaces the buckets (upper bounds in seconds) of the load, fetch and parse durations
+// of the sources, for the sources whose loadings take longer than DefaultDurationBuckets. The deprecated
+// metrics of the subsystems keep the default buckets. This must be called before starting to refresh data.
+func SetDurationBuckets(buckets []float64) error {
+	if len(buckets) == 0 {
+		return fmt.Errorf("no duration buckets")
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("duration buckets must be in increasing order, %g is after %g", buckets[i], buckets[i-1])
+		}
+	}
+	for _, durations := range []struct {
+		vec  **prometheus.HistogramVec
+		name string
+		help string
+	}{
+		{&loadDurations, "load_durations_seconds", loadDurationsHelp},
+		{&fetchDurations, "fetch_durations_seconds", fetchDurationsHelp},
+		{&parseDurations, "parse_durations_seconds", parseDurationsHelp},
+	} {
+		prometheus.Unregister(*durations.vec)
+		serviceRegistry.Unregister(*durations.vec)
+		*durations.vec = newDurationsVec(durations.name, durations.help, buckets)
+		mustRegister(*durations.vec)
+	}
+	return nil
+}
+
+// legacyMetrics are the metrics of a data type in its own subsystem, they are still updated
+// until the dashboards use the metrics labelled by source
+type legacyMetrics struct {
+	loadingDuration  prometheus.Histogram
+	fetchingDuration prometheus.Histogram
+	parsingDuration  prometheus.Histogram
+	loadingErrors    prometheus.Counter
+	// loadLines is nil for the data types that don't expose their LoadStats
+	loadLines *prometheus.GaugeVec
+}
+
+// sourceMetrics updates the metrics of the loadings of a data type, a new data type only needs
+// newSourceMetrics to be monitored
+type sourceMetrics struct {
+	source string
+	legacy *legacyMetrics
+}
+
+func newSourceMetrics(source string) *sourceMetrics {
+	return &sourceMetrics{source: source}
+}
+
+func (m *sourceMetrics) observeLoad(duration time.Duration) {
+	loadDurations.WithLabelValues(m.source).Observe(duration.Seconds())
+	if m.legacy != nil {
+		m.legacy.loadingDuration.Observe(duration.Seconds())
+	}
+}
+
+func (m *sourceMetrics) observeFetch(duration time.Duration) {
+	fetchDurations.WithLabelValues(m.source).Observe(duration.Seconds())
+	if m.legacy != nil {
+		m.legacy.fetchingDuration.Observe(duration.Seconds())
+	}
+}
+
+func (m *sourceMetrics) observeParse(duration time.Duration) {
+	parseDurations.WithLabelValues(m.source).Observe(duration.Seconds())
+	if m.legacy != nil {
+		m.legacy.parsingDuration.Observe(duration.Seconds())
+	}
+}
+
+// loadError counts an error of a loading of the network, "" being the main network
+func (m *sourceMetrics) loadError(network string) {
+	loadErrors.WithLabelValues(m.source, network).Inc()
+	if m.legacy != nil {
+		m.legacy.loadingErrors.Inc()
+	}
+}
+
+// endRefresh releases the context of a loading, the loading is logged and counted as timed out if it
+// failed after the deadline of its context
+func (m *sourceMetrics) endRefresh(ctx context.Context, cancel context.CancelFunc, err error) {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		loadTimeouts.WithLabelValues(m.source).Inc()
+		logrus.Errorf("Loading of %s cancelled by its timeout: %s", m.source, err)
+	}
+	cancel()
+}
+
+// observeFileSize exposes the size of the files loaded, the sum of them if there are several
+func (m *sourceMetrics) observeFileSize(bytes int64) {
+	fileSizes.WithLabelValues(m.source).Set(float64(bytes))
+}
+
+// observeIncomplete counts the records loaded with missing optional fields
+func (m *sourceMetrics) observeIncomplete(count int) {
+	if count > 0 {
+		incompleteRecords.WithLabelValues(m.source).Add(float64(count))
+		logrus.Warnf("%d %s records have missing optional fields", count, m.source)
+	}
+}
+
+// observeStats exposes the stats of the last loading and logs them
+func (m *sourceMetrics) observeStats(s LoadStats) {
+	for state, count := range map[string]int{
+		"read":     s.Read,
+		"consumed": s.Consumed,
+		"skipped":  s.Skipped,
+		"errored":  s.Errored,
+	} {
+		loadRecords.WithLabelValues(m.source, state).Set(float64(count))
+		if m.legacy != nil && m.legacy.loadLines != nil {
+			m.legacy.loadLines.WithLabelValues(state).Set(float64(count))
+		}
+	}
+	logrus.Debugf("%s lines: %d read, %d consumed, %d skipped, %d errored",
+		m.source, s.Read, s.Consumed, s.Skipped, s.Errored)
+	if s.Errored > 0 {
+		badRecords.WithLabelValues(m.source).Add(float64(s.Errored))
+	}
+	if s.Sanitized > 0 {
+		sanitizedFields.WithLabelValues(m.source).Add(float64(s.Sanitized))
+		logrus.Warnf("%d %s fields contained invalid UTF-8", s.Sanitized, m.source)
+	}
+}
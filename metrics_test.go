@@ -0,0 +1,115 @@
+package sytralrt
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshMetricsBySource(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	uri, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	var manager DataManager
+	require.Nil(RefreshDepartures(&manager, *uri))
+
+	// the deprecated metrics of the departures subsystem are still updated
+	consumed := testutil.ToFloat64(loadRecords.WithLabelValues(DeparturesDataType, "consumed"))
+	assert.NotZero(consumed)
+	assert.Equal(consumed, testutil.ToFloat64(departureLoadLines.WithLabelValues("consumed")))
+
+	errors := testutil.ToFloat64(loadErrors.WithLabelValues(DeparturesDataType, ""))
+	legacyErrors := testutil.ToFloat64(departureLoadingErrors)
+	uri, err = url.Parse(fmt.Sprintf("file://%s/invaliddate.txt", fixtureDir))
+	require.Nil(err)
+	require.Error(RefreshDepartures(&manager, *uri))
+	assert.Equal(errors+1, testutil.ToFloat64(loadErrors.WithLabelValues(DeparturesDataType, "")))
+	assert.Equal(legacyErrors+1, testutil.ToFloat64(departureLoadingErrors))
+}
+
+func TestSourceMetricsNetwork(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	manager.SetNetwork("metrics_test")
+	uri, err := url.Parse(fmt.Sprintf("file://%s/invaliddate.txt", fixtureDir))
+	require.Nil(err)
+	errors := testutil.ToFloat64(loadErrors.WithLabelValues(DeparturesDataType, ""))
+	require.Error(RefreshDepartures(&manager, *uri))
+	assert.Equal(1.0, testutil.ToFloat64(loadErrors.WithLabelValues(DeparturesDataType, "metrics_test")))
+	assert.Equal(errors, testutil.ToFloat64(loadErrors.WithLabelValues(DeparturesDataType, "")))
+
+	uri, err = url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshDepartures(&manager, *uri))
+	successTimestamp := testutil.ToFloat64(lastSuccessTimestamp.WithLabelValues(DeparturesDataType, "metrics_test"))
+	assert.InDelta(float64(time.Now().Unix()), successTimestamp, 1)
+	UpdateDataAgeMetrics(&manager)
+	assert.Equal(float64(manager.DeparturesCount()),
+		testutil.ToFloat64(dataRecords.WithLabelValues(DeparturesDataType, "metrics_test")))
+}
+
+func TestSourceMetricsWithoutLegacy(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := newSourceMetrics("metrics_test")
+	metrics.loadError("")
+	metrics.observeStats(LoadStats{Read: 3, Consumed: 2, Skipped: 1})
+	assert.Equal(1.0, testutil.ToFloat64(loadErrors.WithLabelValues("metrics_test", "")))
+	assert.Equal(2.0, testutil.ToFloat64(loadRecords.WithLabelValues("metrics_test", "consumed")))
+	assert.Equal(0.0, testutil.ToFloat64(loadRecords.WithLabelValues("metrics_test", "errored")))
+}
+
+func TestRefreshFileSizeMetric(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	uri, err := url.Parse(fmt.Sprintf("file://%s/oneline.txt.gz", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshDepartures(&manager, *uri))
+	assert.Equal(float64(len(oneline)), testutil.ToFloat64(fileSizes.WithLabelValues(DeparturesDataType)))
+
+	uri, err = url.Parse(fmt.Sprintf("file://%s/parkings.txt", fixtureDir))
+	require.Nil(err)
+	require.Nil(RefreshParkings(&manager, *uri))
+	info, err := os.Stat(uri.Path)
+	require.Nil(err)
+	assert.Equal(float64(info.Size()), testutil.ToFloat64(fileSizes.WithLabelValues(ParkingsDataType)))
+}
+
+func TestSetDurationBuckets(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	assert.Error(SetDurationBuckets(nil))
+	assert.Error(SetDurationBuckets([]float64{1, 5, 5}))
+
+	defer SetDurationBuckets(DefaultDurationBuckets)
+	require.Nil(SetDurationBuckets([]float64{1, 5, 30}))
+	uri, err := url.Parse(fmt.Sprintf("file://%s/oneline.txt", fixtureDir))
+	require.Nil(err)
+	var manager DataManager
+	require.Nil(RefreshDepartures(&manager, *uri))
+
+	families, err := serviceRegistry.Gather()
+	require.Nil(err)
+	var buckets []float64
+	for _, family := range families {
+		if family.GetName() == "sytralrt_load_durations_seconds" {
+			for _, bucket := range family.GetMetric()[0].GetHistogram().GetBucket() {
+				buckets = append(buckets, bucket.GetUpperBound())
+			}
+		}
+	}
+	assert.Equal([]float64{1, 5, 30}, buckets)
+}
@@ -0,0 +1,167 @@
+package sytralrt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	departuresPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Subsystem: "departures",
+		Name:      "published_total",
+		Help:      "number of departures datasets published downstream",
+	})
+
+	departuresPublishingErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Subsystem: "departures",
+		Name:      "publishing_errors_total",
+		Help:      "number of departures datasets that couldn't be published downstream",
+	})
+
+	departuresPublishingDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Subsystem: "departures",
+		Name:      "publishing_dropped_total",
+		Help:      "number of departures datasets dropped because the previous one was still being published",
+	})
+)
+
+func init() {
+	mustRegister(departuresPublished)
+	mustRegister(departuresPublishingErrors)
+	mustRegister(departuresPublishingDropped)
+}
+
+// Publisher sends the departures of a successful refresh to a downstream system
+type Publisher interface {
+	PublishDepartures(departures map[string][]Departure) error
+}
+
+// AsyncPublisher publishes in the background so that a slow or unavailable downstream system
+// doesn't delay the refreshes. A dataset is dropped if the previous one is still being published.
+type AsyncPublisher struct {
+	publisher Publisher
+	datasets  chan map[string][]Departure
+}
+
+// NewAsyncPublisher starts publishing with publisher the datasets given to the returned AsyncPublisher
+func NewAsyncPublisher(publisher Publisher) *AsyncPublisher {
+	p := &AsyncPublisher{
+		publisher: publisher,
+		datasets:  make(chan map[string][]Departure, 1),
+	}
+	go p.run()
+	return p
+}
+
+func (p *AsyncPublisher) run() {
+	for departures := range p.datasets {
+		if err := p.publisher.PublishDepartures(departures); err != nil {
+			departuresPublishingErrors.Inc()
+			logrus.Errorf("Impossible to publish departures: %s", err)
+			continue
+		}
+		departuresPublished.Inc()
+	}
+}
+
+// PublishDepartures queues departures to be published, it never blocks
+func (p *AsyncPublisher) PublishDepartures(departures map[string][]Departure) error {
+	select {
+	case p.datasets <- departures:
+	default:
+		departuresPublishingDropped.Inc()
+		logrus.Warn("Departures are still being published, the new dataset is dropped")
+	}
+	return nil
+}
+
+// KafkaRESTPublisher publishes each departure as a message keyed by its stop to a Kafka topic,
+// through a Kafka REST proxy (v2 API)
+type KafkaRESTPublisher struct {
+	endpoint url.URL
+	topic    string
+	// batchSize is the maximum number of messages sent by request
+	batchSize int
+	client    *http.Client
+}
+
+// NewKafkaRESTPublisher creates a publisher posting to the REST proxy at endpoint,
+// messages are sent by batches of batchSize (500 if 0)
+func NewKafkaRESTPublisher(endpoint url.URL, topic string, batchSize int, timeout time.Duration) *KafkaRESTPublisher {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	return &KafkaRESTPublisher{
+		endpoint:  endpoint,
+		topic:     topic,
+		batchSize: batchSize,
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+type kafkaRecord struct {
+	Key   string    `json:"key"`
+	Value Departure `json:"value"`
+}
+
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+func (k *KafkaRESTPublisher) PublishDepartures(departures map[string][]Departure) error {
+	stops := make([]string, 0, len(departures))
+	for stop := range departures {
+		stops = append(stops, stop)
+	}
+	sort.Strings(stops)
+
+	records := make([]kafkaRecord, 0, k.batchSize)
+	for _, stop := range stops {
+		for _, departure := range departures[stop] {
+			records = append(records, kafkaRecord{Key: stop, Value: departure})
+			if len(records) == k.batchSize {
+				if err := k.send(records); err != nil {
+					return err
+				}
+				records = records[:0]
+			}
+		}
+	}
+	if len(records) > 0 {
+		return k.send(records)
+	}
+	return nil
+}
+
+func (k *KafkaRESTPublisher) send(records []kafkaRecord) error {
+	body, err := json.Marshal(kafkaRecords{Records: records})
+	if err != nil {
+		return err
+	}
+	uri := k.endpoint
+	uri.Path = path.Join(uri.Path, "topics", k.topic)
+	resp, err := k.client.Post(uri.String(), "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Kafka REST proxy answered %s: %s", resp.Status, message)
+	}
+	return nil
+}
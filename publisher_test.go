@@ -0,0 +1,135 @@
+package sytralrt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordPublisher keeps the datasets it is given
+type recordPublisher struct {
+	datasets []map[string][]Departure
+}
+
+func (r *recordPublisher) PublishDepartures(departures map[string][]Departure) error {
+	r.datasets = append(r.datasets, departures)
+	return nil
+}
+
+// blockingPublisher blocks until it is released
+type blockingPublisher struct {
+	published chan map[string][]Departure
+	release   chan struct{}
+}
+
+func (b *blockingPublisher) PublishDepartures(departures map[string][]Departure) error {
+	<-b.release
+	b.published <- departures
+	return nil
+}
+
+func TestRefreshDeparturesPublishes(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	uri, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+
+	var manager DataManager
+	var publisher recordPublisher
+	err = RefreshDeparturesWithOptions(&manager, *uri, RefreshOptions{Publisher: &publisher})
+	require.Nil(err)
+	require.Len(publisher.datasets, 1)
+	departures, err := manager.GetDeparturesByStop("1")
+	require.Nil(err)
+	assert.Equal(departures, publisher.datasets[0]["1"])
+
+	// nothing is published if the refresh fails
+	uri, err = url.Parse(fmt.Sprintf("file://%s/invaliddate.txt", fixtureDir))
+	require.Nil(err)
+	err = RefreshDeparturesWithOptions(&manager, *uri, RefreshOptions{Publisher: &publisher})
+	require.Error(err)
+	assert.Len(publisher.datasets, 1)
+}
+
+func TestAsyncPublisherDoesNotBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	blocking := &blockingPublisher{
+		published: make(chan map[string][]Departure, 3),
+		release:   make(chan struct{}),
+	}
+	publisher := NewAsyncPublisher(blocking)
+
+	first := map[string][]Departure{"1": nil}
+	second := map[string][]Departure{"2": nil}
+	third := map[string][]Departure{"3": nil}
+	assert.Nil(publisher.PublishDepartures(first))
+	// wait for the first dataset to be picked up
+	for len(publisher.datasets) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(publisher.PublishDepartures(second))
+	// the third one is dropped while the first one is published and the second one is queued
+	assert.Nil(publisher.PublishDepartures(third))
+
+	close(blocking.release)
+	assert.Equal(first, <-blocking.published)
+	assert.Equal(second, <-blocking.published)
+	select {
+	case departures := <-blocking.published:
+		t.Errorf("unexpected dataset published: %v", departures)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestKafkaRESTPublisher(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var requests []kafkaRecords
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/kafka/topics/departures", r.URL.Path)
+		assert.Equal("application/vnd.kafka.json.v2+json", r.Header.Get("Content-Type"))
+		var records kafkaRecords
+		assert.Nil(json.NewDecoder(r.Body).Decode(&records))
+		requests = append(requests, records)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	endpoint, err := url.Parse(server.URL + "/kafka")
+	require.Nil(err)
+	publisher := NewKafkaRESTPublisher(*endpoint, "departures", 2, time.Second)
+
+	datetime := time.Date(2018, 9, 17, 20, 28, 0, 0, time.UTC)
+	departures := map[string][]Departure{
+		"1": {{Stop: "1", Line: "87A", Datetime: datetime}, {Stop: "1", Line: "C3", Datetime: datetime}},
+		"2": {{Stop: "2", Line: "T1", Datetime: datetime}},
+	}
+	err = publisher.PublishDepartures(departures)
+	require.Nil(err)
+
+	// one message by departure, by batches of 2
+	require.Len(requests, 2)
+	require.Len(requests[0].Records, 2)
+	assert.Equal("1", requests[0].Records[0].Key)
+	assert.Equal("87A", requests[0].Records[0].Value.Line)
+	assert.Equal(datetime, requests[0].Records[0].Value.Datetime)
+	assert.Equal("C3", requests[0].Records[1].Value.Line)
+	require.Len(requests[1].Records, 1)
+	assert.Equal("2", requests[1].Records[0].Key)
+	assert.Equal("T1", requests[1].Records[0].Value.Line)
+
+	status = http.StatusNotFound
+	err = publisher.PublishDepartures(departures)
+	assert.Error(err)
+}
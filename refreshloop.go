@@ -0,0 +1,46 @@
+package sytralrt
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	refreshLoopHeartbeat = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sytralrt",
+		Name:      "refresh_loop_heartbeat_timestamp_seconds",
+		Help:      "time of the last iteration of the refresh loop of each data type, it stays still if the loop died",
+	},
+		[]string{"loop"},
+	)
+
+	refreshLoopPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sytralrt",
+		Name:      "refresh_loop_panics_total",
+		Help:      "number of panics recovered in the refresh loop of each data type",
+	},
+		[]string{"loop"},
+	)
+)
+
+func init() {
+	mustRegister(refreshLoopHeartbeat)
+	mustRegister(refreshLoopPanics)
+}
+
+// SafeRefresh runs an iteration of the refresh loop of a data type and updates its heartbeat. A panic is
+// logged with its stack, counted and returned as an error, so that the loop carries on with the next iteration.
+func SafeRefresh(loop string, refresh func() error) (err error) {
+	refreshLoopHeartbeat.WithLabelValues(loop).SetToCurrentTime()
+	defer func() {
+		if r := recover(); r != nil {
+			refreshLoopPanics.WithLabelValues(loop).Inc()
+			logrus.Errorf("Panic in the %s refresh loop: %v\n%s", loop, r, debug.Stack())
+			err = fmt.Errorf("panic while refreshing %s: %v", loop, r)
+		}
+	}()
+	return refresh()
+}
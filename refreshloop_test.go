@@ -0,0 +1,36 @@
+package sytralrt
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafeRefresh(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	begin := time.Now().Unix()
+	assert.Nil(SafeRefresh("refreshloop_test", func() error { return nil }))
+	assert.True(testutil.ToFloat64(refreshLoopHeartbeat.WithLabelValues("refreshloop_test")) >= float64(begin))
+
+	err := SafeRefresh("refreshloop_test", func() error { return fmt.Errorf("timeout") })
+	require.Error(err)
+	assert.Equal("timeout", err.Error())
+	assert.Equal(0.0, testutil.ToFloat64(refreshLoopPanics.WithLabelValues("refreshloop_test")))
+
+	// the panic is turned into an error, the next iteration runs as usual
+	err = SafeRefresh("refreshloop_test", func() error {
+		var departures map[string][]Departure
+		departures["1"] = nil
+		return nil
+	})
+	require.Error(err)
+	assert.Contains(err.Error(), "panic while refreshing refreshloop_test")
+	assert.Equal(1.0, testutil.ToFloat64(refreshLoopPanics.WithLabelValues("refreshloop_test")))
+	assert.Nil(SafeRefresh("refreshloop_test", func() error { return nil }))
+}
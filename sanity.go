@@ -0,0 +1,80 @@
+package sytralrt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// The sanity checks catch the files that are loaded without error but whose content is obviously broken,
+// like extracts with only past departures. The data are still served but flagged, and the service isn't ready.
+
+var dataInsane = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "sytralrt",
+	Name:      "data_insane",
+	Help:      "1 if the data last loaded of each data type failed their sanity check, 0 otherwise",
+},
+	[]string{"type"},
+)
+
+func init() {
+	mustRegister(dataInsane)
+}
+
+// departuresSanity checks that at least minFutureRatio of the departures are after now, it returns
+// the problem found or an empty string. There is no check if minFutureRatio isn't positive.
+func departuresSanity(departures map[string][]Departure, now time.Time, minFutureRatio float64) string {
+	if minFutureRatio <= 0 {
+		return ""
+	}
+	total, future := 0, 0
+	for _, stopDepartures := range departures {
+		for _, departure := range stopDepartures {
+			total++
+			if departure.Datetime.After(now) {
+				future++
+			}
+		}
+	}
+	if total == 0 {
+		return "no departures"
+	}
+	if ratio := float64(future) / float64(total); ratio < minFutureRatio {
+		return fmt.Sprintf("%.0f%% of the departures are in the future, at least %.0f%% expected",
+			ratio*100, minFutureRatio*100)
+	}
+	return ""
+}
+
+// equipmentsSanity checks that at most maxUnknownRatio of the equipments have an unknown status, it returns
+// the problem found or an empty string. There is no check if maxUnknownRatio isn't positive.
+func equipmentsSanity(equipments []EquipmentDetail, maxUnknownRatio float64) string {
+	if maxUnknownRatio <= 0 || len(equipments) == 0 {
+		return ""
+	}
+	unknown := 0
+	for _, equipment := range equipments {
+		if equipment.CurrentAvailability.Status == EquipmentUnknown {
+			unknown++
+		}
+	}
+	if ratio := float64(unknown) / float64(len(equipments)); ratio > maxUnknownRatio {
+		return fmt.Sprintf("%.0f%% of the equipments have an unknown status, at most %.0f%% expected",
+			ratio*100, maxUnknownRatio*100)
+	}
+	return ""
+}
+
+// recordSanity records the outcome of the sanity check of the data of a data type just loaded,
+// problem is empty if they passed it
+func recordSanity(manager *DataManager, dataType, problem string) {
+	manager.setSanityError(dataType, problem)
+	if problem == "" {
+		dataInsane.WithLabelValues(dataType).Set(0)
+		return
+	}
+	dataInsane.WithLabelValues(dataType).Set(1)
+	logrus.Warnf("The %s loaded look invalid: %s", dataType, problem)
+}
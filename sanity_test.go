@@ -0,0 +1,65 @@
+package sytralrt
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeparturesSanity(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2018, 9, 17, 20, 0, 0, 0, time.UTC)
+	departures := map[string][]Departure{
+		"1": {{Datetime: now.Add(-time.Minute)}, {Datetime: now.Add(time.Minute)}},
+		"2": {{Datetime: now.Add(-time.Hour)}, {Datetime: now.Add(-time.Minute)}},
+	}
+	assert.Empty(departuresSanity(departures, now, 0))
+	assert.Empty(departuresSanity(departures, now, 0.25))
+	assert.Equal("25% of the departures are in the future, at least 50% expected", departuresSanity(departures, now, 0.5))
+	assert.Equal("no departures", departuresSanity(nil, now, 0.5))
+}
+
+func TestEquipmentsSanity(t *testing.T) {
+	assert := assert.New(t)
+
+	equipments := []EquipmentDetail{
+		{ID: "1", CurrentAvailability: CurrentAvailability{Status: EquipmentUnknown}},
+		{ID: "2", CurrentAvailability: CurrentAvailability{Status: EquipmentAvailable}},
+		{ID: "3", CurrentAvailability: CurrentAvailability{Status: EquipmentAvailable}},
+		{ID: "4", CurrentAvailability: CurrentAvailability{Status: EquipmentUnavailable}},
+	}
+	assert.Empty(equipmentsSanity(equipments, 0))
+	assert.Empty(equipmentsSanity(equipments, 0.25))
+	assert.Equal("25% of the equipments have an unknown status, at most 10% expected", equipmentsSanity(equipments, 0.1))
+	assert.Empty(equipmentsSanity(nil, 0.1))
+}
+
+func TestRefreshDeparturesSanity(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	uri, err := url.Parse(fmt.Sprintf("file://%s/extract_edylic.txt", fixtureDir))
+	require.Nil(err)
+	clock := &fixedClock{time.Date(2018, 9, 17, 0, 0, 0, 0, time.UTC)}
+	var manager DataManager
+	manager.SetClock(clock)
+	options := RefreshOptions{MinFutureDeparturesRatio: 0.5}
+
+	require.Nil(RefreshDeparturesWithOptions(&manager, *uri, options))
+	assert.Empty(manager.GetLoadStatus(DeparturesDataType).SanityError)
+	assert.Equal(0.0, testutil.ToFloat64(dataInsane.WithLabelValues(DeparturesDataType)))
+
+	// the departures are still served once they are all past
+	clock.now = clock.now.AddDate(0, 0, 1)
+	require.Nil(RefreshDeparturesWithOptions(&manager, *uri, options))
+	assert.Equal("0% of the departures are in the future, at least 50% expected",
+		manager.GetLoadStatus(DeparturesDataType).SanityError)
+	assert.Equal(1.0, testutil.ToFloat64(dataInsane.WithLabelValues(DeparturesDataType)))
+	assert.NotZero(manager.DeparturesCount())
+}
@@ -0,0 +1,202 @@
+package sytralrt
+
+import (
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+var sftpSessions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "sytralrt",
+	Subsystem: "sftp",
+	Name:      "sessions_total",
+	Help:      "number of sftp files opened on a new connection or on a reused one",
+},
+	[]string{"connection"},
+)
+
+func init() {
+	mustRegister(sftpSessions)
+}
+
+// sftpPool holds the sftp connections kept open between the fetches, by user and host
+var sftpPool = struct {
+	sync.Mutex
+	idleTimeout time.Duration
+	connections map[string]*sftpConnection
+}{}
+
+// SetSftpReuse keeps the sftp connections open after a fetch to reuse them for the next fetches of the same
+// user and host, instead of paying the ssh handshake at each refresh. A connection is checked before being reused,
+// and replaced if it is broken. It is closed once unused during idleTimeout, which should be longer than the
+// refresh intervals. 0 (the default) disables it. This must be called before starting to refresh data.
+func SetSftpReuse(idleTimeout time.Duration) {
+	sftpPool.Lock()
+	defer sftpPool.Unlock()
+
+	for _, connection := range sftpPool.connections {
+		connection.discard()
+	}
+	sftpPool.idleTimeout = idleTimeout
+	sftpPool.connections = make(map[string]*sftpConnection)
+}
+
+// sftpConnection is a sftp session shared by the files opened on it, it is closed once it is
+// discarded or idle and no file uses it anymore. Its fields are protected by the mutex of sftpPool.
+type sftpConnection struct {
+	key       string
+	client    *sftp.Client
+	sshClient *ssh.Client
+	done      chan struct{}
+	users     int
+	discarded bool
+	broken    bool
+	idle      *time.Timer
+}
+
+func sftpPoolKey(uri url.URL) string {
+	return uri.User.String() + "@" + sftpAddress(uri)
+}
+
+// acquireSftpConnection returns a connection to the host of the uri, reused is true if it was already open.
+// The connection must be released once it isn't used anymore.
+func acquireSftpConnection(uri url.URL) (connection *sftpConnection, reused bool, err error) {
+	key := sftpPoolKey(uri)
+	sftpPool.Lock()
+	connection = sftpPool.connections[key]
+	if connection != nil {
+		connection.users++
+		if connection.idle != nil {
+			connection.idle.Stop()
+		}
+	}
+	sftpPool.Unlock()
+
+	if connection != nil {
+		// a cheap round trip to check that the connection hasn't been dropped while idle
+		if _, err = connection.client.Getwd(); err == nil {
+			return connection, true, nil
+		}
+		logrus.Warnf("sftp connection to %s is broken: %s, reconnecting", sftpAddress(uri), err)
+		connection.release(true)
+	}
+
+	done := make(chan struct{})
+	sshClient, err := dialSSH(uri, done)
+	if err != nil {
+		return nil, false, err
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		close(done)
+		sshClient.Close()
+		return nil, false, err
+	}
+	connection = &sftpConnection{key: key, client: client, sshClient: sshClient, done: done, users: 1}
+
+	sftpPool.Lock()
+	if previous := sftpPool.connections[key]; previous != nil {
+		previous.discard()
+	}
+	sftpPool.connections[key] = connection
+	sftpPool.Unlock()
+	return connection, false, nil
+}
+
+// release gives the connection back once a file opened on it is closed, broken discards it
+// so that it isn't reused
+func (c *sftpConnection) release(broken bool) {
+	sftpPool.Lock()
+	defer sftpPool.Unlock()
+
+	c.users--
+	if broken {
+		c.broken = true
+		c.discard()
+	}
+	if c.users > 0 {
+		return
+	}
+	if c.discarded {
+		c.close()
+		return
+	}
+	c.idle = time.AfterFunc(sftpPool.idleTimeout, func() {
+		sftpPool.Lock()
+		defer sftpPool.Unlock()
+		if c.users == 0 {
+			c.discard()
+			c.close()
+		}
+	})
+}
+
+// discard removes the connection from the pool, it must be called with the mutex of sftpPool held
+func (c *sftpConnection) discard() {
+	if c.discarded {
+		return
+	}
+	c.discarded = true
+	if sftpPool.connections[c.key] == c {
+		delete(sftpPool.connections, c.key)
+	}
+	if c.users == 0 {
+		c.close()
+	}
+}
+
+// close closes the session and the connection, it must be called with the mutex of sftpPool held
+func (c *sftpConnection) close() {
+	if c.done == nil {
+		return
+	}
+	close(c.done)
+	c.done = nil
+	if !c.broken {
+		// the session of a broken connection is already being closed by the sftp client
+		c.client.Close()
+	}
+	c.sshClient.Close()
+}
+
+// openPooledSftpFile opens the file at uri on a connection of the pool, a reused connection failing
+// to open the file is replaced by a new one
+func openPooledSftpFile(uri url.URL) (*sftpFile, error) {
+	connection, reused, err := acquireSftpConnection(uri)
+	if err != nil {
+		return nil, err
+	}
+	file, err := connection.client.Open(uri.Path)
+	if err != nil && reused && !isSftpStatusError(err) {
+		connection.release(true)
+		if connection, reused, err = acquireSftpConnection(uri); err != nil {
+			return nil, err
+		}
+		file, err = connection.client.Open(uri.Path)
+	}
+	if err != nil {
+		connection.release(!isSftpStatusError(err))
+		return nil, err
+	}
+	if reused {
+		sftpSessions.WithLabelValues("reused").Inc()
+	} else {
+		sftpSessions.WithLabelValues("new").Inc()
+	}
+	return &sftpFile{File: file, connection: connection}, nil
+}
+
+// isSftpStatusError tells if err is an error answered by the sftp server, the connection then works
+func isSftpStatusError(err error) bool {
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		return true
+	}
+	_, ok := err.(*sftp.StatusError)
+	return ok
+}
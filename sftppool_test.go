@@ -0,0 +1,74 @@
+package sytralrt
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshOverSftpReused(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	server := startSFTPTestServer(require)
+	defer server.Close()
+	server.copyFixture(require, "oneline.txt")
+	user := url.UserPassword("sytral", "pass")
+	uri := server.uri(user, "oneline.txt")
+
+	SetSftpReuse(time.Minute)
+	defer SetSftpReuse(0)
+	newSessions := func() float64 { return testutil.ToFloat64(sftpSessions.WithLabelValues("new")) }
+	reusedSessions := func() float64 { return testutil.ToFloat64(sftpSessions.WithLabelValues("reused")) }
+	created, reused := newSessions(), reusedSessions()
+
+	var manager DataManager
+	require.Nil(RefreshDepartures(&manager, uri))
+	require.Nil(RefreshDeparturesWithOptions(&manager, uri, RefreshOptions{Streaming: true}))
+	assert.Equal(created+1, newSessions())
+	assert.Equal(reused+1, reusedSessions())
+
+	// a missing file doesn't break the connection
+	require.Error(RefreshDepartures(&manager, server.uri(user, "not.txt")))
+	require.Nil(RefreshDepartures(&manager, uri))
+	assert.Equal(created+1, newSessions())
+	assert.Equal(reused+2, reusedSessions())
+
+	// a broken connection is replaced
+	sftpPool.Lock()
+	sftpPool.connections[sftpPoolKey(uri)].sshClient.Close()
+	sftpPool.Unlock()
+	require.Nil(RefreshDepartures(&manager, uri))
+	assert.Equal(created+2, newSessions())
+	departures, err := manager.GetDeparturesByStop("1")
+	require.Nil(err)
+	assert.Len(departures, 1)
+}
+
+func TestSftpReuseIdleTimeout(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	server := startSFTPTestServer(require)
+	defer server.Close()
+	server.copyFixture(require, "oneline.txt")
+	uri := server.uri(url.UserPassword("sytral", "pass"), "oneline.txt")
+
+	SetSftpReuse(50 * time.Millisecond)
+	defer SetSftpReuse(0)
+
+	var manager DataManager
+	require.Nil(RefreshDepartures(&manager, uri))
+	sftpPool.Lock()
+	assert.Len(sftpPool.connections, 1)
+	sftpPool.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	sftpPool.Lock()
+	assert.Empty(sftpPool.connections)
+	sftpPool.Unlock()
+}
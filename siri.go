@@ -0,0 +1,136 @@
+package sytralrt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Formats of the departures data
+const (
+	CSVFormat  = "csv"
+	JSONFormat = "json"
+	SiriFormat = "siri"
+)
+
+// Temporary structures used only to read SIRI StopMonitoring deliveries:
+type MonitoredStopVisit struct {
+	XMLName                 xml.Name                `xml:"MonitoredStopVisit"`
+	MonitoringRef           string                  `xml:"MonitoringRef"`
+	MonitoredVehicleJourney MonitoredVehicleJourney `xml:"MonitoredVehicleJourney"`
+}
+
+type MonitoredVehicleJourney struct {
+	LineRef         string        `xml:"LineRef"`
+	DirectionRef    string        `xml:"DirectionRef"`
+	DestinationName string        `xml:"DestinationName"`
+	MonitoredCall   MonitoredCall `xml:"MonitoredCall"`
+
+	DatedVehicleJourneyRef string `xml:"FramedVehicleJourneyRef>DatedVehicleJourneyRef"`
+	// Others are the other elements, one of them can hold the line
+	Others []siriElement `xml:",any"`
+}
+
+type siriElement struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// element returns the value of the element of the journey named name, empty if it is absent
+func (j MonitoredVehicleJourney) element(name string) string {
+	if name == "LineRef" {
+		return j.LineRef
+	}
+	for _, other := range j.Others {
+		if other.XMLName.Local == name {
+			return other.Value
+		}
+	}
+	return ""
+}
+
+type MonitoredCall struct {
+	StopPointRef          string `xml:"StopPointRef"`
+	AimedDepartureTime    string `xml:"AimedDepartureTime"`
+	ExpectedDepartureTime string `xml:"ExpectedDepartureTime"`
+}
+
+// NewDepartureFromSiri creates a Departure from a MonitoredStopVisit, the expected departure time is used
+// if available (type "E"), otherwise the aimed one (type "T")
+func NewDepartureFromSiri(visit MonitoredStopVisit, location *time.Location) (Departure, error) {
+	journey := visit.MonitoredVehicleJourney
+	stop := journey.MonitoredCall.StopPointRef
+	if stop == "" {
+		stop = visit.MonitoringRef
+	}
+	if stop == "" || journey.LineRef == "" {
+		return Departure{}, fmt.Errorf("Missing stop or line in MonitoredStopVisit")
+	}
+
+	departureType, datetime := "E", journey.MonitoredCall.ExpectedDepartureTime
+	if datetime == "" {
+		departureType, datetime = "T", journey.MonitoredCall.AimedDepartureTime
+	}
+	dt, err := parseTime(time.RFC3339, datetime, time.UTC)
+	if err != nil {
+		return Departure{}, err
+	}
+
+	return Departure{
+		Stop:          stop,
+		Line:          journey.LineRef,
+		Type:          departureType,
+		Datetime:      dt.In(location),
+		Direction:     journey.DirectionRef,
+		DirectionName: journey.DestinationName,
+		TripID:        journey.DatedVehicleJourneyRef,
+	}, nil
+}
+
+// LoadSiriData reads the departures of a SIRI StopMonitoring delivery, either bare or in a SOAP envelope
+func LoadSiriData(file io.Reader) (map[string][]Departure, error) {
+	return loadSiriData(file, makeDepartureLineConsumer())
+}
+
+// loadSiriData reads the departures with consumer, which filters them and gives the element holding their line
+func loadSiriData(file io.Reader, consumer *DepartureLineConsumer) (map[string][]Departure, error) {
+	location, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := xml.NewDecoder(file)
+	decoder.CharsetReader = getCharsetReader
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "MonitoredStopVisit" {
+			continue
+		}
+		var visit MonitoredStopVisit
+		if err = decoder.DecodeElement(&visit, &start); err != nil {
+			return nil, err
+		}
+		departure, err := NewDepartureFromSiri(visit, location)
+		if err != nil {
+			return nil, err
+		}
+		if consumer.lineElement != "" {
+			if departure.Line = visit.MonitoredVehicleJourney.element(consumer.lineElement); departure.Line == "" {
+				return nil, fmt.Errorf("Missing %s in MonitoredStopVisit", consumer.lineElement)
+			}
+		}
+		consumer.add(departure)
+	}
+
+	consumer.Terminate()
+	return consumer.data, nil
+}
@@ -0,0 +1,143 @@
+package sytralrt
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSiriData(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	uri, err := url.Parse(fmt.Sprintf("file://%s/siri_stop_monitoring.xml", fixtureDir))
+	require.Nil(err)
+	reader, err := getFileWithFS(*uri)
+	require.Nil(err)
+
+	departures, err := LoadSiriData(reader)
+	require.Nil(err)
+	require.Len(departures, 2)
+
+	//departures are sorted
+	require.Len(departures["3"], 2)
+	d := departures["3"][0]
+	assert.Equal("3", d.Stop)
+	assert.Equal("87A", d.Line)
+	assert.Equal("T", d.Type)
+	assert.Equal("35998", d.Direction)
+	assert.Equal("Mions Bourdelle", d.DirectionName)
+	assert.Equal("2018-09-17 20:28:37 +0200 CEST", d.Datetime.String())
+	d = departures["3"][1]
+	assert.Equal("E", d.Type)
+	assert.Equal("2018-09-17 20:38:37 +0200 CEST", d.Datetime.String())
+
+	require.Len(departures["1"], 1)
+	assert.Equal("C13", departures["1"][0].Line)
+}
+
+func TestLoadSiriDataSoap(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	document := `<?xml version="1.0" encoding="UTF-8"?>
+<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/">
+<S:Body><sw:GetStopMonitoringResponse xmlns:sw="http://wsdl.siri.org.uk" xmlns:siri="http://www.siri.org.uk/siri">
+<Answer><siri:StopMonitoringDelivery version="2.0">
+<siri:MonitoredStopVisit>
+<siri:MonitoringRef>5</siri:MonitoringRef>
+<siri:MonitoredVehicleJourney>
+<siri:LineRef>T1</siri:LineRef>
+<siri:DirectionRef>1</siri:DirectionRef>
+<siri:DestinationName>IUT Feyssine</siri:DestinationName>
+<siri:MonitoredCall><siri:ExpectedDepartureTime>2018-09-17T20:42:37+02:00</siri:ExpectedDepartureTime></siri:MonitoredCall>
+</siri:MonitoredVehicleJourney>
+</siri:MonitoredStopVisit>
+</siri:StopMonitoringDelivery></Answer>
+</sw:GetStopMonitoringResponse></S:Body></S:Envelope>`
+
+	departures, err := LoadSiriData(strings.NewReader(document))
+	require.Nil(err)
+	require.Len(departures["5"], 1)
+	d := departures["5"][0]
+	//the stop is given by the MonitoringRef when there is no StopPointRef
+	assert.Equal("5", d.Stop)
+	assert.Equal("T1", d.Line)
+	assert.Equal("IUT Feyssine", d.DirectionName)
+	assert.Equal("E", d.Type)
+}
+
+func TestLoadSiriDataLineElement(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	document := `<Siri><StopMonitoringDelivery>
+<MonitoredStopVisit>
+<MonitoringRef>5</MonitoringRef>
+<MonitoredVehicleJourney>
+<LineRef>SYTRAL:Line::T1:</LineRef>
+<PublishedLineName> t1 </PublishedLineName>
+<FramedVehicleJourneyRef><DataFrameRef>2018-09-17</DataFrameRef><DatedVehicleJourneyRef>T1-A:12</DatedVehicleJourneyRef></FramedVehicleJourneyRef>
+<MonitoredCall><ExpectedDepartureTime>2018-09-17T20:42:37+02:00</ExpectedDepartureTime></MonitoredCall>
+</MonitoredVehicleJourney>
+</MonitoredStopVisit>
+</StopMonitoringDelivery></Siri>`
+
+	consumer := makeDepartureLineConsumer()
+	consumer.lineElement = "PublishedLineName"
+	departures, err := loadSiriData(strings.NewReader(document), consumer)
+	require.Nil(err)
+	require.Len(departures["5"], 1)
+	assert.Equal(" t1 ", departures["5"][0].Line)
+	assert.Equal("T1", departures["5"][0].LineID)
+	assert.Equal("T1-A:12", departures["5"][0].TripID)
+
+	consumer = makeDepartureLineConsumer()
+	consumer.lineElement = "LineName"
+	_, err = loadSiriData(strings.NewReader(document), consumer)
+	assert.Error(err)
+}
+
+func TestNewDepartureFromSiriErrors(t *testing.T) {
+	require := require.New(t)
+
+	location, err := time.LoadLocation("Europe/Paris")
+	require.Nil(err)
+
+	_, err = NewDepartureFromSiri(MonitoredStopVisit{MonitoringRef: "1"}, location)
+	require.Error(err)
+
+	_, err = NewDepartureFromSiri(MonitoredStopVisit{
+		MonitoringRef: "1",
+		MonitoredVehicleJourney: MonitoredVehicleJourney{
+			LineRef:       "C13",
+			MonitoredCall: MonitoredCall{ExpectedDepartureTime: "2018-09-17 20:42:37"},
+		},
+	}, location)
+	require.Error(err)
+}
+
+func TestRefreshDeparturesSiri(t *testing.T) {
+	require := require.New(t)
+
+	uri, err := url.Parse(fmt.Sprintf("file://%s/siri_stop_monitoring.xml", fixtureDir))
+	require.Nil(err)
+
+	var manager DataManager
+	err = RefreshDepartures(&manager, *uri)
+	require.Error(err)
+
+	err = RefreshDeparturesWithOptions(&manager, *uri, RefreshOptions{Format: SiriFormat})
+	require.Nil(err)
+	departures, err := manager.GetDeparturesByStop("3")
+	require.Nil(err)
+	require.Len(departures, 2)
+
+	err = RefreshDeparturesWithOptions(&manager, *uri, RefreshOptions{Format: "gtfs"})
+	require.Error(err)
+}
@@ -0,0 +1,212 @@
+package sytralrt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	osexec "os/exec"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSSHServer starts an ssh server accepting the user sytral with the password pass,
+// the exec requests are run with sh and the sftp subsystem serves the whole filesystem
+func startSSHServer(require *require.Assertions) net.Listener {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.Nil(err)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "sytral" && string(password) == "pass" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("wrong password for %s", c.User())
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	return listener
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				switch req.Type {
+				case "exec":
+					var exec struct{ Command string }
+					if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(true, nil)
+
+					var status uint32
+					cmd := osexec.Command("sh", "-c", exec.Command)
+					cmd.Stdout = channel
+					cmd.Stderr = channel.Stderr()
+					if err := cmd.Run(); err != nil {
+						status = 1
+					}
+					channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+					return
+				case "subsystem":
+					var subsystem struct{ Name string }
+					if err := ssh.Unmarshal(req.Payload, &subsystem); err != nil || subsystem.Name != "sftp" {
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(true, nil)
+
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						return
+					}
+					server.Serve()
+					return
+				default:
+					req.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
+
+// sftpTestServer is an in-process sftp server serving the files of a temporary directory,
+// to test the loadings over sftp end to end without docker
+type sftpTestServer struct {
+	listener net.Listener
+	dir      string
+}
+
+func startSFTPTestServer(require *require.Assertions) *sftpTestServer {
+	dir, err := ioutil.TempDir("", "sytralrt")
+	require.Nil(err)
+	return &sftpTestServer{listener: startSSHServer(require), dir: dir}
+}
+
+// Close stops the server and removes its directory
+func (s *sftpTestServer) Close() {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
+
+// writeFile adds a file to the served directory
+func (s *sftpTestServer) writeFile(require *require.Assertions, name, content string) {
+	require.Nil(ioutil.WriteFile(s.dir+"/"+name, []byte(content), 0644))
+}
+
+// copyFixture adds a file of the fixtures to the served directory
+func (s *sftpTestServer) copyFixture(require *require.Assertions, name string) {
+	content, err := ioutil.ReadFile(fixtureDir + "/" + name)
+	require.Nil(err)
+	s.writeFile(require, name, string(content))
+}
+
+// uri returns the sftp uri of a file of the served directory
+func (s *sftpTestServer) uri(user *url.Userinfo, name string) url.URL {
+	return url.URL{Scheme: "sftp", User: user, Host: s.listener.Addr().String(), Path: s.dir + "/" + name}
+}
+
+// cuttingProxy forwards the connections to a server, the next connections can be cut once a number of
+// bytes have been sent back to the client, like connections lost in the middle of a transfer
+type cuttingProxy struct {
+	listener net.Listener
+	target   string
+	mutex    sync.Mutex
+	cuts     int
+	limit    int64
+}
+
+func startCuttingProxy(require *require.Assertions, target string) *cuttingProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	proxy := &cuttingProxy{listener: listener, target: target}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go proxy.forward(conn)
+		}
+	}()
+	return proxy
+}
+
+// cut makes the next cuts connections be closed after limit bytes sent to the client
+func (p *cuttingProxy) cut(cuts int, limit int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.cuts, p.limit = cuts, limit
+}
+
+func (p *cuttingProxy) forward(conn net.Conn) {
+	defer conn.Close()
+	server, err := net.Dial("tcp", p.target)
+	if err != nil {
+		return
+	}
+	defer server.Close()
+
+	p.mutex.Lock()
+	limit := int64(-1)
+	if p.cuts > 0 {
+		p.cuts--
+		limit = p.limit
+	}
+	p.mutex.Unlock()
+
+	go io.Copy(server, conn)
+	if limit < 0 {
+		io.Copy(conn, server)
+	} else {
+		io.CopyN(conn, server, limit)
+	}
+}
+
+func (p *cuttingProxy) Close() {
+	p.listener.Close()
+}
+
+// uri returns the uri of a file of the sftp server through the proxy
+func (p *cuttingProxy) uri(server *sftpTestServer, user *url.Userinfo, name string) url.URL {
+	uri := server.uri(user, name)
+	uri.Host = p.listener.Addr().String()
+	return uri
+}
@@ -2,15 +2,20 @@ package sytralrt
 
 import (
 	"fmt"
+	"net/url"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type LineConsumer interface {
 	Consume([]string, *time.Location) error
 	Terminate()
+	// ExpectedFields is the minimal number of fields a line must have to be consumed
+	ExpectedFields() int
 }
 
 // Departure represent a departure for a public transport vehicle
@@ -21,49 +26,222 @@ type Departure struct {
 	Direction     string    `json:"direction"`
 	DirectionName string    `json:"direction_name"`
 	Datetime      time.Time `json:"datetime"`
-	//VJ            string
+	// LineID is the line normalized with NormalizeLineID, the departures are filtered by line on it
+	LineID string `json:"-"`
+	// StopName and StopCoord come from the stops reference data, they are only set in the responses
+	StopName  string `json:"stop_name,omitempty"`
+	StopCoord *Coord `json:"stop_coord,omitempty"`
+	// TripID is the vehicle journey of the departure, from the eighth column of the CSV extracts or the
+	// DatedVehicleJourneyRef of SIRI, it is only published in the GTFS-RT feed
+	TripID string `json:"-"`
 	//Route         string
 }
 
+// DateLayouts are the layouts, in the format of the time package, of the dates and times read from a source.
+// The fields holding both are read with the date layout followed by a space and the time layout.
+type DateLayouts struct {
+	Date string
+	Time string
+}
+
+// DefaultDateLayouts are the layouts used by the Sytral
+var DefaultDateLayouts = DateLayouts{Date: "2006-01-02", Time: "15:04:05"}
+
+// withDefaults returns the layouts with the missing ones replaced by their default
+func (l DateLayouts) withDefaults() DateLayouts {
+	if l.Date == "" {
+		l.Date = DefaultDateLayouts.Date
+	}
+	if l.Time == "" {
+		l.Time = DefaultDateLayouts.Time
+	}
+	return l
+}
+
+// DateTime is the layout of the fields holding both a date and a time
+func (l DateLayouts) DateTime() string {
+	return l.Date + " " + l.Time
+}
+
+// parseTime parses value with layout, the error names both of them. An hour of 24 or more is on the next
+// days of the service day: 25:10:00 is 01:10:00 the day after.
+func parseTime(layout, value string, location *time.Location) (time.Time, error) {
+	t, err := time.ParseInLocation(layout, value, location)
+	if perr, ok := err.(*time.ParseError); ok && perr.LayoutElem == "15" && perr.Message == ": hour out of range" {
+		// the hour is right before the part of value left to parse
+		end := len(value) - len(perr.ValueElem)
+		if end >= 2 {
+			if hour, convErr := strconv.Atoi(value[end-2 : end]); convErr == nil && hour >= 24 {
+				wrapped := fmt.Sprintf("%s%02d%s", value[:end-2], hour%24, value[end:])
+				if t, err = time.ParseInLocation(layout, wrapped, location); err == nil {
+					t = t.AddDate(0, 0, hour/24)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected layout %q", value, layout)
+	}
+	return t, nil
+}
+
 func NewDeparture(record []string, location *time.Location) (Departure, error) {
+	return newDeparture(record, location, DefaultDateLayouts, 1)
+}
+
+// newDeparture reads a departure whose line is in the column lineColumn of the record
+func newDeparture(record []string, location *time.Location, layouts DateLayouts, lineColumn int) (Departure, error) {
 	if len(record) < 7 {
 		return Departure{}, fmt.Errorf("Missing field in record")
 	}
-	dt, err := time.ParseInLocation("2006-01-02 15:04:05", record[5], location)
+	if lineColumn >= len(record) {
+		return Departure{}, fmt.Errorf("Missing line column %d in record", lineColumn)
+	}
+	dt, err := parseTime(layouts.DateTime(), record[5], location)
 	if err != nil {
 		return Departure{}, err
 	}
 
-	return Departure{
+	departure := Departure{
 		Stop:          record[0],
-		Line:          record[1],
+		Line:          record[lineColumn],
 		Type:          record[4],
 		Datetime:      dt,
 		Direction:     record[6],
 		DirectionName: record[2],
-	}, nil
+	}
+	if len(record) > 7 {
+		departure.TripID = record[7]
+	}
+	return departure, nil
+}
+
+// Fields of a Departure on which a DepartureFilter can apply
+const (
+	DepartureStopField      = "stop"
+	DepartureLineField      = "line"
+	DepartureTypeField      = "type"
+	DepartureDirectionField = "direction"
+)
+
+// DepartureFilter keeps the departures whose field has one of the values
+type DepartureFilter struct {
+	field  string
+	values map[string]bool
+}
+
+// NewDepartureFilter creates a filter keeping the departures whose field (stop, line, type or direction)
+// is one of values
+func NewDepartureFilter(field string, values []string) (*DepartureFilter, error) {
+	switch field {
+	case DepartureStopField, DepartureLineField, DepartureTypeField, DepartureDirectionField:
+	default:
+		return nil, fmt.Errorf("Unsupported departure field %q", field)
+	}
+	filter := &DepartureFilter{field: field, values: make(map[string]bool, len(values))}
+	for _, value := range values {
+		if field == DepartureLineField {
+			value = NormalizeLineID(value)
+		}
+		filter.values[value] = true
+	}
+	return filter, nil
+}
+
+// ParseDepartureFilter reads a filter written field=value1,value2...
+func ParseDepartureFilter(filter string) (*DepartureFilter, error) {
+	kv := strings.SplitN(filter, "=", 2)
+	if len(kv) != 2 {
+		return nil, fmt.Errorf("invalid departures filter %q, format is field=value1,value2", filter)
+	}
+	var values []string
+	for _, value := range strings.Split(kv[1], ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return NewDepartureFilter(strings.TrimSpace(kv[0]), values)
+}
+
+// Match tells whether the departure is kept by the filter, a nil filter keeps every departure
+func (f *DepartureFilter) Match(departure Departure) bool {
+	if f == nil {
+		return true
+	}
+	switch f.field {
+	case DepartureStopField:
+		return f.values[departure.Stop]
+	case DepartureLineField:
+		lineID := departure.LineID
+		if lineID == "" {
+			lineID = NormalizeLineID(departure.Line)
+		}
+		return f.values[lineID]
+	case DepartureTypeField:
+		return f.values[departure.Type]
+	case DepartureDirectionField:
+		return f.values[departure.Direction]
+	}
+	return false
 }
 
 // DepartureLineConsumer constructs a departure from a slice of strings
 type DepartureLineConsumer struct {
-	data map[string][]Departure
+	data    map[string][]Departure
+	layouts DateLayouts
+	// filter drops the departures it doesn't match, they are counted in filtered
+	filter   *DepartureFilter
+	filtered int
+	// directionColumn is the column of the direction, the default one is used if nil
+	directionColumn *int
+	// lineColumn is the column of the line in the CSV files, the default one is used if nil
+	lineColumn *int
+	// lineElement is the element of the MonitoredVehicleJourney holding the line in SIRI data, LineRef if empty
+	lineElement string
 }
 
 func makeDepartureLineConsumer() *DepartureLineConsumer {
-	return &DepartureLineConsumer{make(map[string][]Departure)}
+	return makeDepartureLineConsumerWithLayouts(DefaultDateLayouts)
+}
+
+func makeDepartureLineConsumerWithLayouts(layouts DateLayouts) *DepartureLineConsumer {
+	return &DepartureLineConsumer{data: make(map[string][]Departure), layouts: layouts.withDefaults()}
+}
+
+// add keeps the departure if it matches the filter, its LineID is set
+func (p *DepartureLineConsumer) add(departure Departure) {
+	departure.LineID = NormalizeLineID(departure.Line)
+	if !p.filter.Match(departure) {
+		p.filtered++
+		return
+	}
+	p.data[departure.Stop] = append(p.data[departure.Stop], departure)
 }
 
 func (p *DepartureLineConsumer) Consume(line []string, loc *time.Location) error {
 
-	departure, err := NewDeparture(line, loc)
+	lineColumn := 1
+	if p.lineColumn != nil {
+		lineColumn = *p.lineColumn
+	}
+	departure, err := newDeparture(line, loc, p.layouts, lineColumn)
 	if err != nil {
 		return err
 	}
+	if p.directionColumn != nil {
+		// the direction is only for display, a line without it is still a valid departure
+		departure.Direction = ""
+		if column := *p.directionColumn; column >= 0 && column < len(line) {
+			departure.Direction = line[column]
+		}
+	}
 
-	p.data[departure.Stop] = append(p.data[departure.Stop], departure)
+	p.add(departure)
 	return nil
 }
 
+func (p *DepartureLineConsumer) ExpectedFields() int { return 7 }
+
 func (p *DepartureLineConsumer) Terminate() {
 	//sort the departures
 	for _, v := range p.data {
@@ -73,6 +251,29 @@ func (p *DepartureLineConsumer) Terminate() {
 	}
 }
 
+// NormalizeStopID casefolds a stop id so that the lookups don't depend on its case
+func NormalizeStopID(stopID string) string {
+	return strings.ToLower(stopID)
+}
+
+// NormalizeLineID trims and upper cases a line so that the feeds writing the lines
+// differently, like " t1" and "T1", give the same line
+func NormalizeLineID(line string) string {
+	return strings.ToUpper(strings.TrimSpace(line))
+}
+
+// normalizeStopIDs indexes the departures by normalized stop id,
+// the departures of stops differing only by their case are merged
+func normalizeStopIDs(departures map[string][]Departure) map[string][]Departure {
+	consumer := makeDepartureLineConsumer()
+	for stopID, stopDepartures := range departures {
+		key := NormalizeStopID(stopID)
+		consumer.data[key] = append(consumer.data[key], stopDepartures...)
+	}
+	consumer.Terminate()
+	return consumer.data
+}
+
 // Parking defines details and spaces available for P+R parkings
 type Parking struct {
 	ID                        string    `json:"Id"`
@@ -82,6 +283,8 @@ type Parking struct {
 	AvailableAccessibleSpaces int       `json:"available_accessible_space"`
 	TotalStandardSpaces       int       `json:"available_normal_space"`
 	TotalAccessibleSpaces     int       `json:"total_space"`
+	// Coord is only known if the lat and lon columns are mapped and filled
+	Coord *Coord `json:"coord,omitempty"`
 }
 
 type ByParkingId []Parking
@@ -90,57 +293,185 @@ func (p ByParkingId) Len() int           { return len(p) }
 func (p ByParkingId) Less(i, j int) bool { return p[i].ID < p[j].ID }
 func (p ByParkingId) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// ParkingFields maps the fields of a Parking to the index of their column in the CSV lines
+type ParkingFields map[string]int
+
+// Names of the fields of a Parking in ParkingFields, they are all required
+const (
+	ParkingIDField                        = "id"
+	ParkingLabelField                     = "label"
+	ParkingUpdatedTimeField               = "updated_time"
+	ParkingAvailableStandardSpacesField   = "available_standard_spaces"
+	ParkingTotalStandardSpacesField       = "total_standard_spaces"
+	ParkingAvailableAccessibleSpacesField = "available_accessible_spaces"
+	ParkingTotalAccessibleSpacesField     = "total_accessible_spaces"
+)
+
+// Names of the optional fields of a Parking in ParkingFields, absent from the extract of the Sytral.
+// They must be mapped together.
+const (
+	ParkingLatField = "lat"
+	ParkingLonField = "lon"
+)
+
+// DefaultParkingFields is the layout of the parkings extract of the Sytral
+var DefaultParkingFields = ParkingFields{
+	ParkingIDField:                        0, // COD_PAR_REL
+	ParkingLabelField:                     1, // LIB_PAR_REL
+	ParkingUpdatedTimeField:               2, // DATEHEURE_COMPTAGE
+	ParkingAvailableStandardSpacesField:   4, // NB_TOT_PLACE_DISPO
+	ParkingTotalStandardSpacesField:       5, // CAP_VEH_NOR
+	ParkingAvailableAccessibleSpacesField: 6, // NB_TOT_PLACE_PMR_DISPO
+	ParkingTotalAccessibleSpacesField:     7, // CAP_VEH_PMR
+}
+
+// ParseParkingFields reads a list of name=index, the fields that aren't listed keep their default index
+func ParseParkingFields(list []string) (ParkingFields, error) {
+	fields := make(ParkingFields, len(DefaultParkingFields))
+	for name, index := range DefaultParkingFields {
+		fields[name] = index
+	}
+	for _, field := range list {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid parking field %q, format is name=index", field)
+		}
+		name := strings.TrimSpace(kv[0])
+		if _, ok := DefaultParkingFields[name]; !ok && name != ParkingLatField && name != ParkingLonField {
+			return nil, fmt.Errorf("unknown parking field %q", name)
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid index %q for parking field %s", kv[1], name)
+		}
+		fields[name] = index
+	}
+	_, lat := fields[ParkingLatField]
+	_, lon := fields[ParkingLonField]
+	if lat != lon {
+		return nil, fmt.Errorf("parking fields %s and %s must be mapped together", ParkingLatField, ParkingLonField)
+	}
+	return fields, nil
+}
+
+// minFields is the number of fields a line must have to contain every mapped column
+func (f ParkingFields) minFields() int {
+	min := 0
+	for _, index := range f {
+		if index+1 > min {
+			min = index + 1
+		}
+	}
+	return min
+}
+
 // NewParking creates a new Parking object based on a line read from a CSV
 func NewParking(record []string, location *time.Location) (*Parking, error) {
-	if len(record) < 8 {
-		return nil, fmt.Errorf("Missing field in Parking record")
+	return NewParkingWithFields(record, location, DefaultParkingFields)
+}
+
+// NewParkingWithFields creates a new Parking object based on a line read from a CSV
+// whose columns are given by fields
+func NewParkingWithFields(record []string, location *time.Location, fields ParkingFields) (*Parking, error) {
+	return newParking(record, location, fields, DefaultDateLayouts)
+}
+
+func newParking(record []string, location *time.Location, fields ParkingFields, layouts DateLayouts) (*Parking, error) {
+	for name := range DefaultParkingFields {
+		index, ok := fields[name]
+		if !ok {
+			return nil, fmt.Errorf("No column mapped for field %s of Parking record", name)
+		}
+		if index < 0 || index >= len(record) {
+			return nil, fmt.Errorf("Missing field %s (column %d) in Parking record of %d fields",
+				name, index, len(record))
+		}
 	}
 
-	updatedTime, err := time.ParseInLocation("2006-01-02 15:04:05", record[2], location)
+	updatedTime, err := parseTime(layouts.DateTime(), record[fields[ParkingUpdatedTimeField]], location)
 	if err != nil {
 		return nil, err
 	}
-	availableStd, err := strconv.Atoi(record[4])
+	availableStd, err := strconv.Atoi(record[fields[ParkingAvailableStandardSpacesField]])
 	if err != nil {
 		return nil, err
 	}
-	totalStd, err := strconv.Atoi(record[5])
+	totalStd, err := strconv.Atoi(record[fields[ParkingTotalStandardSpacesField]])
 	if err != nil {
 		return nil, err
 	}
-	availableAcc, err := strconv.Atoi(record[6])
+	availableAcc, err := strconv.Atoi(record[fields[ParkingAvailableAccessibleSpacesField]])
 	if err != nil {
 		return nil, err
 	}
-	totalAcc, err := strconv.Atoi(record[7])
+	totalAcc, err := strconv.Atoi(record[fields[ParkingTotalAccessibleSpacesField]])
+	if err != nil {
+		return nil, err
+	}
+
+	coord, err := parkingCoord(record, fields)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Parking{
-		ID:                        record[0],    // COD_PAR_REL
-		Label:                     record[1],    // LIB_PAR_REL
-		UpdatedTime:               updatedTime,  // DATEHEURE_COMPTAGE
-		AvailableStandardSpaces:   availableStd, // NB_TOT_PLACE_DISPO
-		AvailableAccessibleSpaces: availableAcc, // NB_TOT_PLACE_PMR_DISPO
-		TotalStandardSpaces:       totalStd,     // CAP_VEH_NOR
-		TotalAccessibleSpaces:     totalAcc,     // CAP_VEH_PMR
+		ID:                        record[fields[ParkingIDField]],
+		Label:                     record[fields[ParkingLabelField]],
+		UpdatedTime:               updatedTime,
+		AvailableStandardSpaces:   availableStd,
+		AvailableAccessibleSpaces: availableAcc,
+		TotalStandardSpaces:       totalStd,
+		TotalAccessibleSpaces:     totalAcc,
+		Coord:                     coord,
 	}, nil
 }
 
+// parkingCoord reads the coordinates of a parking, nil if their columns aren't mapped or are empty
+func parkingCoord(record []string, fields ParkingFields) (*Coord, error) {
+	latIndex, ok := fields[ParkingLatField]
+	lonIndex, _ := fields[ParkingLonField]
+	if !ok || latIndex >= len(record) || lonIndex >= len(record) {
+		return nil, nil
+	}
+	latStr, lonStr := strings.TrimSpace(record[latIndex]), strings.TrimSpace(record[lonIndex])
+	if latStr == "" || lonStr == "" {
+		return nil, nil
+	}
+	lat, err := strconv.ParseFloat(latStr, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid latitude %q in Parking record", latStr)
+	}
+	lon, err := strconv.ParseFloat(lonStr, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid longitude %q in Parking record", lonStr)
+	}
+	return &Coord{Lat: lat, Lon: lon}, nil
+}
+
 // ParkingLineConsumer constructs a parking from a slice of strings
 type ParkingLineConsumer struct {
 	parkings map[string]Parking
+	fields   ParkingFields
+	layouts  DateLayouts
 }
 
 func makeParkingLineConsumer() *ParkingLineConsumer {
+	return makeParkingLineConsumerWithFields(DefaultParkingFields, DefaultDateLayouts)
+}
+
+func makeParkingLineConsumerWithFields(fields ParkingFields, layouts DateLayouts) *ParkingLineConsumer {
+	if fields == nil {
+		fields = DefaultParkingFields
+	}
 	return &ParkingLineConsumer{
 		parkings: make(map[string]Parking),
+		fields:   fields,
+		layouts:  layouts.withDefaults(),
 	}
 }
 
 func (p *ParkingLineConsumer) Consume(line []string, loc *time.Location) error {
-	parking, err := NewParking(line, loc)
+	parking, err := newParking(line, loc, p.fields, p.layouts)
 	if err != nil {
 		return err
 	}
@@ -151,6 +482,146 @@ func (p *ParkingLineConsumer) Consume(line []string, loc *time.Location) error {
 
 func (p *ParkingLineConsumer) Terminate() {}
 
+func (p *ParkingLineConsumer) ExpectedFields() int { return p.fields.minFields() }
+
+// BikeStation defines the availability of a bike-share station
+type BikeStation struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	BikesAvailable  int       `json:"bikes_available"`
+	DocksAvailable  int       `json:"docks_available"`
+	LastUpdatedTime time.Time `json:"last_updated"`
+}
+
+type ByBikeStationId []BikeStation
+
+func (b ByBikeStationId) Len() int           { return len(b) }
+func (b ByBikeStationId) Less(i, j int) bool { return b[i].ID < b[j].ID }
+func (b ByBikeStationId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// NewBikeStation creates a new BikeStation object based on a line read from a CSV
+func NewBikeStation(record []string, location *time.Location) (*BikeStation, error) {
+	return newBikeStation(record, location, DefaultDateLayouts)
+}
+
+func newBikeStation(record []string, location *time.Location, layouts DateLayouts) (*BikeStation, error) {
+	if len(record) < 5 {
+		return nil, fmt.Errorf("Missing field in BikeStation record")
+	}
+
+	bikes, err := strconv.Atoi(record[2])
+	if err != nil {
+		return nil, err
+	}
+	docks, err := strconv.Atoi(record[3])
+	if err != nil {
+		return nil, err
+	}
+	lastUpdated, err := parseTime(layouts.DateTime(), record[4], location)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BikeStation{
+		ID:              record[0],
+		Name:            record[1],
+		BikesAvailable:  bikes,
+		DocksAvailable:  docks,
+		LastUpdatedTime: lastUpdated,
+	}, nil
+}
+
+// BikeStationLineConsumer constructs a bike station from a slice of strings
+type BikeStationLineConsumer struct {
+	bikeStations map[string]BikeStation
+	layouts      DateLayouts
+}
+
+func makeBikeStationLineConsumer() *BikeStationLineConsumer {
+	return makeBikeStationLineConsumerWithLayouts(DefaultDateLayouts)
+}
+
+func makeBikeStationLineConsumerWithLayouts(layouts DateLayouts) *BikeStationLineConsumer {
+	return &BikeStationLineConsumer{
+		bikeStations: make(map[string]BikeStation),
+		layouts:      layouts.withDefaults(),
+	}
+}
+
+func (b *BikeStationLineConsumer) Consume(line []string, loc *time.Location) error {
+	station, err := newBikeStation(line, loc, b.layouts)
+	if err != nil {
+		return err
+	}
+
+	b.bikeStations[station.ID] = *station
+	return nil
+}
+
+func (b *BikeStationLineConsumer) Terminate() {}
+
+func (b *BikeStationLineConsumer) ExpectedFields() int { return 5 }
+
+// Coord is a WGS84 position
+type Coord struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Stop is the reference data of a stop, used to enrich the departures
+type Stop struct {
+	ID    string
+	Name  string
+	Coord Coord
+}
+
+// NewStop creates a new Stop object based on a line read from a CSV: id, name, lat, lon
+func NewStop(record []string) (*Stop, error) {
+	if len(record) < 4 {
+		return nil, fmt.Errorf("Missing field in Stop record")
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid latitude %q for stop %s", record[2], record[0])
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(record[3]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid longitude %q for stop %s", record[3], record[0])
+	}
+
+	return &Stop{
+		ID:    record[0],
+		Name:  record[1],
+		Coord: Coord{Lat: lat, Lon: lon},
+	}, nil
+}
+
+// StopLineConsumer constructs a stop from a slice of strings
+type StopLineConsumer struct {
+	stops map[string]Stop
+}
+
+func makeStopLineConsumer() *StopLineConsumer {
+	return &StopLineConsumer{
+		stops: make(map[string]Stop),
+	}
+}
+
+func (s *StopLineConsumer) Consume(line []string, loc *time.Location) error {
+	stop, err := NewStop(line)
+	if err != nil {
+		return err
+	}
+
+	s.stops[stop.ID] = *stop
+	return nil
+}
+
+func (s *StopLineConsumer) Terminate() {}
+
+func (s *StopLineConsumer) ExpectedFields() int { return 4 }
+
 // EquipmentDetail defines how a equipment object is represented in a response
 type EquipmentDetail struct {
 	ID                  string              `json:"id"`
@@ -159,6 +630,12 @@ type EquipmentDetail struct {
 	CurrentAvailability CurrentAvailability `json:"current_availaibity"`
 }
 
+type ByEquipmentId []EquipmentDetail
+
+func (e ByEquipmentId) Len() int           { return len(e) }
+func (e ByEquipmentId) Less(i, j int) bool { return e[i].ID < e[j].ID }
+func (e ByEquipmentId) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
 type CurrentAvailability struct {
 	Status    string    `json:"status"`
 	Cause     Cause     `json:"cause"`
@@ -191,38 +668,184 @@ func EmbeddedType(s string) (string, error) {
 	}
 }
 
-// NewEquipmentDetail creates a new EquipmentDetail object from the object EquipementSource
-func NewEquipmentDetail(es EquipementSource, updatedAt time.Time, location *time.Location) (*EquipmentDetail, error) {
-	start, err := time.ParseInLocation("2006-01-02", es.Start, location)
-	if err != nil {
-		return nil, err
+// EquipmentFields is a set of attributes of the equipments, identified by the names below
+type EquipmentFields map[string]bool
+
+// Names of the attributes of an equipment in EquipmentFields
+const (
+	EquipmentIDField      = "id"
+	EquipmentNameField    = "name"
+	EquipmentTypeField    = "type"
+	EquipmentCauseField   = "cause"
+	EquipmentEffectField  = "effect"
+	EquipmentStartField   = "start_date"
+	EquipmentEndField     = "end_date"
+	EquipmentEndTimeField = "end_time"
+)
+
+// DefaultEquipmentRequiredFields are the attributes without which an equipment can't be loaded,
+// the other attributes are optional
+var DefaultEquipmentRequiredFields = EquipmentFields{
+	EquipmentTypeField:    true,
+	EquipmentStartField:   true,
+	EquipmentEndField:     true,
+	EquipmentEndTimeField: true,
+}
+
+// ParseEquipmentFields reads a list of attribute names
+func ParseEquipmentFields(list []string) (EquipmentFields, error) {
+	fields := make(EquipmentFields, len(list))
+	for _, name := range list {
+		name = strings.TrimSpace(name)
+		switch name {
+		case EquipmentIDField, EquipmentNameField, EquipmentTypeField, EquipmentCauseField,
+			EquipmentEffectField, EquipmentStartField, EquipmentEndField, EquipmentEndTimeField:
+			fields[name] = true
+		default:
+			return nil, fmt.Errorf("unknown equipment field %q", name)
+		}
 	}
+	return fields, nil
+}
 
-	end, err := time.ParseInLocation("2006-01-02", es.End, location)
-	if err != nil {
-		return nil, err
+// missingFields returns the names of the attributes of es that are missing or empty
+func (es EquipementSource) missingFields() []string {
+	var missing []string
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{EquipmentIDField, es.ID},
+		{EquipmentNameField, es.Name},
+		{EquipmentTypeField, es.Type},
+		{EquipmentCauseField, es.Cause},
+		{EquipmentEffectField, es.Effect},
+		{EquipmentStartField, es.Start},
+		{EquipmentEndField, es.End},
+		{EquipmentEndTimeField, es.Hour},
+	} {
+		if strings.TrimSpace(field.value) == "" {
+			missing = append(missing, field.name)
+		}
 	}
+	return missing
+}
 
-	hour, err := time.ParseInLocation("15:04:05", es.Hour, location)
-	if err != nil {
-		return nil, err
+// checkFields returns an error if a required attribute of es is missing, and whether optional ones are
+func (es EquipementSource) checkFields(required EquipmentFields) (incomplete bool, err error) {
+	for _, name := range es.missingFields() {
+		if required[name] {
+			return false, fmt.Errorf("Missing required attribute %s for equipment %q", name, es.ID)
+		}
+		incomplete = true
+	}
+	return incomplete, nil
+}
+
+// Normalized statuses of the equipments
+const (
+	EquipmentAvailable    = "available"
+	EquipmentUnavailable  = "unavailable"
+	EquipmentOutOfService = "out_of_service"
+	// EquipmentUnknown is the status of the equipments whose raw status isn't in the EquipmentStatuses
+	EquipmentUnknown = "unknown"
+)
+
+// EquipmentStatuses maps the raw status codes of the provider to the normalized statuses. Without
+// mapping, or for the equipments without raw status, the status is computed from the unavailability dates.
+type EquipmentStatuses map[string]string
+
+// ParseEquipmentStatuses reads a list of code=status, status being available, unavailable or out_of_service
+func ParseEquipmentStatuses(list []string) (EquipmentStatuses, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	statuses := make(EquipmentStatuses, len(list))
+	for _, item := range list {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid equipment status %q, code=status expected", item)
+		}
+		code, status := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch status {
+		case EquipmentAvailable, EquipmentUnavailable, EquipmentOutOfService:
+		default:
+			return nil, fmt.Errorf("unknown equipment status %q for code %q", status, code)
+		}
+		if _, ok := statuses[code]; ok {
+			return nil, fmt.Errorf("equipment status code %q mapped twice", code)
+		}
+		statuses[code] = status
 	}
+	return statuses, nil
+}
 
-	// Add time part to end date
-	end = hour.AddDate(end.Year(), int(end.Month())-1, end.Day()-1)
+// status returns the normalized status of a raw status code, EquipmentUnknown if it isn't mapped
+func (s EquipmentStatuses) status(code string) string {
+	if status, ok := s[code]; ok {
+		return status
+	}
+	unknownEquipmentStatuses.Inc()
+	return EquipmentUnknown
+}
 
-	etype, err := EmbeddedType(es.Type)
-	if err != nil {
+// NewEquipmentDetail creates a new EquipmentDetail object from the object EquipementSource,
+// the DefaultEquipmentRequiredFields must be present
+func NewEquipmentDetail(es EquipementSource, updatedAt time.Time, location *time.Location) (*EquipmentDetail, error) {
+	if _, err := es.checkFields(DefaultEquipmentRequiredFields); err != nil {
 		return nil, err
 	}
-	now := time.Now()
+	return newEquipmentDetail(es, updatedAt, location, time.Now(), DefaultDateLayouts, nil)
+}
 
+// newEquipmentDetail creates an EquipmentDetail whose status is computed at now. The missing
+// attributes are left empty: without start date the unavailability has no beginning, without
+// end date it has no end and without end time it ends at midnight. The raw status of the equipment
+// is used instead if statuses is set.
+func newEquipmentDetail(es EquipementSource, updatedAt time.Time, location *time.Location,
+	now time.Time, layouts DateLayouts, statuses EquipmentStatuses) (*EquipmentDetail, error) {
+	var start, end time.Time
+	var err error
+	if es.Start != "" {
+		if start, err = parseTime(layouts.Date, es.Start, location); err != nil {
+			return nil, err
+		}
+	}
+
+	if es.End != "" {
+		if end, err = parseTime(layouts.Date, es.End, location); err != nil {
+			return nil, err
+		}
+		if es.Hour != "" {
+			hour, err := parseTime(layouts.Time, es.Hour, location)
+			if err != nil {
+				return nil, err
+			}
+			// Add time part to end date
+			end = hour.AddDate(end.Year(), int(end.Month())-1, end.Day()-1)
+		}
+	}
+
+	var etype string
+	if es.Type != "" {
+		if etype, err = EmbeddedType(es.Type); err != nil {
+			return nil, err
+		}
+	}
+
+	status := GetEquipmentStatus(start, end, now)
+	if end.IsZero() && !now.Before(start) {
+		status = EquipmentUnavailable
+	}
+	if statuses != nil && es.Status != "" {
+		status = statuses.status(es.Status)
+	}
 	return &EquipmentDetail{
 		ID:           es.ID,
 		Name:         es.Name,
 		EmbeddedType: etype,
 		CurrentAvailability: CurrentAvailability{
-			Status:    GetEquipmentStatus(start, end, now),
+			Status:    status,
 			Cause:     Cause{Label: es.Cause},
 			Effect:    Effect{Label: es.Effect},
 			Periods:   []Period{Period{Begin: start, End: end}},
@@ -230,10 +853,66 @@ func NewEquipmentDetail(es EquipementSource, updatedAt time.Time, location *time
 	}, nil
 }
 
+// Names of the data types handled by sytralrt
+const (
+	DeparturesDataType   = "departures"
+	ParkingsDataType     = "parkings"
+	EquipmentsDataType   = "equipments"
+	BikeStationsDataType = "bikestations"
+	StopsDataType        = "stops"
+)
+
+// LoadStatus describes the outcome of the loading of a data type
+type LoadStatus struct {
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	// FirstSuccess is the time of the first successful loading since the start
+	FirstSuccess time.Time `json:"first_success"`
+	// ConsecutiveFailures is the number of attempts that failed since the last success
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// SanityError is the reason why the data of the last success failed their sanity check, if they did
+	SanityError string `json:"sanity_error,omitempty"`
+}
+
+// Clock gives the current time to a DataManager, it allows tests to use a fixed time
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// DataManager holds the data served. Each Update method builds the new data entirely, then replaces
+// the previous data by assigning a single pointer under the write lock of the data type: the readers see
+// either the previous data or the new one, never a partial update. The data given to the Update methods
+// must not be modified afterwards.
 type DataManager struct {
+	// version is incremented each time a data type is updated, it is first to be aligned for atomic operations
+	version uint64
+
+	clock Clock
+	// network labels the metrics of the loadings, "" for the main network
+	network string
+
+	// updateMutex serializes the updates, so that they build the new data from the current one without
+	// holding the write lock that blocks the readers
+	updateMutex sync.Mutex
+
 	departures          *map[string][]Departure
 	lastDepartureUpdate time.Time
 	departuresMutex     sync.RWMutex
+	// departuresVersion is incremented by each update of the departures
+	departuresVersion uint64
+	// stopVersions is the departuresVersion at which the departures of each stop last changed,
+	// the stops removed from the departures included until they are pruned by an update of the stops
+	stopVersions map[string]uint64
+	// prunedVersion is the last version of the stops pruned from stopVersions, the changes asked since
+	// an older version could miss their removal
+	prunedVersion uint64
+	// departuresUpdated is closed by the next update of the departures, nil if nobody waits for it
+	departuresUpdated chan struct{}
 
 	parkings          *map[string]Parking
 	lastParkingUpdate time.Time
@@ -242,14 +921,520 @@ type DataManager struct {
 	equipments          *[]EquipmentDetail
 	lastEquipmentUpdate time.Time
 	equipmentsMutex     sync.RWMutex
+	// equipmentsSeen is the last time each equipment was part of a merge
+	equipmentsSeen map[string]time.Time
+
+	bikeStations          *map[string]BikeStation
+	lastBikeStationUpdate time.Time
+	bikeStationsMutex     sync.RWMutex
+
+	stops           *map[string]Stop
+	lastStopsUpdate time.Time
+	stopsMutex      sync.RWMutex
+	// stopsNormalized tells that the stops are indexed by NormalizeStopID
+	stopsNormalized bool
+
+	loadStatuses      map[string]LoadStatus
+	loadStatusesMutex sync.RWMutex
+
+	// refreshMutexes prevent two loadings of the same data type from running at the same time
+	refreshMutexes      map[string]*sync.Mutex
+	refreshMutexesMutex sync.Mutex
+
+	rawData      map[string]RawData
+	rawDataMutex sync.RWMutex
+
+	// rangeOffsets is the part of the file of each data type loaded by the partial refreshes
+	rangeOffsets      map[string]rangeOffset
+	rangeOffsetsMutex sync.Mutex
+
+	// draining is 1 once the service is shutting down
+	draining int32
+	// drainingStarted is closed once the service is shutting down, nil if nobody waits for it
+	drainingStarted chan struct{}
+	drainingMutex   sync.Mutex
+}
+
+// SetClock replaces the real time used by the DataManager, it must be called before using the DataManager
+func (d *DataManager) SetClock(clock Clock) {
+	d.clock = clock
+}
+
+// SetNetwork names the network whose data is managed, the metrics of its loadings are labelled with it.
+// It must be called before loading data.
+func (d *DataManager) SetNetwork(name string) {
+	d.network = name
+}
+
+// Network returns the name of the network whose data is managed, "" for the main network
+func (d *DataManager) Network() string {
+	return d.network
+}
+
+// Now returns the current time according to the clock of the DataManager
+func (d *DataManager) Now() time.Time {
+	if d.clock == nil {
+		return realClock{}.Now()
+	}
+	return d.clock.Now()
+}
+
+// Version changes each time any data is updated, the responses computed from the data
+// can be reused as long as it doesn't change
+func (d *DataManager) Version() uint64 {
+	return atomic.LoadUint64(&d.version)
+}
+
+// SetDraining marks the service as shutting down, it isn't ready anymore but keeps serving the requests,
+// the departures streams excepted
+func (d *DataManager) SetDraining(draining bool) {
+	d.drainingMutex.Lock()
+	defer d.drainingMutex.Unlock()
+
+	var value int32
+	if draining {
+		value = 1
+	}
+	if atomic.SwapInt32(&d.draining, value) == value {
+		return
+	}
+	if draining {
+		if d.drainingStarted == nil {
+			d.drainingStarted = make(chan struct{})
+		}
+		close(d.drainingStarted)
+	} else {
+		d.drainingStarted = nil
+	}
+}
+
+// DrainingStarted returns a channel closed once the service is shutting down
+func (d *DataManager) DrainingStarted() <-chan struct{} {
+	d.drainingMutex.Lock()
+	defer d.drainingMutex.Unlock()
+
+	if d.drainingStarted == nil {
+		d.drainingStarted = make(chan struct{})
+		if d.IsDraining() {
+			close(d.drainingStarted)
+		}
+	}
+	return d.drainingStarted
+}
+
+// IsDraining tells if the service is shutting down
+func (d *DataManager) IsDraining() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// Snapshot is a consistent view of the data of a DataManager, a nil field means this data type isn't loaded
+type Snapshot struct {
+	Departures   map[string][]Departure `json:"departures"`
+	Parkings     map[string]Parking     `json:"parkings"`
+	Equipments   []EquipmentDetail      `json:"equipments"`
+	BikeStations map[string]BikeStation `json:"bike_stations"`
+	Stops        map[string]Stop        `json:"stops"`
+	// StopsNormalized tells that the stops are indexed by NormalizeStopID
+	StopsNormalized bool `json:"stops_normalized,omitempty"`
+	// UpdatedAt is the time of the last update of each data type of the snapshot
+	UpdatedAt map[string]time.Time `json:"updated_at,omitempty"`
+}
+
+// Snapshot returns the departures, parkings, equipments, bike stations and stops as they are at a single
+// point in time
+func (d *DataManager) Snapshot() Snapshot {
+	d.departuresMutex.RLock()
+	defer d.departuresMutex.RUnlock()
+	d.parkingsMutex.RLock()
+	defer d.parkingsMutex.RUnlock()
+	d.equipmentsMutex.RLock()
+	defer d.equipmentsMutex.RUnlock()
+	d.bikeStationsMutex.RLock()
+	defer d.bikeStationsMutex.RUnlock()
+	d.stopsMutex.RLock()
+	defer d.stopsMutex.RUnlock()
+
+	snapshot := Snapshot{UpdatedAt: make(map[string]time.Time)}
+	if d.departures != nil {
+		snapshot.Departures = *d.departures
+		snapshot.UpdatedAt[DeparturesDataType] = d.lastDepartureUpdate
+	}
+	if d.parkings != nil {
+		snapshot.Parkings = *d.parkings
+		snapshot.UpdatedAt[ParkingsDataType] = d.lastParkingUpdate
+	}
+	if d.equipments != nil {
+		snapshot.Equipments = *d.equipments
+		snapshot.UpdatedAt[EquipmentsDataType] = d.lastEquipmentUpdate
+	}
+	if d.bikeStations != nil {
+		snapshot.BikeStations = *d.bikeStations
+		snapshot.UpdatedAt[BikeStationsDataType] = d.lastBikeStationUpdate
+	}
+	if d.stops != nil {
+		snapshot.Stops = *d.stops
+		snapshot.StopsNormalized = d.stopsNormalized
+		snapshot.UpdatedAt[StopsDataType] = d.lastStopsUpdate
+	}
+	return snapshot
+}
+
+// restoreUpdate dates the data of a type restored from a snapshot, and their last successful loading, back to
+// their update before the snapshot was taken, so that they keep their age. They stay dated now if at is zero.
+func (d *DataManager) restoreUpdate(dataType string, at time.Time) {
+	d.updateLoadStatus(dataType, nil)
+	if at.IsZero() {
+		return
+	}
+	switch dataType {
+	case DeparturesDataType:
+		d.departuresMutex.Lock()
+		d.lastDepartureUpdate = at
+		d.departuresMutex.Unlock()
+	case ParkingsDataType:
+		d.parkingsMutex.Lock()
+		d.lastParkingUpdate = at
+		d.parkingsMutex.Unlock()
+	case EquipmentsDataType:
+		d.equipmentsMutex.Lock()
+		d.lastEquipmentUpdate = at
+		d.equipmentsMutex.Unlock()
+	case BikeStationsDataType:
+		d.bikeStationsMutex.Lock()
+		d.lastBikeStationUpdate = at
+		d.bikeStationsMutex.Unlock()
+	case StopsDataType:
+		d.stopsMutex.Lock()
+		d.lastStopsUpdate = at
+		d.stopsMutex.Unlock()
+	}
+
+	d.loadStatusesMutex.Lock()
+	defer d.loadStatusesMutex.Unlock()
+	status := d.loadStatuses[dataType]
+	status.LastAttempt, status.LastSuccess, status.FirstSuccess = at, at, at
+	d.loadStatuses[dataType] = status
+	lastSuccessTimestamp.WithLabelValues(dataType, d.network).Set(float64(at.Unix()))
+}
+
+// RawData is the file of the last successful loading of a data type
+type RawData struct {
+	Content     []byte
+	ContentType string
+	// Truncated is true if the file was bigger than the maximum size kept
+	Truncated bool
+	LoadedAt  time.Time
+}
+
+// updateRawData replaces the raw data of a data type
+func (d *DataManager) updateRawData(dataType string, raw RawData) {
+	d.rawDataMutex.Lock()
+	defer d.rawDataMutex.Unlock()
+
+	if d.rawData == nil {
+		d.rawData = make(map[string]RawData)
+	}
+	d.rawData[dataType] = raw
+}
+
+// GetRawData returns the file of the last successful loading of a data type, if it has been kept
+func (d *DataManager) GetRawData(dataType string) (RawData, bool) {
+	d.rawDataMutex.RLock()
+	defer d.rawDataMutex.RUnlock()
+
+	raw, ok := d.rawData[dataType]
+	return raw, ok
+}
+
+// rangeOffset is the number of bytes of the file at uri already loaded
+type rangeOffset struct {
+	uri    string
+	offset int64
+	// validator is the ETag or the Last-Modified of the file loaded, sent as If-Range
+	validator string
+}
+
+// rangeOffset returns the number of bytes of the file at uri loaded by the partial refreshes of a data type
+// and the validator of this file, 0 if it hasn't been loaded yet
+func (d *DataManager) rangeOffset(dataType string, uri url.URL) (int64, string) {
+	d.rangeOffsetsMutex.Lock()
+	defer d.rangeOffsetsMutex.Unlock()
+
+	if offset, ok := d.rangeOffsets[dataType]; ok && offset.uri == uri.String() {
+		return offset.offset, offset.validator
+	}
+	return 0, ""
+}
+
+// setRangeOffset records the number of bytes of the file at uri loaded and the validator of the file,
+// a negative offset forgets them
+func (d *DataManager) setRangeOffset(dataType string, uri url.URL, offset int64, validator string) {
+	d.rangeOffsetsMutex.Lock()
+	defer d.rangeOffsetsMutex.Unlock()
+
+	if offset < 0 {
+		delete(d.rangeOffsets, dataType)
+		return
+	}
+	if d.rangeOffsets == nil {
+		d.rangeOffsets = make(map[string]rangeOffset)
+	}
+	d.rangeOffsets[dataType] = rangeOffset{uri.String(), offset, validator}
+}
+
+// lockRefresh waits for the loading of dataType in progress, if any, it returns the function to call
+// once the loading is over
+func (d *DataManager) lockRefresh(dataType string) (unlock func()) {
+	d.refreshMutexesMutex.Lock()
+	if d.refreshMutexes == nil {
+		d.refreshMutexes = make(map[string]*sync.Mutex)
+	}
+	mutex, ok := d.refreshMutexes[dataType]
+	if !ok {
+		mutex = &sync.Mutex{}
+		d.refreshMutexes[dataType] = mutex
+	}
+	d.refreshMutexesMutex.Unlock()
+
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// updateLoadStatus records the result of an attempt to load a data type
+func (d *DataManager) updateLoadStatus(dataType string, err error) {
+	d.loadStatusesMutex.Lock()
+	defer d.loadStatusesMutex.Unlock()
+
+	if d.loadStatuses == nil {
+		d.loadStatuses = make(map[string]LoadStatus)
+	}
+	status := d.loadStatuses[dataType]
+	status.LastAttempt = d.Now()
+	if err != nil {
+		status.LastError = err.Error()
+		status.ConsecutiveFailures++
+	} else {
+		status.LastSuccess = status.LastAttempt
+		if status.FirstSuccess.IsZero() {
+			status.FirstSuccess = status.LastSuccess
+		}
+		status.LastError = ""
+		status.ConsecutiveFailures = 0
+		lastSuccessTimestamp.WithLabelValues(dataType, d.network).Set(float64(status.LastSuccess.Unix()))
+	}
+	d.loadStatuses[dataType] = status
+}
+
+// setSanityError records the outcome of the sanity check of the data last loaded, problem is empty if they passed it
+func (d *DataManager) setSanityError(dataType, problem string) {
+	d.loadStatusesMutex.Lock()
+	defer d.loadStatusesMutex.Unlock()
+
+	if d.loadStatuses == nil {
+		d.loadStatuses = make(map[string]LoadStatus)
+	}
+	status := d.loadStatuses[dataType]
+	status.SanityError = problem
+	d.loadStatuses[dataType] = status
+}
+
+// getLoadStatuses returns a copy of the outcomes of the loading of every data type
+func (d *DataManager) getLoadStatuses() map[string]LoadStatus {
+	d.loadStatusesMutex.RLock()
+	defer d.loadStatusesMutex.RUnlock()
+
+	statuses := make(map[string]LoadStatus, len(d.loadStatuses))
+	for dataType, status := range d.loadStatuses {
+		statuses[dataType] = status
+	}
+	return statuses
+}
+
+// GetLoadStatus returns the outcome of the loading of a data type
+func (d *DataManager) GetLoadStatus(dataType string) LoadStatus {
+	d.loadStatusesMutex.RLock()
+	defer d.loadStatusesMutex.RUnlock()
+
+	return d.loadStatuses[dataType]
 }
 
 func (d *DataManager) UpdateDepartures(departures map[string][]Departure) {
+	d.updateMutex.Lock()
+	defer d.updateMutex.Unlock()
+
+	d.updateDepartures(departures)
+}
+
+// AppendDepartures adds departures to the current ones, like the departures of the lines appended to a file,
+// and returns all the departures. A departure replaces the current one of its stop with the same departureKey,
+// and the departures already past are dropped since the file only grows. The departures of each stop stay
+// sorted by time.
+func (d *DataManager) AppendDepartures(departures map[string][]Departure) map[string][]Departure {
+	d.updateMutex.Lock()
+	defer d.updateMutex.Unlock()
+
+	now := d.Now()
+	merged := make(map[string][]Departure)
+	if d.departures != nil {
+		for stop, stopDepartures := range *d.departures {
+			merged[stop] = stopDepartures
+		}
+	}
+	for stop, stopDepartures := range departures {
+		appended := make(map[string]bool, len(stopDepartures))
+		all := make([]Departure, 0, len(merged[stop])+len(stopDepartures))
+		// the last line of a departure is the most recent one
+		for i := len(stopDepartures) - 1; i >= 0; i-- {
+			if key := departureKey(stopDepartures[i]); !appended[key] {
+				appended[key] = true
+				all = append(all, stopDepartures[i])
+			}
+		}
+		for _, departure := range merged[stop] {
+			if !appended[departureKey(departure)] {
+				all = append(all, departure)
+			}
+		}
+		sort.SliceStable(all, func(i, j int) bool {
+			return all[i].Datetime.Before(all[j].Datetime)
+		})
+		merged[stop] = all
+	}
+	for stop, stopDepartures := range merged {
+		past := sort.Search(len(stopDepartures), func(i int) bool {
+			return !stopDepartures[i].Datetime.Before(now)
+		})
+		if past == len(stopDepartures) {
+			delete(merged, stop)
+		} else if past > 0 {
+			merged[stop] = stopDepartures[past:]
+		}
+	}
+	d.updateDepartures(merged)
+	return merged
+}
+
+// departureKey identifies a departure of a stop across the partial refreshes: its trip, or its line,
+// direction and time if the source has no trips
+func departureKey(departure Departure) string {
+	if departure.TripID != "" {
+		return departure.TripID
+	}
+	return departure.Line + "|" + departure.Direction + "|" + departure.Datetime.String()
+}
+
+// updateDepartures replaces the departures, the caller must hold the updateMutex
+func (d *DataManager) updateDepartures(departures map[string][]Departure) {
+	// the writers are serialized, the current data can be read without lock
+	version := d.departuresVersion + 1
+	stopVersions := make(map[string]uint64, len(d.stopVersions))
+	for stop, stopVersion := range d.stopVersions {
+		stopVersions[stop] = stopVersion
+	}
+	var previous map[string][]Departure
+	if d.departures != nil {
+		previous = *d.departures
+	}
+	for stop, stopDepartures := range departures {
+		if previousDepartures, ok := previous[stop]; !ok || !sameDepartures(previousDepartures, stopDepartures) {
+			stopVersions[stop] = version
+		}
+	}
+	for stop := range previous {
+		if _, ok := departures[stop]; !ok {
+			stopVersions[stop] = version
+		}
+	}
+	now := d.Now()
+
+	d.departuresMutex.Lock()
+	d.departures = &departures
+	d.departuresVersion = version
+	d.stopVersions = stopVersions
+	d.lastDepartureUpdate = now
+	if d.departuresUpdated != nil {
+		close(d.departuresUpdated)
+		d.departuresUpdated = nil
+	}
+	d.departuresMutex.Unlock()
+	atomic.AddUint64(&d.version, 1)
+}
+
+// sameDepartures tells whether two lists hold the same departures in the same order
+func sameDepartures(a, b []Departure) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Line != b[i].Line || a[i].Stop != b[i].Stop || a[i].Type != b[i].Type ||
+			a[i].Direction != b[i].Direction || a[i].DirectionName != b[i].DirectionName ||
+			!a[i].Datetime.Equal(b[i].Datetime) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetDeparturesChangedSince returns the departures of the stops whose departures changed after version,
+// the stops removed since then and the current version of the departures. All the departures are returned
+// if version is 0, isn't a version given by the DataManager or is older than the removals forgotten since.
+func (d *DataManager) GetDeparturesChangedSince(version uint64) (changed map[string][]Departure, removed []string, current uint64, err error) {
+	d.departuresMutex.RLock()
+	defer d.departuresMutex.RUnlock()
+
+	if d.departures == nil {
+		return nil, nil, 0, fmt.Errorf("no departures")
+	}
+	if version == 0 || version > d.departuresVersion || version < d.prunedVersion {
+		return *d.departures, nil, d.departuresVersion, nil
+	}
+
+	changed = make(map[string][]Departure)
+	for stop, stopVersion := range d.stopVersions {
+		if stopVersion <= version {
+			continue
+		}
+		if departures, ok := (*d.departures)[stop]; ok {
+			changed[stop] = departures
+		} else {
+			removed = append(removed, stop)
+		}
+	}
+	sort.Strings(removed)
+	return changed, removed, d.departuresVersion, nil
+}
+
+// DeparturesUpdated returns a channel closed by the next update of the departures
+func (d *DataManager) DeparturesUpdated() <-chan struct{} {
 	d.departuresMutex.Lock()
 	defer d.departuresMutex.Unlock()
 
-	d.departures = &departures
-	d.lastDepartureUpdate = time.Now()
+	if d.departuresUpdated == nil {
+		d.departuresUpdated = make(chan struct{})
+	}
+	return d.departuresUpdated
+}
+
+// lookupStopVersion returns the departures of a stop like LookupDeparturesByStop, along with the version
+// of the departures at which they last changed, 0 if the stop has never been in the departures.
+// The departures lock isn't held while the stops reference data are read.
+func (d *DataManager) lookupStopVersion(stopID string) ([]Departure, bool, uint64, error) {
+	d.departuresMutex.RLock()
+	if d.departures == nil {
+		d.departuresMutex.RUnlock()
+		return []Departure{}, false, 0, fmt.Errorf("no departures")
+	}
+	departures := (*d.departures)[stopID]
+	version, known := d.stopVersions[stopID]
+	d.departuresMutex.RUnlock()
+
+	if departures == nil {
+		departures = []Departure{}
+	}
+	if !known {
+		_, known = d.GetStop(stopID)
+	}
+	return departures, known, version, nil
 }
 
 func (d *DataManager) GetLastDepartureDataUpdate() time.Time {
@@ -259,25 +1444,70 @@ func (d *DataManager) GetLastDepartureDataUpdate() time.Time {
 	return d.lastDepartureUpdate
 }
 
-func (d *DataManager) GetDeparturesByStop(stopID string) ([]Departure, error) {
+// DeparturesCount returns the number of departures of all the stops, without copying them
+func (d *DataManager) DeparturesCount() int {
+	d.departuresMutex.RLock()
+	defer d.departuresMutex.RUnlock()
 
-	var departures []Departure
-	{
-		d.departuresMutex.RLock()
-		defer d.departuresMutex.RUnlock()
+	if d.departures == nil {
+		return 0
+	}
+	count := 0
+	for _, departures := range *d.departures {
+		count += len(departures)
+	}
+	return count
+}
 
-		if d.departures == nil {
-			return []Departure{}, fmt.Errorf("no departures")
-		}
+// CountDeparturesByLine returns the number of departures of each line, by LineID, of all the stops or only
+// of stopID if it isn't empty, without copying the departures
+func (d *DataManager) CountDeparturesByLine(stopID string) (map[string]int, error) {
+	d.departuresMutex.RLock()
+	defer d.departuresMutex.RUnlock()
 
-		departures = (*d.departures)[stopID]
+	if d.departures == nil {
+		return nil, fmt.Errorf("no departures")
+	}
+	counts := make(map[string]int)
+	for stop, departures := range *d.departures {
+		if stopID != "" && stop != stopID {
+			continue
+		}
+		for _, departure := range departures {
+			lineID := departure.LineID
+			if lineID == "" {
+				lineID = NormalizeLineID(departure.Line)
+			}
+			counts[lineID]++
+		}
 	}
+	return counts, nil
+}
 
-	if departures == nil {
-		//there is no departures for this stop, we return an empty slice
-		return []Departure{}, nil
+func (d *DataManager) GetDeparturesByStop(stopID string) ([]Departure, error) {
+	departures, _, err := d.LookupDeparturesByStop(stopID)
+	return departures, err
+}
+
+// LookupDeparturesByStop returns the departures of a stop and whether this stop is known.
+// A stop is known once it has been in the departures data, even if its departures have all passed since,
+// or if it is in the stops reference data. A stop no longer in the departures is forgotten when the stops
+// reference data are updated without it.
+func (d *DataManager) LookupDeparturesByStop(stopID string) ([]Departure, bool, error) {
+	departures, known, _, err := d.lookupStopVersion(stopID)
+	return departures, known, err
+}
+
+// IsKnownStop tells if the stop has been in the departures data or is in the stops reference data
+func (d *DataManager) IsKnownStop(stopID string) bool {
+	d.departuresMutex.RLock()
+	_, known := d.stopVersions[stopID]
+	d.departuresMutex.RUnlock()
+
+	if !known {
+		_, known = d.GetStop(stopID)
 	}
-	return departures, nil
+	return known
 }
 
 func (d *DataManager) UpdateParkings(parkings map[string]Parking) {
@@ -285,7 +1515,8 @@ func (d *DataManager) UpdateParkings(parkings map[string]Parking) {
 	defer d.parkingsMutex.Unlock()
 
 	d.parkings = &parkings
-	d.lastParkingUpdate = time.Now()
+	d.lastParkingUpdate = d.Now()
+	atomic.AddUint64(&d.version, 1)
 }
 
 func (d *DataManager) GetLastParkingsDataUpdate() time.Time {
@@ -295,6 +1526,17 @@ func (d *DataManager) GetLastParkingsDataUpdate() time.Time {
 	return d.lastParkingUpdate
 }
 
+// ParkingsCount returns the number of parkings, without copying them
+func (d *DataManager) ParkingsCount() int {
+	d.parkingsMutex.RLock()
+	defer d.parkingsMutex.RUnlock()
+
+	if d.parkings == nil {
+		return 0
+	}
+	return len(*d.parkings)
+}
+
 func (d *DataManager) GetParkingsByIds(ids []string) (parkings []Parking, errors []error) {
 	for _, id := range ids {
 		if p, err := d.GetParkingById(id); err == nil {
@@ -351,12 +1593,254 @@ func (d *DataManager) GetParkingById(id string) (p Parking, e error) {
 	return p, e
 }
 
+func (d *DataManager) UpdateBikeStations(bikeStations map[string]BikeStation) {
+	d.bikeStationsMutex.Lock()
+	defer d.bikeStationsMutex.Unlock()
+
+	d.bikeStations = &bikeStations
+	d.lastBikeStationUpdate = d.Now()
+	atomic.AddUint64(&d.version, 1)
+}
+
+func (d *DataManager) GetLastBikeStationsDataUpdate() time.Time {
+	d.bikeStationsMutex.RLock()
+	defer d.bikeStationsMutex.RUnlock()
+
+	return d.lastBikeStationUpdate
+}
+
+func (d *DataManager) GetBikeStationsByIds(ids []string) (bikeStations []BikeStation, errors []error) {
+	for _, id := range ids {
+		if b, err := d.GetBikeStationById(id); err == nil {
+			bikeStations = append(bikeStations, b)
+		} else {
+			errors = append(errors, err)
+		}
+	}
+	return
+}
+
+func (d *DataManager) GetBikeStations() (bikeStations []BikeStation, e error) {
+	var mapBikeStations map[string]BikeStation
+	{
+		d.bikeStationsMutex.RLock()
+		defer d.bikeStationsMutex.RUnlock()
+
+		if d.bikeStations == nil {
+			e = fmt.Errorf("No bike stations in the data")
+			return
+		}
+
+		mapBikeStations = *d.bikeStations
+	}
+
+	bikeStations = make([]BikeStation, 0, len(mapBikeStations))
+	for _, b := range mapBikeStations {
+		bikeStations = append(bikeStations, b)
+	}
+
+	return bikeStations, nil
+}
+
+func (d *DataManager) GetBikeStationById(id string) (b BikeStation, e error) {
+	var ok bool
+	{
+		d.bikeStationsMutex.RLock()
+		defer d.bikeStationsMutex.RUnlock()
+
+		if d.bikeStations == nil {
+			e = fmt.Errorf("No bike stations in the data")
+			return
+		}
+
+		b, ok = (*d.bikeStations)[id]
+	}
+
+	if !ok {
+		e = fmt.Errorf("No bike station found with id: %s", id)
+	}
+
+	return b, e
+}
+
+// UpdateStops replaces the stops reference data
+func (d *DataManager) UpdateStops(stops map[string]Stop) {
+	d.updateStops(stops, false)
+}
+
+// updateStops replaces the stops reference data, normalized tells that they are indexed by NormalizeStopID
+// so that they are looked up regardless of the case of the stop ids
+func (d *DataManager) updateStops(stops map[string]Stop, normalized bool) {
+	d.updateMutex.Lock()
+	defer d.updateMutex.Unlock()
+
+	d.stopsMutex.Lock()
+	d.stops = &stops
+	d.stopsNormalized = normalized
+	d.lastStopsUpdate = d.Now()
+	d.stopsMutex.Unlock()
+	d.pruneStopVersions()
+	atomic.AddUint64(&d.version, 1)
+}
+
+// pruneStopVersions forgets the stops removed from the departures that aren't in the stops reference data,
+// so that stopVersions doesn't keep every stop ever seen. The caller must hold the updateMutex.
+func (d *DataManager) pruneStopVersions() {
+	var departures map[string][]Departure
+	if d.departures != nil {
+		departures = *d.departures
+	}
+	stopVersions := make(map[string]uint64, len(d.stopVersions))
+	prunedVersion := d.prunedVersion
+	for stop, stopVersion := range d.stopVersions {
+		if _, ok := departures[stop]; ok {
+			stopVersions[stop] = stopVersion
+		} else if _, ok := d.GetStop(stop); ok {
+			stopVersions[stop] = stopVersion
+		} else if stopVersion > prunedVersion {
+			prunedVersion = stopVersion
+		}
+	}
+
+	d.departuresMutex.Lock()
+	d.stopVersions = stopVersions
+	d.prunedVersion = prunedVersion
+	d.departuresMutex.Unlock()
+}
+
+// stopKey is the key of a stop id in the stops reference data, it must be called with stopsMutex held
+func (d *DataManager) stopKey(id string) string {
+	if d.stopsNormalized {
+		return NormalizeStopID(id)
+	}
+	return id
+}
+
+func (d *DataManager) GetLastStopsDataUpdate() time.Time {
+	d.stopsMutex.RLock()
+	defer d.stopsMutex.RUnlock()
+
+	return d.lastStopsUpdate
+}
+
+// GetStop returns the reference data of a stop, ok is false if the stop is unknown or the stops aren't loaded
+func (d *DataManager) GetStop(id string) (stop Stop, ok bool) {
+	d.stopsMutex.RLock()
+	defer d.stopsMutex.RUnlock()
+
+	if d.stops == nil {
+		return Stop{}, false
+	}
+	stop, ok = (*d.stops)[d.stopKey(id)]
+	return stop, ok
+}
+
+// EnrichDepartures returns a copy of departures with the name and coordinates of their stop, the departures
+// of the stops absent from the reference data are left as is. departures is returned if no stops are loaded.
+func (d *DataManager) EnrichDepartures(departures []Departure) []Departure {
+	d.stopsMutex.RLock()
+	defer d.stopsMutex.RUnlock()
+
+	if d.stops == nil || len(departures) == 0 {
+		return departures
+	}
+	enriched := make([]Departure, len(departures))
+	for i, departure := range departures {
+		if stop, ok := (*d.stops)[d.stopKey(departure.Stop)]; ok {
+			coord := stop.Coord
+			departure.StopName = stop.Name
+			departure.StopCoord = &coord
+		}
+		enriched[i] = departure
+	}
+	return enriched
+}
+
+// UpdateEquipments replaces the equipments, they are sorted by ID so that they are always listed in the same order
 func (d *DataManager) UpdateEquipments(equipments []EquipmentDetail) {
-	d.equipmentsMutex.Lock()
-	defer d.equipmentsMutex.Unlock()
+	d.updateMutex.Lock()
+	defer d.updateMutex.Unlock()
+
+	d.setEquipments(equipments, nil)
+}
+
+// MergeEquipments updates and inserts the equipments by ID and leaves the others in place, for the feeds
+// giving only a part of the equipments. An equipment that hasn't been merged for more than ttl is removed,
+// they are never removed if ttl is 0.
+func (d *DataManager) MergeEquipments(equipments []EquipmentDetail, ttl time.Duration) {
+	now := d.Now()
+	d.updateMutex.Lock()
+	defer d.updateMutex.Unlock()
+
+	// the writers are serialized, the current data can be read without lock
+	seen := make(map[string]time.Time, len(d.equipmentsSeen))
+	for id, t := range d.equipmentsSeen {
+		seen[id] = t
+	}
+	byID := make(map[string]EquipmentDetail)
+	if d.equipments != nil {
+		for _, e := range *d.equipments {
+			byID[e.ID] = e
+			// the equipments loaded by UpdateEquipments are seen for the first time
+			if _, ok := seen[e.ID]; !ok {
+				seen[e.ID] = now
+			}
+		}
+	}
+	for _, e := range equipments {
+		byID[e.ID] = e
+		seen[e.ID] = now
+	}
+
+	merged := make([]EquipmentDetail, 0, len(byID))
+	for id, e := range byID {
+		if ttl > 0 && now.Sub(seen[id]) > ttl {
+			delete(seen, id)
+			continue
+		}
+		merged = append(merged, e)
+	}
+	d.setEquipments(merged, seen)
+}
+
+// setEquipments sorts and swaps the equipments and the times they were seen, updateMutex must be held
+func (d *DataManager) setEquipments(equipments []EquipmentDetail, seen map[string]time.Time) {
+	sort.Sort(ByEquipmentId(equipments))
+
+	if d.equipments != nil {
+		added, removed := diffEquipments(*d.equipments, equipments)
+		equipmentsAdded.Add(float64(added))
+		equipmentsRemoved.Add(float64(removed))
+	}
+	now := d.Now()
 
+	d.equipmentsMutex.Lock()
 	d.equipments = &equipments
-	d.lastEquipmentUpdate = time.Now()
+	d.equipmentsSeen = seen
+	d.lastEquipmentUpdate = now
+	d.equipmentsMutex.Unlock()
+	atomic.AddUint64(&d.version, 1)
+}
+
+// diffEquipments counts the equipments, by ID, added and removed from previous to next
+func diffEquipments(previous, next []EquipmentDetail) (added, removed int) {
+	previousIDs := make(map[string]bool, len(previous))
+	for _, e := range previous {
+		previousIDs[e.ID] = true
+	}
+	nextIDs := make(map[string]bool, len(next))
+	for _, e := range next {
+		if !previousIDs[e.ID] && !nextIDs[e.ID] {
+			added++
+		}
+		nextIDs[e.ID] = true
+	}
+	for id := range previousIDs {
+		if !nextIDs[id] {
+			removed++
+		}
+	}
+	return added, removed
 }
 
 func (d *DataManager) GetLastEquipmentsDataUpdate() time.Time {
@@ -366,6 +1850,17 @@ func (d *DataManager) GetLastEquipmentsDataUpdate() time.Time {
 	return d.lastEquipmentUpdate
 }
 
+// EquipmentsCount returns the number of equipments, without copying them
+func (d *DataManager) EquipmentsCount() int {
+	d.equipmentsMutex.RLock()
+	defer d.equipmentsMutex.RUnlock()
+
+	if d.equipments == nil {
+		return 0
+	}
+	return len(*d.equipments)
+}
+
 func (d *DataManager) GetEquipments() (equipments []EquipmentDetail, e error) {
 	var equipmentDetails []EquipmentDetail
 	{
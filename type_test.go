@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"encoding/xml"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -51,8 +55,13 @@ func TestNewDepartureInvalidDate(t *testing.T) {
 	_, err = NewDeparture([]string{"1", "2", "dest", "", "E", "2018-09-17 20:28", "3"}, location)
 	require.Error(err)
 
-	_, err = NewDeparture([]string{"1", "2", "dest", "", "E", "2018-09-17 25:28:00", "3"}, location)
+	_, err = NewDeparture([]string{"1", "2", "dest", "", "E", "2018-09-17 2a:28:00", "3"}, location)
 	require.Error(err)
+
+	// an hour of 24 or more is the next day
+	departure, err := NewDeparture([]string{"1", "2", "dest", "", "E", "2018-09-17 25:28:00", "3"}, location)
+	require.Nil(err)
+	require.Equal(time.Date(2018, 9, 18, 1, 28, 0, 0, location), departure.Datetime)
 }
 
 func TestDataManagerLastUpdate(t *testing.T) {
@@ -139,7 +148,7 @@ func TestDataManagerCanGetParkingById(t *testing.T) {
 
 	var manager DataManager
 	manager.UpdateParkings(map[string]Parking{
-		"toto": {"DECC", "Décines Centre", updateTime, 1, 2, 3, 4},
+		"toto": {"DECC", "Décines Centre", updateTime, 1, 2, 3, 4, nil},
 	})
 
 	p, err := manager.GetParkingById("toto")
@@ -162,6 +171,26 @@ func TestDataManagerShouldErrorOnEmptyData(t *testing.T) {
 	assert.Empty(p)
 }
 
+func TestDataManagerCounts(t *testing.T) {
+	assert := assert.New(t)
+
+	var manager DataManager
+	assert.Zero(manager.DeparturesCount())
+	assert.Zero(manager.ParkingsCount())
+	assert.Zero(manager.EquipmentsCount())
+
+	manager.UpdateDepartures(map[string][]Departure{
+		"1": {{Line: "C17", Stop: "1"}, {Line: "C17", Stop: "1"}},
+		"2": {{Line: "C20", Stop: "2"}},
+		"3": {},
+	})
+	manager.UpdateParkings(map[string]Parking{"DECC": {ID: "DECC"}, "PERI": {ID: "PERI"}})
+	manager.UpdateEquipments([]EquipmentDetail{{ID: "1"}})
+	assert.Equal(3, manager.DeparturesCount())
+	assert.Equal(2, manager.ParkingsCount())
+	assert.Equal(1, manager.EquipmentsCount())
+}
+
 func TestDataManagerShouldErrorOnEmptyData2(t *testing.T) {
 	assert := assert.New(t)
 
@@ -184,9 +213,9 @@ func TestDataManagerCanGetParkingByIds(t *testing.T) {
 
 	var manager DataManager
 	manager.UpdateParkings(map[string]Parking{
-		"riri":   {"Riri", "First of the name", updateTime, 1, 2, 3, 4},
-		"fifi":   {"Fifi", "Second of the name", updateTime, 1, 2, 3, 4},
-		"loulou": {"Loulou", "Third of the name", updateTime, 1, 2, 3, 4},
+		"riri":   {"Riri", "First of the name", updateTime, 1, 2, 3, 4, nil},
+		"fifi":   {"Fifi", "Second of the name", updateTime, 1, 2, 3, 4, nil},
+		"loulou": {"Loulou", "Third of the name", updateTime, 1, 2, 3, 4, nil},
 	})
 
 	p, errs := manager.GetParkingsByIds([]string{"riri", "loulou"})
@@ -207,9 +236,9 @@ func TestDataManagerCanPartiallyGetParkingByIds(t *testing.T) {
 
 	var manager DataManager
 	manager.UpdateParkings(map[string]Parking{
-		"riri":   {"Riri", "First of the name", updateTime, 1, 2, 3, 4},
-		"fifi":   {"Fifi", "Second of the name", updateTime, 1, 2, 3, 4},
-		"loulou": {"Loulou", "Third of the name", updateTime, 1, 2, 3, 4},
+		"riri":   {"Riri", "First of the name", updateTime, 1, 2, 3, 4, nil},
+		"fifi":   {"Fifi", "Second of the name", updateTime, 1, 2, 3, 4, nil},
+		"loulou": {"Loulou", "Third of the name", updateTime, 1, 2, 3, 4, nil},
 	})
 
 	p, errs := manager.GetParkingsByIds([]string{"fifi", "donald"})
@@ -231,9 +260,9 @@ func TestDataManagerGetParking(t *testing.T) {
 
 	var manager DataManager
 	manager.UpdateParkings(map[string]Parking{
-		"riri":   {"Riri", "First of the name", updateTime, 1, 2, 3, 4},
-		"fifi":   {"Fifi", "Second of the name", updateTime, 1, 2, 3, 4},
-		"loulou": {"Loulou", "Third of the name", updateTime, 1, 2, 3, 4},
+		"riri":   {"Riri", "First of the name", updateTime, 1, 2, 3, 4, nil},
+		"fifi":   {"Fifi", "Second of the name", updateTime, 1, 2, 3, 4, nil},
+		"loulou": {"Loulou", "Third of the name", updateTime, 1, 2, 3, 4, nil},
 	})
 
 	parkings, err := manager.GetParkings()
@@ -324,9 +353,10 @@ func TestDataManagerGetEquipments(t *testing.T) {
 	require.Nil(err)
 	require.Len(equipments, 3)
 
-	assert.Equal("toto", equipDetails[0].ID)
-	assert.Equal("tata", equipDetails[1].ID)
-	assert.Equal("titi", equipDetails[2].ID)
+	// the equipments are sorted by id
+	assert.Equal("tata", equipDetails[0].ID)
+	assert.Equal("titi", equipDetails[1].ID)
+	assert.Equal("toto", equipDetails[2].ID)
 }
 
 func TestEquipmentsWithBadEmbeddedType(t *testing.T) {
@@ -351,3 +381,439 @@ func TestEquipmentsWithBadEmbeddedType(t *testing.T) {
 		assert.Nil(ed)
 	}
 }
+
+func TestNewBikeStation(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	location, err := time.LoadLocation("Europe/Paris")
+	require.Nil(err)
+
+	bikeStationLine := []string{"1001", "Opéra", "4", "12", "2018-09-17 19:29:00"}
+
+	b, err := NewBikeStation(bikeStationLine, location)
+	require.Nil(err)
+	require.NotNil(b)
+
+	assert.Equal("1001", b.ID)
+	assert.Equal("Opéra", b.Name)
+	assert.Equal(4, b.BikesAvailable)
+	assert.Equal(12, b.DocksAvailable)
+	assert.Equal(time.Date(2018, 9, 17, 19, 29, 0, 0, location), b.LastUpdatedTime)
+}
+
+func TestNewBikeStationWithMalformedFields(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	location, err := time.LoadLocation("Europe/Paris")
+	require.Nil(err)
+
+	malformedBikeStationLines := [][]string{
+		{"1001", "Opéra", "4", "12"},
+		{"1001", "Opéra", "four", "12", "2018-09-17 19:29:00"},
+		{"1001", "Opéra", "4", "", "2018-09-17 19:29:00"},
+		{"1001", "Opéra", "4", "12", "this_should_be_a_date"},
+	}
+
+	for _, malformedLine := range malformedBikeStationLines {
+		b, err := NewBikeStation(malformedLine, location)
+		assert.Error(err)
+		assert.Nil(b)
+	}
+}
+
+func TestNewStopWithMalformedFields(t *testing.T) {
+	assert := assert.New(t)
+
+	malformedStopLines := [][]string{
+		{"1", "Mions Bourdelle", "45.6612"},
+		{"1", "Mions Bourdelle", "north", "4.9561"},
+		{"1", "Mions Bourdelle", "45.6612", ""},
+	}
+
+	for _, malformedLine := range malformedStopLines {
+		s, err := NewStop(malformedLine)
+		assert.Error(err)
+		assert.Nil(s)
+	}
+}
+
+func TestDataManagerSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	var manager DataManager
+	snapshot := manager.Snapshot()
+	assert.Nil(snapshot.Departures)
+	assert.Nil(snapshot.Parkings)
+	assert.Nil(snapshot.Equipments)
+
+	manager.UpdateDepartures(map[string][]Departure{"3": {{Stop: "3", Line: "C17"}}})
+	manager.UpdateParkings(map[string]Parking{"DECC": {ID: "DECC"}})
+	snapshot = manager.Snapshot()
+	assert.Len(snapshot.Departures["3"], 1)
+	assert.Contains(snapshot.Parkings, "DECC")
+	assert.Nil(snapshot.Equipments)
+}
+
+func TestDataManagerUpdatesAreAtomic(t *testing.T) {
+	assert := assert.New(t)
+
+	// each update gives every stop a departure of the line of this update
+	departures := func(update int) map[string][]Departure {
+		data := make(map[string][]Departure)
+		for stop := 0; stop < 100; stop++ {
+			id := strconv.Itoa(stop)
+			data[id] = []Departure{{Stop: id, Line: strconv.Itoa(update)}}
+		}
+		return data
+	}
+	var manager DataManager
+	manager.UpdateDepartures(departures(0))
+	manager.UpdateEquipments([]EquipmentDetail{})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				changed, _, version, err := manager.GetDeparturesChangedSince(0)
+				assert.Nil(err)
+				// all the stops come from the same update
+				line := changed["0"][0].Line
+				for _, stopDepartures := range changed {
+					assert.Equal(line, stopDepartures[0].Line)
+				}
+				assert.Equal(strconv.FormatUint(version-1, 10), line)
+				_, err = manager.GetEquipments()
+				assert.Nil(err)
+			}
+		}()
+	}
+	for update := 1; update <= 50; update++ {
+		manager.UpdateDepartures(departures(update))
+		manager.MergeEquipments([]EquipmentDetail{{ID: strconv.Itoa(update)}}, 0)
+	}
+	close(done)
+	wg.Wait()
+
+	equipments, err := manager.GetEquipments()
+	assert.Nil(err)
+	assert.Len(equipments, 50)
+}
+
+func TestDataManagerDeparturesChangedSince(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	_, _, _, err := manager.GetDeparturesChangedSince(0)
+	require.Error(err)
+
+	datetime := time.Date(2018, 9, 17, 20, 28, 0, 0, time.UTC)
+	manager.UpdateDepartures(map[string][]Departure{
+		"1": {{Stop: "1", Line: "C17", Datetime: datetime}},
+		"2": {{Stop: "2", Line: "C3", Datetime: datetime}},
+		"3": {{Stop: "3", Line: "T1", Datetime: datetime}},
+	})
+	changed, removed, first, err := manager.GetDeparturesChangedSince(0)
+	require.Nil(err)
+	assert.Len(changed, 3)
+	assert.Empty(removed)
+
+	// the departures of the stop 1 are the same, in another time zone
+	manager.UpdateDepartures(map[string][]Departure{
+		"1": {{Stop: "1", Line: "C17", Datetime: datetime.In(time.FixedZone("CEST", 2*3600))}},
+		"2": {{Stop: "2", Line: "C3", Datetime: datetime.Add(time.Minute)}},
+		"4": {{Stop: "4", Line: "T2", Datetime: datetime}},
+	})
+	changed, removed, second, err := manager.GetDeparturesChangedSince(first)
+	require.Nil(err)
+	assert.True(second > first)
+	assert.Len(changed, 2)
+	assert.Equal(datetime.Add(time.Minute), changed["2"][0].Datetime)
+	assert.Contains(changed, "4")
+	assert.Equal([]string{"3"}, removed)
+
+	changed, removed, current, err := manager.GetDeparturesChangedSince(second)
+	require.Nil(err)
+	assert.Equal(second, current)
+	assert.Empty(changed)
+	assert.Empty(removed)
+
+	// an unknown version gets all the departures
+	changed, _, _, err = manager.GetDeparturesChangedSince(second + 1)
+	require.Nil(err)
+	assert.Len(changed, 3)
+}
+
+func TestDataManagerPruneStopVersions(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var manager DataManager
+	manager.UpdateDepartures(map[string][]Departure{
+		"1": {{Stop: "1", Line: "C17"}},
+		"2": {{Stop: "2", Line: "C3"}},
+		"3": {{Stop: "3", Line: "T1"}},
+	})
+	_, _, first, err := manager.GetDeparturesChangedSince(0)
+	require.Nil(err)
+	manager.UpdateDepartures(map[string][]Departure{"1": {{Stop: "1", Line: "C17"}}})
+	_, removed, second, err := manager.GetDeparturesChangedSince(first)
+	require.Nil(err)
+	assert.Equal([]string{"2", "3"}, removed)
+	assert.True(manager.IsKnownStop("2"))
+
+	// the stops removed from the departures are only kept if they are in the stops
+	manager.UpdateStops(map[string]Stop{"3": {ID: "3"}})
+	assert.Len(manager.stopVersions, 2)
+	assert.False(manager.IsKnownStop("2"))
+	assert.True(manager.IsKnownStop("3"))
+
+	// the changes since a version older than the removal of a forgotten stop are all the departures
+	changed, removed, _, err := manager.GetDeparturesChangedSince(first)
+	require.Nil(err)
+	assert.Len(changed, 1)
+	assert.Empty(removed)
+	changed, removed, _, err = manager.GetDeparturesChangedSince(second)
+	require.Nil(err)
+	assert.Empty(changed)
+	assert.Empty(removed)
+}
+
+// fixedClock is a Clock that only moves when told to
+type fixedClock struct {
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time { return c.now }
+
+func TestDataManagerClock(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fixedClock{time.Date(2018, 9, 17, 19, 29, 0, 0, time.UTC)}
+	var manager DataManager
+	manager.SetClock(clock)
+
+	manager.UpdateParkings(map[string]Parking{})
+	assert.Equal(clock.now, manager.GetLastParkingsDataUpdate())
+	manager.updateLoadStatus(ParkingsDataType, nil)
+	assert.Equal(clock.now, manager.GetLoadStatus(ParkingsDataType).LastSuccess)
+
+	clock.now = clock.now.Add(time.Hour)
+	assert.Equal(clock.now, manager.Now())
+}
+
+func TestDiffEquipments(t *testing.T) {
+	assert := assert.New(t)
+
+	previous := []EquipmentDetail{{ID: "821"}, {ID: "8205"}, {ID: "8107"}}
+	next := []EquipmentDetail{{ID: "821"}, {ID: "901"}, {ID: "901"}}
+
+	added, removed := diffEquipments(previous, next)
+	assert.Equal(1, added)
+	assert.Equal(2, removed)
+
+	added, removed = diffEquipments(nil, previous)
+	assert.Equal(3, added)
+	assert.Equal(0, removed)
+}
+
+func TestDataManagerUpdateEquipmentsCountsChurn(t *testing.T) {
+	assert := assert.New(t)
+
+	var manager DataManager
+	added := testutil.ToFloat64(equipmentsAdded)
+	removed := testutil.ToFloat64(equipmentsRemoved)
+
+	// nothing is counted on the first load
+	manager.UpdateEquipments([]EquipmentDetail{{ID: "821"}, {ID: "8205"}})
+	assert.Equal(added, testutil.ToFloat64(equipmentsAdded))
+	assert.Equal(removed, testutil.ToFloat64(equipmentsRemoved))
+
+	manager.UpdateEquipments([]EquipmentDetail{{ID: "821"}, {ID: "901"}})
+	assert.Equal(added+1, testutil.ToFloat64(equipmentsAdded))
+	assert.Equal(removed+1, testutil.ToFloat64(equipmentsRemoved))
+}
+
+func TestNewParkingWithFields(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	location, err := time.LoadLocation("Europe/Paris")
+	require.Nil(err)
+
+	fields, err := ParseParkingFields([]string{
+		"id=1", "label=0", "updated_time=6", "available_standard_spaces=2",
+		"total_standard_spaces=3", "available_accessible_spaces=4", "total_accessible_spaces=5",
+	})
+	require.Nil(err)
+
+	parkingLine := []string{"Décines Centre", "DECC", "82", "105", "3", "4", "2018-09-17 19:29:00"}
+	p, err := NewParkingWithFields(parkingLine, location, fields)
+	require.Nil(err)
+	require.NotNil(p)
+
+	assert.Equal("DECC", p.ID)
+	assert.Equal("Décines Centre", p.Label)
+	assert.Equal(time.Date(2018, 9, 17, 19, 29, 0, 0, location), p.UpdatedTime)
+	assert.Equal(82, p.AvailableStandardSpaces)
+	assert.Equal(105, p.TotalStandardSpaces)
+	assert.Equal(3, p.AvailableAccessibleSpaces)
+	assert.Equal(4, p.TotalAccessibleSpaces)
+
+	// the mapped columns must be in the row
+	p, err = NewParkingWithFields(parkingLine[:6], location, fields)
+	assert.Error(err)
+	assert.Nil(p)
+}
+
+func TestNewParkingWithCoord(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	location, err := time.LoadLocation("Europe/Paris")
+	require.Nil(err)
+	fields, err := ParseParkingFields([]string{"lat=8", "lon=9"})
+	require.Nil(err)
+
+	line := []string{"DECC", "Décines Centre", "2018-09-17 19:29:00", "", "82", "105", "0", "3", "45.7687", "4.9580"}
+	p, err := NewParkingWithFields(line, location, fields)
+	require.Nil(err)
+	assert.Equal(&Coord{Lat: 45.7687, Lon: 4.9580}, p.Coord)
+
+	// the coordinates are optional
+	line[8] = ""
+	p, err = NewParkingWithFields(line, location, fields)
+	require.Nil(err)
+	assert.Nil(p.Coord)
+	p, err = NewParkingWithFields(line[:8], location, DefaultParkingFields)
+	require.Nil(err)
+	assert.Nil(p.Coord)
+
+	line[8] = "north"
+	_, err = NewParkingWithFields(line, location, fields)
+	assert.Error(err)
+
+	_, err = ParseParkingFields([]string{"lat=8"})
+	assert.Error(err)
+}
+
+func TestParseParkingFields(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	fields, err := ParseParkingFields(nil)
+	require.Nil(err)
+	assert.Equal(DefaultParkingFields, fields)
+
+	fields, err = ParseParkingFields([]string{"id=8"})
+	require.Nil(err)
+	assert.Equal(8, fields[ParkingIDField])
+	assert.Equal(1, fields[ParkingLabelField])
+	assert.Equal(9, makeParkingLineConsumerWithFields(fields, DateLayouts{}).ExpectedFields())
+	assert.Equal(0, DefaultParkingFields[ParkingIDField])
+
+	for _, list := range [][]string{{"id"}, {"name=1"}, {"id=a"}, {"id=-1"}} {
+		_, err = ParseParkingFields(list)
+		assert.Error(err, list)
+	}
+}
+
+func TestDataManagerMergeEquipments(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	clock := &fixedClock{time.Date(2018, 9, 17, 19, 29, 0, 0, time.UTC)}
+	var manager DataManager
+	manager.SetClock(clock)
+
+	equipment := func(id, name string) EquipmentDetail {
+		return EquipmentDetail{ID: id, Name: name, EmbeddedType: "elevator"}
+	}
+	manager.UpdateEquipments([]EquipmentDetail{equipment("a", "first"), equipment("b", "first")})
+
+	clock.now = clock.now.Add(time.Minute)
+	manager.MergeEquipments([]EquipmentDetail{equipment("b", "second"), equipment("c", "second")}, 0)
+	equipments, err := manager.GetEquipments()
+	require.Nil(err)
+	assert.Equal([]EquipmentDetail{equipment("a", "first"), equipment("b", "second"), equipment("c", "second")},
+		equipments)
+	assert.Equal(clock.now, manager.GetLastEquipmentsDataUpdate())
+
+	// without ttl nothing expires
+	clock.now = clock.now.Add(24 * time.Hour)
+	manager.MergeEquipments([]EquipmentDetail{equipment("c", "third")}, 0)
+	equipments, err = manager.GetEquipments()
+	require.Nil(err)
+	assert.Len(equipments, 3)
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	manager.MergeEquipments([]EquipmentDetail{equipment("b", "fourth")}, time.Minute)
+	equipments, err = manager.GetEquipments()
+	require.Nil(err)
+	assert.Equal([]EquipmentDetail{equipment("b", "fourth")}, equipments)
+}
+
+func TestDepartureFilter(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	filter, err := ParseDepartureFilter("line=87A, C3A")
+	require.Nil(err)
+	assert.True(filter.Match(Departure{Line: "87A"}))
+	assert.True(filter.Match(Departure{Line: "C3A"}))
+	assert.False(filter.Match(Departure{Line: "C3"}))
+	assert.False(filter.Match(Departure{Stop: "87A"}))
+	// the lines are compared once normalized
+	assert.True(filter.Match(Departure{Line: " c3a"}))
+	assert.True(filter.Match(Departure{Line: "c3a", LineID: "C3A"}))
+
+	filter, err = NewDepartureFilter(DepartureTypeField, []string{"T"})
+	require.Nil(err)
+	assert.True(filter.Match(Departure{Type: "T"}))
+	assert.False(filter.Match(Departure{Type: "E"}))
+
+	var none *DepartureFilter
+	assert.True(none.Match(Departure{Line: "87A"}))
+
+	for _, invalid := range []string{"line", "name=87A"} {
+		_, err = ParseDepartureFilter(invalid)
+		assert.Error(err, invalid)
+	}
+}
+
+func TestDataManagerRefreshesDontOverlap(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	uri, err := url.Parse(fmt.Sprintf("file://%s/oneline.txt", fixtureDir))
+	require.Nil(err)
+
+	var manager DataManager
+	// a loading of the departures is in progress
+	unlock := manager.lockRefresh(DeparturesDataType)
+
+	done := make(chan error)
+	go func() { done <- RefreshDepartures(&manager, *uri) }()
+	select {
+	case <-done:
+		t.Fatal("the departures have been loaded while another loading was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the other data types aren't blocked
+	parkingsUnlock := manager.lockRefresh(ParkingsDataType)
+	parkingsUnlock()
+
+	unlock()
+	assert.Nil(<-done)
+}